@@ -0,0 +1,346 @@
+package main
+
+import (
+
+	"strings"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Ownership rule - Restricts a function to the caller's own data
+//=======================================================================================================================
+
+type OwnershipRule int
+
+const (
+	OwnerAny        OwnershipRule = iota    // no restriction
+	OwnerUserArg                            // args[0] is a username that must be the caller's
+	OwnerImageArg                           // args[0] is an image ID that must belong to the caller, if given
+)
+
+//=======================================================================================================================
+// Organization scope rule - Restricts a function to the caller's organization, see Organizations.go
+//=======================================================================================================================
+
+type ScopeRule int
+
+const (
+	ScopeAny            ScopeRule = iota    // no restriction
+	ScopeUserArg                            // args[0] is a username of the caller's organization
+	ScopeImageArg                           // args[0] is an image ID of the caller's organization, if given
+	ScopeOrganizationArg                    // args[0] is the caller's organization
+)
+
+//=======================================================================================================================
+// Access policy - Who may call a function. Roles are participant types, RoleApprover stands for the approver roles
+// of the config; an empty list allows every caller. Roles in OwnerExempt are not bound by the ownership rule.
+//=======================================================================================================================
+
+const RoleApprover = "@approver"
+
+type AccessPolicy struct {
+
+	Roles           []string
+	Registered      bool                    // caller must map to a user
+	Attributes      map[string]string       // certificate attributes the caller must have
+	NetworkAdmin    bool                    // caller must be a network admin, see Organizations.go
+	Ownership       OwnershipRule
+	OwnerExempt     []string
+	Scope           ScopeRule
+
+}
+
+var privilegedRoles = []string{ParticipantMarketing, ParticipantAdmin}
+
+var accessPolicies = map[string]AccessPolicy{
+
+	// Functions updating the ledger
+	"addUser":                  {Roles: []string{ParticipantAdmin}},
+	"DemandImage":              {Roles: []string{ParticipantEmployee, ParticipantMarketing, ParticipantAdmin}},
+	"DeliverImage":             {Roles: []string{ParticipantMarketing, ParticipantAdmin}, Scope: ScopeImageArg},
+	"ApproveImageDemand":       {Roles: []string{RoleApprover}, Registered: true, Scope: ScopeImageArg},
+	"RejectImageDemand":        {Roles: []string{RoleApprover}, Registered: true, Scope: ScopeImageArg},
+	"MigrateLegacyIndexes":     {NetworkAdmin: true},
+	"ExpireLicenses":           {Roles: privilegedRoles},
+	"TransferImageLicense":     {Roles: []string{ParticipantEmployee, ParticipantMarketing, ParticipantAdmin}, Ownership: OwnerImageArg, OwnerExempt: privilegedRoles, Scope: ScopeImageArg},
+	"ArchiveImage":             {Roles: privilegedRoles, Scope: ScopeImageArg},
+	"AddOrganization":          {NetworkAdmin: true},
+	"SetBudget":                {Roles: privilegedRoles},
+	"AddProvider":              {NetworkAdmin: true},
+	"UpdateProvider":           {NetworkAdmin: true},
+	"AuthenticateAsUser":       {},
+	"UpgradePasswordHash":      {},
+
+	// Functions reading the ledger
+	"WhoAmI":                   {},
+	"getUsers":                 {Roles: privilegedRoles},
+	"GetImages":                {Roles: privilegedRoles},
+	"GetImagesByUser":          {Registered: true, Ownership: OwnerUserArg, OwnerExempt: privilegedRoles, Scope: ScopeUserArg},
+	"getImage":                 {Registered: true, Ownership: OwnerImageArg, OwnerExempt: privilegedRoles, Scope: ScopeImageArg},
+	"GetAllowedTransitions":    {Registered: true, Ownership: OwnerImageArg, OwnerExempt: privilegedRoles, Scope: ScopeImageArg},
+	"GetPendingApprovals":      {Roles: []string{RoleApprover}},
+	"VerifyImageByHash":        {Registered: true},
+	"FindSimilarImages":        {Registered: true},
+	"CheckUsageAllowed":        {Registered: true, Ownership: OwnerImageArg, OwnerExempt: privilegedRoles, Scope: ScopeImageArg},
+	"GetExpiringLicenses":      {Roles: privilegedRoles},
+	"GetImageHistory":          {Registered: true, Ownership: OwnerImageArg, OwnerExempt: privilegedRoles, Scope: ScopeImageArg},
+	"QueryImages":              {Roles: privilegedRoles},
+	"GetImagesByAuthor":        {Roles: privilegedRoles},
+	"GetImagesByStatus":        {Roles: privilegedRoles},
+	"GetImagesByProvider":      {Roles: privilegedRoles},
+	"RecordImagePurchase":      {Roles: privilegedRoles, Scope: ScopeImageArg},
+	"GetImagePurchaseRecord":   {Roles: privilegedRoles, Scope: ScopeImageArg},
+	"RevokeImageLicense":       {Roles: privilegedRoles, Scope: ScopeImageArg},
+	"GetRevokedImages":         {Roles: privilegedRoles},
+	"GetOrganization":          {Scope: ScopeOrganizationArg},
+	"GetImagesByOrganization":  {Roles: privilegedRoles, Scope: ScopeOrganizationArg},
+	"GetUsersByOrganization":   {Roles: privilegedRoles, Scope: ScopeOrganizationArg},
+	"GetBudgetStatus":          {Registered: true},
+	"GetProviders":             {},
+
+}
+
+//=======================================================================================================================
+// Access denied - The FORBIDDEN error of a failed policy check
+//=======================================================================================================================
+
+func accessDenied(function string, reason string) *ChaincodeError {
+
+	return NewError(CodeForbidden, "Access denied to " + function + ": " + reason)
+
+}
+
+//=======================================================================================================================
+//  Check access - Evaluate the policy of a function for the caller, before the function is dispatched
+//=======================================================================================================================
+
+func CheckAccess(stub shim.ChaincodeStubInterface, function string, args []string) error {
+
+	policy, ok := accessPolicies[function]
+
+	if !ok {
+
+		// Every function the chaincode dispatches has a policy
+		return NewError(CodeInvalidArgument, "Unknown function " + function)
+
+	}
+
+	if len(policy.Roles) == 0 && !policy.Registered && len(policy.Attributes) == 0 && !policy.NetworkAdmin && policy.Ownership == OwnerAny && policy.Scope == ScopeAny {
+
+		return nil
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return accessDenied(function, AsChaincodeError(err).Message)
+
+	}
+
+	if policy.Registered && caller.Username == "" {
+
+		return accessDenied(function, "caller " + caller.Subject + " is not registered as a user")
+
+	}
+
+	if policy.NetworkAdmin && !caller.IsNetworkAdmin() {
+
+		return accessDenied(function, "caller " + caller.Subject + " is not a network admin")
+
+	}
+
+	for name, value := range policy.Attributes {
+
+		if actual, found := caller.Attribute(name); !found || actual != value {
+
+			return accessDenied(function, "certificate attribute " + name + "=" + value + " is required")
+
+		}
+
+	}
+
+	if len(policy.Roles) > 0 {
+
+		allowed, err := hasRole(stub, caller, policy.Roles)
+
+		if err != nil {
+
+			return err
+
+		}
+
+		if !allowed {
+
+			return accessDenied(function, "role '" + caller.Role + "' is not one of " + strings.Join(policy.Roles, ", "))
+
+		}
+
+	}
+
+	if err = checkScope(stub, function, policy.Scope, caller, args); err != nil {
+
+		return err
+
+	}
+
+	if policy.Ownership == OwnerAny || len(args) == 0 {
+
+		return nil
+
+	}
+
+	exempt, err := hasRole(stub, caller, policy.OwnerExempt)
+
+	if err != nil || exempt {
+
+		return err
+
+	}
+
+	switch policy.Ownership {
+
+	case OwnerUserArg:
+
+		if args[0] != caller.Username {
+
+			return accessDenied(function, caller.Username + " can only access their own data")
+
+		}
+
+	case OwnerImageArg:
+
+		image, err := LoadImage(stub, args[0])
+
+		if HasCode(err, CodeNotFound) {
+
+			// Let the function report missing images
+			return nil
+
+		}
+
+		if err != nil {
+
+			return err
+
+		}
+
+		if image.User != caller.Username {
+
+			return accessDenied(function, "image " + image.ID + " does not belong to " + caller.Username)
+
+		}
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Check scope - Evaluate the organization scope rule of a function for the caller
+//=======================================================================================================================
+
+func checkScope(stub shim.ChaincodeStubInterface, function string, rule ScopeRule, caller Caller, args []string) error {
+
+	if rule == ScopeAny || len(args) == 0 || caller.IsNetworkAdmin() {
+
+		return nil
+
+	}
+
+	organization := args[0]
+
+	switch rule {
+
+	case ScopeUserArg:
+
+		user, err := GetUser(stub, args[0])
+
+		if HasCode(err, CodeNotFound) {
+
+			return nil
+
+		}
+
+		if err != nil {
+
+			return err
+
+		}
+
+		organization = user.Organization
+
+	case ScopeImageArg:
+
+		image, err := LoadImage(stub, args[0])
+
+		if HasCode(err, CodeNotFound) {
+
+			return nil
+
+		}
+
+		if err != nil {
+
+			return err
+
+		}
+
+		organization = image.Organization
+
+	}
+
+	if !caller.CanAccessOrganization(organization) {
+
+		return accessDenied(function, caller.Name() + " cannot access data of another organization")
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Has role - Check the caller against a list of roles. Admins have every role.
+//=======================================================================================================================
+
+func hasRole(stub shim.ChaincodeStubInterface, caller Caller, roles []string) (bool, error) {
+
+	if caller.IsAdmin() {
+
+		return true, nil
+
+	}
+
+	for _, role := range roles {
+
+		if role == RoleApprover {
+
+			config, err := GetConfig(stub)
+
+			if err != nil {
+
+				return false, err
+
+			}
+
+			if config.IsApproverRole(caller.Role) {
+
+				return true, nil
+
+			}
+
+		} else if caller.Role != "" && strings.EqualFold(role, caller.Role) {
+
+			return true, nil
+
+		}
+
+	}
+
+	return false, nil
+
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+//  Approve Image Demand function - args[0] = image ID, args[1] = approver username (optional, see ResolveActingUser)
+//=======================================================================================================================
+
+func ApproveImageDemand(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) < 1 || len(args) > 2 {
+
+		logger.Debug("Invalid number of args")
+		return nil, NewError(CodeInvalidArgument, "Expected image ID and optionally approver for approving an image demand")
+
+	}
+
+	return nil, decideImageDemand(stub, args[0], optionalArg(args, 1), StatusApproved, "")
+
+}
+
+//=======================================================================================================================
+//  Reject Image Demand function - args[0] = image ID, args[1] = reason, args[2] = approver username (optional)
+//=======================================================================================================================
+
+func RejectImageDemand(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) < 2 || len(args) > 3 {
+
+		logger.Debug("Invalid number of args")
+		return nil, NewError(CodeInvalidArgument, "Expected image ID, reason and optionally approver for rejecting an image demand")
+
+	}
+
+	if args[1] == "" {
+
+		return nil, NewError(CodeInvalidArgument, "A reason is required for rejecting an image demand")
+
+	}
+
+	return nil, decideImageDemand(stub, args[0], optionalArg(args, 2), StatusRejected, args[1])
+
+}
+
+//=======================================================================================================================
+//  Decide image demand - Move a demanded image to approved or rejected on behalf of the calling approver
+//=======================================================================================================================
+
+func decideImageDemand(stub shim.ChaincodeStubInterface, imageID string, claimedApprover string, to ImageStatus, reason string) error {
+
+	config, err := GetConfig(stub)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	approver, err := ResolveActingUser(stub, caller, claimedApprover)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	user, err := GetUser(stub, approver)
+
+	if err != nil {
+
+		return WrapError(err, "Could not get approver " + approver)
+
+	}
+
+	if !config.IsApproverRole(user.PType) {
+
+		return NewError(CodeForbidden, "User " + approver + " with participant type '" + user.PType + "' is not allowed to approve or reject demands")
+
+	}
+
+	image, err := LoadImage(stub, imageID)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if image.User == approver {
+
+		return NewError(CodeForbidden, "User " + approver + " cannot approve or reject their own demand")
+
+	}
+
+	if err = TransitionImage(stub, &image, to, approver, reason); err != nil {
+
+		return err
+
+	}
+
+	if to == StatusRejected {
+
+		if err = SettleBudget(stub, &image, ReservationReleased); err != nil {
+
+			return err
+
+		}
+
+	}
+
+	return SaveImage(stub, image)
+
+}
+
+//=======================================================================================================================
+//  Get pending approvals - All images of the caller's organization still waiting for an approver
+//=======================================================================================================================
+
+func GetPendingApprovals(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	var images []Image
+
+	err = ForEachImageInIndex(stub, ImagesByStatusIndexName, StatusDemanded.Key(), func(image Image) error {
+
+		if caller.CanAccessOrganization(image.Organization) {
+
+			images = append(images, image)
+
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+
+		return nil, WrapError(err, "Unable to retrieve pending approvals")
+
+	}
+
+	return json.Marshal(Images {Images: images})
+
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+
+	"time"
+	"bytes"
+	"strconv"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Budgets - Stock photo spend of a department of an organization in a period, a year (YYYY) or a month (YYYY-MM).
+// Amounts are in the minor unit of the currency, like purchase records. A demand with a price reserves it on the
+// budget of the demanding user's department for the month of the demand, or the year if the month has no budget, and
+// is rejected with BUDGET_EXCEEDED if the remaining amount is too low. Delivery turns the reservation into spend,
+// rejection releases it. Demands of departments without a budget for the period are not limited.
+//
+// Like purchase records, budgets, prices and reserved amounts stay off the public ledger: they are passed as transient
+// data and kept in the purchase collection of the caller's MSP, of which the channel only sees the hashes. The image
+// only names the budget and the collection of its reservation. Every priced demand, delivery and rejection of a
+// department updates the one record of its budget, so such transactions of a department endorsed for the same block
+// fail with an MVCC read conflict and have to be resubmitted; unpriced demands and departments without a budget do
+// not touch it.
+//=======================================================================================================================
+
+const BudgetsIndexName     =   "budget~org~department~period"
+const ReservationsIndexName =  "reservation~id"
+const PriceTransientKey    =   "price"
+const BudgetTransientKey   =   "budget"
+
+const BudgetYearLayout     =   "2006"
+const BudgetMonthLayout    =   "2006-01"
+
+const ReservationReserved  =   "reserved"
+const ReservationConsumed  =   "consumed"
+const ReservationReleased  =   "released"
+
+type Budget struct {
+
+	Organization    string      `json:"organization,omitempty"`
+	Department      string      `json:"department"`
+	Period          string      `json:"period"`
+	Currency        string      `json:"currency"`
+	Amount          int64       `json:"amount"`
+	Reserved        int64       `json:"reserved"`                  // by demands not delivered yet
+	Spent           int64       `json:"spent"`
+	UpdatedBy       string      `json:"updated-by"`
+	UpdatedAt       string      `json:"updated-at"`
+
+}
+
+type BudgetStatus struct {
+
+	Budget
+	Remaining       int64       `json:"remaining"`
+
+}
+
+type BudgetReservation struct {
+
+	Department      string      `json:"department"`
+	Period          string      `json:"period"`
+	Collection      string      `json:"collection"`                // private data collection holding the amount
+	State           string      `json:"state"`                     // reserved, consumed or released
+
+}
+
+// The price of a demand, passed as transient data
+type DemandPrice struct {
+
+	Price           int64       `json:"price"`
+	Currency        string      `json:"currency"`
+
+}
+
+// The reserved amount of an image, in the private data collection of the reservation
+type ReservedAmount struct {
+
+	ImageID         string      `json:"image-id"`
+	Amount          int64       `json:"amount"`
+
+}
+
+func (b Budget) Available() int64 {
+
+	return b.Amount - b.Reserved - b.Spent
+
+}
+
+func isBudgetPeriod(period string) bool {
+
+	for _, layout := range []string{BudgetYearLayout, BudgetMonthLayout} {
+
+		if _, err := time.Parse(layout, period); err == nil {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+func budgetKey(stub shim.ChaincodeStubInterface, organization string, department string, period string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(BudgetsIndexName, []string{organization, department, period})
+
+	if err != nil {
+
+		return "", NewError(CodeInvalidArgument, "Error creating key for budget of " + department + " in " + period + ", reason: " + err.Error())
+
+	}
+
+	return key, nil
+
+}
+
+//=======================================================================================================================
+//  Get budget - The budget of a department in a period from a purchase collection, nil if there is none
+//=======================================================================================================================
+
+func GetBudget(stub shim.ChaincodeStubInterface, collection string, organization string, department string, period string) (*Budget, error) {
+
+	key, err := budgetKey(stub, organization, department, period)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	// The peer fails to read from collections that are not in the collection config of the chaincode
+	budgetAsBytes, err := stub.GetPrivateData(collection, key)
+
+	if err != nil {
+
+		return nil, NewError(CodeInvalidState, "Could not retrieve budget of " + department + " in " + period + " from collection " + collection + ", reason: " + err.Error())
+
+	}
+
+	if budgetAsBytes == nil {
+
+		return nil, nil
+
+	}
+
+	var budget Budget
+
+	if err = json.Unmarshal(budgetAsBytes, &budget); err != nil {
+
+		return nil, WrapError(err, "Error while unmarshalling budget of " + department + " in " + period)
+
+	}
+
+	return &budget, nil
+
+}
+
+func putBudget(stub shim.ChaincodeStubInterface, collection string, budget Budget) error {
+
+	key, err := budgetKey(stub, budget.Organization, budget.Department, budget.Period)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	budgetAsBytes, err := json.Marshal(budget)
+
+	if err != nil {
+
+		return WrapError(err, "Error marshalling budget")
+
+	}
+
+	if err = stub.PutPrivateData(collection, key, budgetAsBytes); err != nil {
+
+		return WrapError(err, "Error storing budget of " + budget.Department + " in " + budget.Period + " in collection " + collection)
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Set budget - args[0] = department, args[1] = period, transient budget = {"amount":..., "currency":...}. Creates the
+//  budget of a department of the caller's organization or changes its amount; reservations and spend are kept.
+//=======================================================================================================================
+
+func SetBudget(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var input struct {
+
+		Amount      int64       `json:"amount"`
+		Currency    string      `json:"currency"`
+
+	}
+
+	var validation Validation
+
+	transient, err := stub.GetTransient()
+
+	if err != nil {
+
+		return nil, WrapError(err, "Could not read the transient data")
+
+	}
+
+	if transient[BudgetTransientKey] == nil {
+
+		return nil, NewError(CodeInvalidArgument, "The budget must be passed as transient data '" + BudgetTransientKey + "'")
+
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(transient[BudgetTransientKey]))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&input); err != nil {
+
+		return nil, NewError(CodeInvalidArgument, "Budget is not valid JSON, reason: " + err.Error())
+
+	}
+
+	department, period := strings.TrimSpace(args[0]), args[1]
+	input.Currency = strings.ToUpper(strings.TrimSpace(input.Currency))
+
+	if department == "" {
+
+		validation.Fail("department", "is required")
+
+	}
+
+	if !isBudgetPeriod(period) {
+
+		validation.Fail("period", "must be a year as " + BudgetYearLayout + " or a month as " + BudgetMonthLayout)
+
+	}
+
+	if input.Amount < 0 {
+
+		validation.Fail("amount", "must not be negative")
+
+	}
+
+	if !isCurrencyCode(input.Currency) {
+
+		validation.Fail("currency", "must be an ISO 4217 code")
+
+	}
+
+	if err := validation.Error("Invalid budget"); err != nil {
+
+		return nil, err
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	txTime, err := GetTransactionTime(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	collection := PurchaseCollection(caller.MSPID)
+
+	budget, err := GetBudget(stub, collection, caller.Organization, department, period)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if budget == nil {
+
+		budget = &Budget{Organization: caller.Organization, Department: department, Period: period, Currency: input.Currency}
+
+	}
+
+	if budget.Currency != input.Currency && budget.Reserved + budget.Spent > 0 {
+
+		return nil, NewError(CodeInvalidState, "The budget of " + department + " in " + period + " is in use and must stay in " + budget.Currency)
+
+	}
+
+	budget.Currency = input.Currency
+	budget.Amount = input.Amount
+	budget.UpdatedBy = caller.Name()
+	budget.UpdatedAt = txTime.Format(time.RFC3339)
+
+	if err = putBudget(stub, collection, *budget); err != nil {
+
+		return nil, err
+
+	}
+
+	return json.Marshal(BudgetStatus{Budget: *budget, Remaining: budget.Available()})
+
+}
+
+//=======================================================================================================================
+//  Transient price - The price of a demand from the transient data, zero if it has none
+//=======================================================================================================================
+
+func TransientPrice(stub shim.ChaincodeStubInterface) (DemandPrice, error) {
+
+	var price DemandPrice
+	var validation Validation
+
+	transient, err := stub.GetTransient()
+
+	if err != nil {
+
+		return price, WrapError(err, "Could not read the transient data")
+
+	}
+
+	if transient[PriceTransientKey] == nil {
+
+		return price, nil
+
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(transient[PriceTransientKey]))
+	decoder.DisallowUnknownFields()
+
+	if err = decoder.Decode(&price); err != nil {
+
+		return price, NewError(CodeInvalidArgument, "Price is not valid JSON, reason: " + err.Error())
+
+	}
+
+	if price.Price < 0 {
+
+		validation.Fail("price", "must be a non-negative whole number of minor currency units")
+
+	}
+
+	price.Currency = strings.ToUpper(strings.TrimSpace(price.Currency))
+
+	if price.Price > 0 && !isCurrencyCode(price.Currency) {
+
+		validation.Fail("currency", "must be an ISO 4217 code for a priced demand")
+
+	}
+
+	return price, validation.Error("Invalid price")
+
+}
+
+func reservationKey(stub shim.ChaincodeStubInterface, imageID string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(ReservationsIndexName, []string{imageID})
+
+	if err != nil {
+
+		return "", NewError(CodeInvalidArgument, "Error creating key for the reservation of image " + imageID + ", reason: " + err.Error())
+
+	}
+
+	return key, nil
+
+}
+
+//=======================================================================================================================
+//  Reserve budget - Reserve the price of a new demand on the budget of the owner's department, if there is one. The
+//  budget is read from and the amount kept in the purchase collection of mspID.
+//=======================================================================================================================
+
+func ReserveBudget(stub shim.ChaincodeStubInterface, image *Image, owner User, price DemandPrice, mspID string) error {
+
+	if price.Price == 0 || owner.Department == "" {
+
+		return nil
+
+	}
+
+	txTime, err := GetTransactionTime(stub)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	var budget *Budget
+
+	collection := PurchaseCollection(mspID)
+
+	for _, layout := range []string{BudgetMonthLayout, BudgetYearLayout} {
+
+		if budget, err = GetBudget(stub, collection, owner.Organization, owner.Department, txTime.Format(layout)); err != nil || budget != nil {
+
+			break
+
+		}
+
+	}
+
+	if err != nil || budget == nil {
+
+		return err
+
+	}
+
+	if budget.Currency != price.Currency {
+
+		return NewError(CodeInvalidArgument, "The budget of " + budget.Department + " is in " + budget.Currency + ", the price must be too")
+
+	}
+
+	if price.Price > budget.Available() {
+
+		return NewError(CodeBudgetExceeded, "The price of image " + image.ID + " exceeds the remaining budget of " + budget.Department +
+			" in " + budget.Period + ", " + strconv.FormatInt(budget.Available(), 10) + " " + budget.Currency + " minor units")
+
+	}
+
+	key, err := reservationKey(stub, image.ID)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	amountAsBytes, err := json.Marshal(ReservedAmount{ImageID: image.ID, Amount: price.Price})
+
+	if err != nil {
+
+		return WrapError(err, "Error marshalling reserved amount")
+
+	}
+
+	if err = stub.PutPrivateData(collection, key, amountAsBytes); err != nil {
+
+		return WrapError(err, "Error storing reserved amount in collection " + collection)
+
+	}
+
+	budget.Reserved += price.Price
+
+	if err = putBudget(stub, collection, *budget); err != nil {
+
+		return err
+
+	}
+
+	image.BudgetReservation = &BudgetReservation{Department: budget.Department, Period: budget.Period, Collection: collection, State: ReservationReserved}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Settle budget - Consume the reservation of a delivered image or release that of a rejected one. Only the peers of
+//  the organization that reserved the amount can read it.
+//=======================================================================================================================
+
+func SettleBudget(stub shim.ChaincodeStubInterface, image *Image, state string) error {
+
+	reservation := image.BudgetReservation
+
+	if reservation == nil || reservation.State != ReservationReserved {
+
+		return nil
+
+	}
+
+	key, err := reservationKey(stub, image.ID)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	amountAsBytes, err := stub.GetPrivateData(reservation.Collection, key)
+
+	if err != nil {
+
+		return NewError(CodeInvalidState, "The reservation of image " + image.ID + " can only be settled on a peer of collection " + reservation.Collection + ", reason: " + err.Error())
+
+	}
+
+	if amountAsBytes == nil {
+
+		return NewError(CodeInternal, "The reserved amount of image " + image.ID + " is missing in collection " + reservation.Collection)
+
+	}
+
+	var reserved ReservedAmount
+
+	if err = json.Unmarshal(amountAsBytes, &reserved); err != nil {
+
+		return WrapError(err, "Error while unmarshalling the reserved amount of image " + image.ID)
+
+	}
+
+	budget, err := GetBudget(stub, reservation.Collection, image.Organization, reservation.Department, reservation.Period)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if budget == nil {
+
+		return NewError(CodeInternal, "The budget of " + reservation.Department + " in " + reservation.Period + " reserved for image " + image.ID + " is missing")
+
+	}
+
+	budget.Reserved -= reserved.Amount
+
+	if state == ReservationConsumed {
+
+		budget.Spent += reserved.Amount
+
+	}
+
+	if err = putBudget(stub, reservation.Collection, *budget); err != nil {
+
+		return err
+
+	}
+
+	reservation.State = state
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Get budget status - args[0] = department, args[1] = period. The budget of a department of the caller's
+//  organization with the remaining amount; employees can only read the budget of their own department.
+//=======================================================================================================================
+
+func GetBudgetStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	privileged, err := hasRole(stub, caller, privilegedRoles)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if !privileged {
+
+		user, err := GetUser(stub, caller.Username)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		if user.Department != args[0] {
+
+			return nil, NewError(CodeForbidden, caller.Name() + " can only read the budget of their own department")
+
+		}
+
+	}
+
+	if !isBudgetPeriod(args[1]) {
+
+		return nil, NewError(CodeInvalidArgument, "Period must be a year as " + BudgetYearLayout + " or a month as " + BudgetMonthLayout)
+
+	}
+
+	budget, err := GetBudget(stub, PurchaseCollection(caller.MSPID), caller.Organization, args[0], args[1])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if budget == nil {
+
+		return nil, NewError(CodeNotFound, "No budget is set for " + args[0] + " in " + args[1])
+
+	}
+
+	return json.Marshal(BudgetStatus{Budget: *budget, Remaining: budget.Available()})
+
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+
+	"strconv"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Config - Chaincode settings, passed as JSON to Init and kept on the ledger
+//=======================================================================================================================
+
+const ConfigKey = "config"
+
+type Config struct {
+
+	ApproverRoles           []string    `json:"approver-roles"`
+	LegacyAuth              bool        `json:"legacy-auth"`
+	LegacyDigests           bool        `json:"legacy-digests"`            // deliveries may carry only md5 and sha1 digests
+	SimilarImageDistance    int         `json:"similar-image-distance"`
+	AdminMSPs               []string    `json:"admin-msps"`               // MSPs whose certificates may carry plv.role
+	NetworkAdminMSPs        []string    `json:"network-admin-msps"`       // admin MSPs whose unregistered admins see every organization
+
+}
+
+// A new value every time, unmarshalling into a shared default would overwrite its slices
+func defaultConfig() Config {
+
+	return Config{
+
+		ApproverRoles:          []string{ParticipantMarketing},
+		SimilarImageDistance:   6,
+
+	}
+
+}
+
+//=======================================================================================================================
+//  Get config - The stored config, or the defaults if Init was never given one
+//=======================================================================================================================
+
+func GetConfig(stub shim.ChaincodeStubInterface) (Config, error) {
+
+	configAsBytes, err := stub.GetState(ConfigKey)
+
+	if err != nil {
+
+		return Config{}, WrapError(err, "Could not retrieve config")
+
+	}
+
+	if configAsBytes == nil {
+
+		return defaultConfig(), nil
+
+	}
+
+	config := defaultConfig()
+
+	if err = json.Unmarshal(configAsBytes, &config); err != nil {
+
+		return Config{}, WrapError(err, "Error while unmarshalling config")
+
+	}
+
+	return config, nil
+
+}
+
+//=======================================================================================================================
+//  Put config - Validate and store the config given to Init
+//=======================================================================================================================
+
+func PutConfig(stub shim.ChaincodeStubInterface, configAsJSON string) error {
+
+	config := defaultConfig()
+
+	if err := json.Unmarshal([]byte(configAsJSON), &config); err != nil {
+
+		return NewError(CodeInvalidArgument, "Error while unmarshalling config, reason: " + err.Error())
+
+	}
+
+	if len(config.ApproverRoles) == 0 {
+
+		return NewError(CodeInvalidArgument, "Config needs at least one approver role")
+
+	}
+
+	if config.SimilarImageDistance < 0 || config.SimilarImageDistance > MaxPerceptualDistance {
+
+		return NewError(CodeInvalidArgument, "Config similar-image-distance must be from 0 to " + strconv.Itoa(MaxPerceptualDistance))
+
+	}
+
+	for _, mspID := range config.NetworkAdminMSPs {
+
+		if !contains(config.AdminMSPs, mspID) {
+
+			return NewError(CodeInvalidArgument, "Config network-admin-msps must be admin-msps, " + mspID + " is not")
+
+		}
+
+	}
+
+	configAsBytes, err := json.Marshal(config)
+
+	if err != nil {
+
+		return WrapError(err, "Error marshalling config")
+
+	}
+
+	return stub.PutState(ConfigKey, configAsBytes)
+
+}
+
+//=======================================================================================================================
+//  Is approver role - Check a participant type against the configured approver roles
+//=======================================================================================================================
+
+func (c Config) IsApproverRole(participantType string) bool {
+
+	for _, role := range c.ApproverRoles {
+
+		if strings.EqualFold(role, participantType) {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
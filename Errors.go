@@ -0,0 +1,134 @@
+package main
+
+import (
+
+	"encoding/json"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+)
+
+//=======================================================================================================================
+// Error codes - Stable codes clients can branch on, the messages may change
+//=======================================================================================================================
+
+type ErrorCode string
+
+const (
+	CodeNotFound          ErrorCode = "NOT_FOUND"
+	CodeAlreadyExists     ErrorCode = "ALREADY_EXISTS"
+	CodeInvalidArgument   ErrorCode = "INVALID_ARGUMENT"
+	CodeForbidden         ErrorCode = "FORBIDDEN"
+	CodeInvalidState      ErrorCode = "INVALID_STATE"
+	CodeInternal          ErrorCode = "INTERNAL"
+	CodeRevoked           ErrorCode = "LICENSE_REVOKED"
+	CodeBudgetExceeded    ErrorCode = "BUDGET_EXCEEDED"
+)
+
+// Peer response status for every code, Fabric treats 400 and above as errors
+var errorStatuses = map[ErrorCode]int32{
+	CodeNotFound:         404,
+	CodeAlreadyExists:    409,
+	CodeInvalidArgument:  400,
+	CodeForbidden:        403,
+	CodeInvalidState:     409,
+	CodeInternal:         500,
+	CodeRevoked:          410,
+	CodeBudgetExceeded:   409,
+}
+
+//=======================================================================================================================
+// Chaincode error - Returned as JSON envelope in the message of a failed response
+//=======================================================================================================================
+
+type ChaincodeError struct {
+
+	Code        ErrorCode       `json:"code"`
+	Message     string          `json:"message"`
+	Details     []FieldError    `json:"details,omitempty"`
+
+}
+
+func (e *ChaincodeError) Error() string {
+
+	return string(e.Code) + ": " + e.Message
+
+}
+
+//=======================================================================================================================
+//  New error
+//=======================================================================================================================
+
+func NewError(code ErrorCode, message string) *ChaincodeError {
+
+	return &ChaincodeError{Code: code, Message: message}
+
+}
+
+//=======================================================================================================================
+//  Wrap error - Add context to an error, keeping its code. Errors without a code, from the stub or from marshalling,
+//  are internal.
+//=======================================================================================================================
+
+func WrapError(err error, message string) *ChaincodeError {
+
+	cause := AsChaincodeError(err)
+
+	return &ChaincodeError{Code: cause.Code, Message: message + ", reason: " + cause.Message, Details: cause.Details}
+
+}
+
+//=======================================================================================================================
+//  As chaincode error
+//=======================================================================================================================
+
+func AsChaincodeError(err error) *ChaincodeError {
+
+	if chaincodeError, ok := err.(*ChaincodeError); ok {
+
+		return chaincodeError
+
+	}
+
+	return &ChaincodeError{Code: CodeInternal, Message: err.Error()}
+
+}
+
+//=======================================================================================================================
+//  Has code - Check the code of an error
+//=======================================================================================================================
+
+func HasCode(err error, code ErrorCode) bool {
+
+	return err != nil && AsChaincodeError(err).Code == code
+
+}
+
+//=======================================================================================================================
+//  Error response - The peer response of a failed call
+//=======================================================================================================================
+
+func ErrorResponse(err error) pb.Response {
+
+	chaincodeError := AsChaincodeError(err)
+
+	logger.Errorf("Returning error: %v", chaincodeError)
+
+	envelope, marshalErr := json.Marshal(chaincodeError)
+
+	if marshalErr != nil {
+
+		envelope = []byte(`{"code":"INTERNAL","message":"Error marshalling error"}`)
+
+	}
+
+	status, ok := errorStatuses[chaincodeError.Code]
+
+	if !ok {
+
+		status = errorStatuses[CodeInternal]
+
+	}
+
+	return pb.Response{Status: status, Message: string(envelope)}
+
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+
+	"time"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Events - Every change of an image's status emits Image<Status> (ImageDemanded, ImageApproved, ImageDelivered, ...),
+// adding a user emits UserAdded and transferring an image license LicenseTransferred. Payloads carry EventVersion,
+// which changes when fields are removed or change meaning.
+//=======================================================================================================================
+
+const EventVersion = 1
+
+const UserAddedEvent            =   "UserAdded"
+const LicenseTransferredEvent   =   "LicenseTransferred"
+
+// A peer keeps only the last SetEvent of a transaction, transactions with several events emit them as one batch
+const BatchEvent                =   "Batch"
+
+type ChaincodeEvent struct {
+
+	Version     int             `json:"version"`
+	Type        string          `json:"type"`
+	ImageID     string          `json:"image-id,omitempty"`
+	Username    string          `json:"username,omitempty"`
+	PreviousUser string         `json:"previous-user,omitempty"`
+	From        *ImageStatus    `json:"from,omitempty"`
+	To          *ImageStatus    `json:"to,omitempty"`
+	Actor       string          `json:"actor"`
+	Reason      string          `json:"reason,omitempty"`
+	TxID        string          `json:"tx-id"`
+	Timestamp   string          `json:"timestamp"`
+
+}
+
+type EventBatch struct {
+
+	Version     int                 `json:"version"`
+	Events      []ChaincodeEvent    `json:"events"`
+
+}
+
+//=======================================================================================================================
+// Event collector - The events of one invocation. Invoke passes it to dispatch in place of the stub, so functions
+// reach it through their stub argument, and sets the events once the function has succeeded.
+//=======================================================================================================================
+
+type EventCollector struct {
+
+	shim.ChaincodeStubInterface
+
+	events      []ChaincodeEvent
+
+}
+
+func NewEventCollector(stub shim.ChaincodeStubInterface) *EventCollector {
+
+	return &EventCollector{ChaincodeStubInterface: stub}
+
+}
+
+//=======================================================================================================================
+//  Emit event - Queue an event of the invocation, it is set when the function succeeds
+//=======================================================================================================================
+
+func EmitEvent(stub shim.ChaincodeStubInterface, event ChaincodeEvent) error {
+
+	collector, ok := stub.(*EventCollector)
+
+	if !ok {
+
+		return NewError(CodeInternal, "Event " + event.Type + " can only be emitted by a function run by Invoke")
+
+	}
+
+	now, err := GetTransactionTime(stub)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	event.Version = EventVersion
+	event.TxID = stub.GetTxID()
+	event.Timestamp = now.Format(time.RFC3339)
+
+	collector.events = append(collector.events, event)
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Emit image event - Image<Status> for a status change of an image
+//=======================================================================================================================
+
+func EmitImageEvent(stub shim.ChaincodeStubInterface, imageID string, from ImageStatus, to ImageStatus, actor string, reason string) error {
+
+	return EmitEvent(stub, ChaincodeEvent{
+
+		Type:    "Image" + to.String(),
+		ImageID: imageID,
+		From:    &from,
+		To:      &to,
+		Actor:   actor,
+		Reason:  reason,
+
+	})
+
+}
+
+//=======================================================================================================================
+//  Flush - Set the queued events of a successful invocation, a single event under its own name and several as a Batch
+//=======================================================================================================================
+
+func (c *EventCollector) Flush() error {
+
+	if len(c.events) == 0 {
+
+		return nil
+
+	}
+
+	var payload interface{} = c.events[0]
+	name := c.events[0].Type
+
+	if len(c.events) > 1 {
+
+		name, payload = BatchEvent, EventBatch{Version: EventVersion, Events: c.events}
+
+	}
+
+	payloadAsBytes, err := json.Marshal(payload)
+
+	if err != nil {
+
+		return WrapError(err, "Error marshalling event " + name)
+
+	}
+
+	if err = c.SetEvent(name, payloadAsBytes); err != nil {
+
+		return WrapError(err, "Error setting event " + name)
+
+	}
+
+	return nil
+
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+
+	"time"
+	"strconv"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Expiry index - The end dates of the licenses of delivered images, under (year, month, day, image ID). Keys of a
+// month share a prefix, so a date range is read month by month; the whole index is ordered by date.
+//=======================================================================================================================
+
+const ExpiryIndexName  =   "expiry~year~month~day~id"
+
+// Periods of GetExpiringLicenses are limited, as each month is read separately
+const MaxExpiryPeriodMonths  =   24
+
+func expiryKey(stub shim.ChaincodeStubInterface, endDate string, imageID string) (string, error) {
+
+	date, err := time.Parse(LicenseDateLayout, endDate)
+
+	if err != nil {
+
+		return "", NewError(CodeInvalidArgument, "End date " + endDate + " is not a date as " + LicenseDateLayout)
+
+	}
+
+	key, err := stub.CreateCompositeKey(ExpiryIndexName, []string{date.Format("2006"), date.Format("01"), date.Format("02"), imageID})
+
+	if err != nil {
+
+		return "", WrapError(err, "Error creating expiry key")
+
+	}
+
+	return key, nil
+
+}
+
+//=======================================================================================================================
+//  Index license expiry - Add the end date of an image's license to the index, perpetual licenses have none
+//=======================================================================================================================
+
+func IndexLicenseExpiry(stub shim.ChaincodeStubInterface, image Image) error {
+
+	if image.License == nil || image.License.EndDate == "" {
+
+		return nil
+
+	}
+
+	key, err := expiryKey(stub, image.License.EndDate, image.ID)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if err = stub.PutState(key, []byte(image.License.EndDate)); err != nil {
+
+		return WrapError(err, "Error indexing license expiry of image " + image.ID)
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  For each expiry - Call handle for the entries of the index under the given year and month (or the whole index if
+//  none are given), in date order. Handle returns false to stop.
+//=======================================================================================================================
+
+func forEachExpiry(stub shim.ChaincodeStubInterface, prefix []string, handle func(key string, endDate string, imageID string) (bool, error)) error {
+
+	iterator, err := stub.GetStateByPartialCompositeKey(ExpiryIndexName, prefix)
+
+	if err != nil {
+
+		return WrapError(err, "Failed to get " + ExpiryIndexName)
+
+	}
+
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+
+		entry, err := iterator.Next()
+
+		if err != nil {
+
+			return WrapError(err, "Error iterating index '" + ExpiryIndexName + "'")
+
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(entry.Key)
+
+		if err != nil || len(attributes) != 4 {
+
+			return NewError(CodeInternal, "Malformed key in index '" + ExpiryIndexName + "'")
+
+		}
+
+		more, err := handle(entry.Key, attributes[0] + "-" + attributes[1] + "-" + attributes[2], attributes[3])
+
+		if err != nil || !more {
+
+			return err
+
+		}
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+// Expiring license - A delivered image whose license ends in the queried period
+//=======================================================================================================================
+
+type ExpiringLicense struct {
+
+	ImageID         string      `json:"image-id"`
+	Name            string      `json:"name"`
+	LicensedTo      string      `json:"licensed-to"`
+	LicenseType     string      `json:"license-type"`
+	EndDate         string      `json:"end-date"`
+
+}
+
+//=======================================================================================================================
+//  Get expiring licenses - args[0] = from date, args[1] = to date, both YYYY-MM-DD and inclusive, at most
+//  MaxExpiryPeriodMonths apart. Returns the licenses of delivered images of the caller's organization ending in the
+//  period, earliest first.
+//=======================================================================================================================
+
+func GetExpiringLicenses(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var validation Validation
+
+	from, err := time.Parse(LicenseDateLayout, args[0])
+
+	if err != nil {
+
+		validation.Fail("from", "must be a date as " + LicenseDateLayout)
+
+	}
+
+	to, err := time.Parse(LicenseDateLayout, args[1])
+
+	if err != nil {
+
+		validation.Fail("to", "must be a date as " + LicenseDateLayout)
+
+	} else if to.Before(from) {
+
+		validation.Fail("to", "must not be before from")
+
+	} else if to.After(from.AddDate(0, MaxExpiryPeriodMonths, 0)) {
+
+		validation.Fail("to", "must be at most " + strconv.Itoa(MaxExpiryPeriodMonths) + " months after from")
+
+	}
+
+	if err = validation.Error("Invalid period"); err != nil {
+
+		return nil, err
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	licenses := []ExpiringLicense{}
+
+	handle := func(key string, endDate string, imageID string) (bool, error) {
+
+		if endDate < args[0] || endDate > args[1] {
+
+			return true, nil
+
+		}
+
+		image, err := LoadImage(stub, imageID)
+
+		if err != nil {
+
+			return false, err
+
+		}
+
+		if image.Status == StatusDelivered && image.License != nil && caller.CanAccessOrganization(image.Organization) {
+
+			licenses = append(licenses, ExpiringLicense{
+
+				ImageID:        image.ID,
+				Name:           image.Name,
+				LicensedTo:     image.User,
+				LicenseType:    image.License.Type,
+				EndDate:        endDate,
+
+			})
+
+		}
+
+		return true, nil
+
+	}
+
+	for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); !month.After(to); month = month.AddDate(0, 1, 0) {
+
+		if err = forEachExpiry(stub, []string{month.Format("2006"), month.Format("01")}, handle); err != nil {
+
+			return nil, err
+
+		}
+
+	}
+
+	return json.Marshal(map[string][]ExpiringLicense{"licenses": licenses})
+
+}
+
+//=======================================================================================================================
+//  Expire licenses - Move delivered images whose license ended before the transaction date to Expired, and drop
+//  the index entries of the past. Past entries of organizations the caller cannot access are moved to the due index
+//  of their organization, which its own callers work off, so no entry is read twice by the same organization.
+//  Returns the expired image IDs, each of which emits ImageExpired.
+//=======================================================================================================================
+
+const DueExpiryIndexName   =   "due~organization~id"
+
+type ExpiredLicenses struct {
+
+	Date        string      `json:"date"`
+	ImageIDs    []string    `json:"image-ids"`
+
+}
+
+func ExpireLicenses(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	txTime, err := GetTransactionTime(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	expired := ExpiredLicenses{Date: txTime.Format(LicenseDateLayout), ImageIDs: []string{}}
+
+	type expiry struct {
+
+		key, endDate, imageID string
+
+	}
+
+	// The index is in date order, everything before the first entry ending today or later is past
+	var past []expiry
+
+	err = forEachExpiry(stub, []string{}, func(key string, endDate string, imageID string) (bool, error) {
+
+		if endDate >= expired.Date {
+
+			return false, nil
+
+		}
+
+		past = append(past, expiry{key, endDate, imageID})
+
+		return true, nil
+
+	})
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	// Then the entries other organizations left for the caller's
+	prefix := []string{caller.Organization}
+
+	if caller.IsNetworkAdmin() {
+
+		prefix = []string{}
+
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(DueExpiryIndexName, prefix)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Failed to get " + DueExpiryIndexName)
+
+	}
+
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+
+		entry, err := iterator.Next()
+
+		if err != nil {
+
+			return nil, WrapError(err, "Error iterating index '" + DueExpiryIndexName + "'")
+
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(entry.Key)
+
+		if err != nil || len(attributes) != 2 {
+
+			return nil, NewError(CodeInternal, "Malformed key in index '" + DueExpiryIndexName + "'")
+
+		}
+
+		past = append(past, expiry{entry.Key, string(entry.Value), attributes[1]})
+
+	}
+
+	for _, entry := range past {
+
+		if err = stub.DelState(entry.key); err != nil {
+
+			return nil, WrapError(err, "Error deleting expiry of image " + entry.imageID)
+
+		}
+
+		image, err := LoadImage(stub, entry.imageID)
+
+		if HasCode(err, CodeNotFound) {
+
+			continue
+
+		}
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		// Licenses of other organizations are left to their own callers
+		if !caller.CanAccessOrganization(image.Organization) {
+
+			if err = putDueExpiry(stub, image, entry.endDate); err != nil {
+
+				return nil, err
+
+			}
+
+			continue
+
+		}
+
+		// Images revoked or archived before their license ended only need their index entry dropped
+		if image.Status == StatusDelivered {
+
+			if err = TransitionImage(stub, &image, StatusExpired, caller.Name(), "License ended on " + entry.endDate); err != nil {
+
+				return nil, err
+
+			}
+
+			if err = SaveImage(stub, image); err != nil {
+
+				return nil, err
+
+			}
+
+			expired.ImageIDs = append(expired.ImageIDs, image.ID)
+
+		}
+
+	}
+
+	return json.Marshal(expired)
+
+}
+
+func putDueExpiry(stub shim.ChaincodeStubInterface, image Image, endDate string) error {
+
+	key, err := stub.CreateCompositeKey(DueExpiryIndexName, []string{image.Organization, image.ID})
+
+	if err != nil {
+
+		return WrapError(err, "Error creating due expiry key")
+
+	}
+
+	if err = stub.PutState(key, []byte(endDate)); err != nil {
+
+		return WrapError(err, "Error storing due expiry of image " + image.ID)
+
+	}
+
+	return nil
+
+}
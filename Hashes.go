@@ -0,0 +1,468 @@
+package main
+
+import (
+
+	"sort"
+	"strings"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Hash algorithms - Digests identify the file of an image. MD5 and SHA-1 are broken for integrity and only kept for
+// images delivered before SHA-2 was supported, a delivery needs at least one strong digest unless the config allows
+// legacy digests for clients that cannot send one yet.
+//=======================================================================================================================
+
+const HashMD5       =   "md5"
+const HashSHA1      =   "sha1"
+const HashSHA256    =   "sha256"
+const HashSHA512    =   "sha512"
+
+type HashAlgorithm struct {
+
+	Length      int         // digest length in bytes
+	Legacy      bool
+
+}
+
+var hashAlgorithms = map[string]HashAlgorithm{
+
+	HashMD5:       {Length: 16, Legacy: true},
+	HashSHA1:      {Length: 20, Legacy: true},
+	HashSHA256:    {Length: 32},
+	HashSHA512:    {Length: 64},
+
+}
+
+//=======================================================================================================================
+// Hashes index - Maps (algorithm, digest, organization) to the ID of the image the file belongs to in the organization,
+// so organizations neither block nor see each other's files. An entry is released when its image is archived, unless
+// the license was revoked: files of revoked images keep failing verification.
+//=======================================================================================================================
+
+const HashesIndexName  =   "hash~algorithm~digest~organization"
+
+//=======================================================================================================================
+//  Parse digest - "<algorithm>:<hex digest>", or a bare hex digest whose algorithm follows from its length
+//=======================================================================================================================
+
+func ParseDigest(value string) (string, string, error) {
+
+	algorithm, digest := "", strings.ToLower(strings.TrimSpace(value))
+
+	if separator := strings.Index(digest, ":"); separator >= 0 {
+
+		algorithm, digest = digest[:separator], digest[separator + 1:]
+
+	}
+
+	decoded, err := hex.DecodeString(digest)
+
+	if err != nil || len(decoded) == 0 {
+
+		return "", "", NewError(CodeInvalidArgument, "'" + value + "' is not a hex digest")
+
+	}
+
+	if algorithm == "" {
+
+		for name, hashAlgorithm := range hashAlgorithms {
+
+			if hashAlgorithm.Length == len(decoded) {
+
+				algorithm = name
+
+			}
+
+		}
+
+	}
+
+	hashAlgorithm, supported := hashAlgorithms[algorithm]
+
+	if !supported {
+
+		return "", "", NewError(CodeInvalidArgument, "Hash algorithm of '" + value + "' is not one of " + strings.Join(HashAlgorithmNames(), ", "))
+
+	}
+
+	if hashAlgorithm.Length != len(decoded) {
+
+		return "", "", NewError(CodeInvalidArgument, "'" + value + "' is not a " + algorithm + " digest")
+
+	}
+
+	return algorithm, digest, nil
+
+}
+
+//=======================================================================================================================
+//  Parse digests - A list of digests, one per algorithm
+//=======================================================================================================================
+
+func ParseDigests(items []string, validation *Validation, field string) map[string]string {
+
+	digests := map[string]string{}
+
+	for _, item := range items {
+
+		algorithm, digest, err := ParseDigest(item)
+
+		if err != nil {
+
+			validation.Fail(field, AsChaincodeError(err).Message)
+			continue
+
+		}
+
+		if _, duplicate := digests[algorithm]; duplicate {
+
+			validation.Fail(field, "has more than one " + algorithm + " digest")
+			continue
+
+		}
+
+		digests[algorithm] = digest
+
+	}
+
+	return digests
+
+}
+
+func HashAlgorithmNames() []string {
+
+	names := []string{}
+
+	for name := range hashAlgorithms {
+
+		names = append(names, name)
+
+	}
+
+	sort.Strings(names)
+
+	return names
+
+}
+
+func hasStrongDigest(digests map[string]string) bool {
+
+	for algorithm := range digests {
+
+		if !hashAlgorithms[algorithm].Legacy {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+//=======================================================================================================================
+//  Find image by hash - ID of the image a digest is registered for in an organization, "" if there is none
+//=======================================================================================================================
+
+func FindImageByHash(stub shim.ChaincodeStubInterface, algorithm string, digest string, organization string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(HashesIndexName, []string{algorithm, digest, organization})
+
+	if err != nil {
+
+		return "", WrapError(err, "Error creating hash key")
+
+	}
+
+	imageID, err := stub.GetState(key)
+
+	if err != nil {
+
+		return "", WrapError(err, "Could not retrieve hash")
+
+	}
+
+	return string(imageID), nil
+
+}
+
+//=======================================================================================================================
+//  Register image hashes - Index the digests of an image. A file can only be licensed once per organization, a digest
+//  registered for another image of the organization is a duplicate.
+//=======================================================================================================================
+
+func RegisterImageHashes(stub shim.ChaincodeStubInterface, image Image) error {
+
+	for _, algorithm := range HashAlgorithmNames() {
+
+		digest, found := image.Hashes[algorithm]
+
+		if !found {
+
+			continue
+
+		}
+
+		existing, err := FindImageByHash(stub, algorithm, digest, image.Organization)
+
+		if err != nil {
+
+			return err
+
+		}
+
+		if existing == image.ID {
+
+			continue
+
+		}
+
+		if existing != "" {
+
+			return NewError(CodeAlreadyExists, "The file with " + algorithm + " digest " + digest + " is already registered as image " + existing)
+
+		}
+
+		key, err := stub.CreateCompositeKey(HashesIndexName, []string{algorithm, digest, image.Organization})
+
+		if err != nil {
+
+			return WrapError(err, "Error creating hash key")
+
+		}
+
+		if err = stub.PutState(key, []byte(image.ID)); err != nil {
+
+			return WrapError(err, "Error registering hash of image " + image.ID)
+
+		}
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Release image hashes - Remove the digests of an image from the index, so the file can be licensed again
+//=======================================================================================================================
+
+func ReleaseImageHashes(stub shim.ChaincodeStubInterface, image Image) error {
+
+	for algorithm, digest := range image.Hashes {
+
+		existing, err := FindImageByHash(stub, algorithm, digest, image.Organization)
+
+		if err != nil {
+
+			return err
+
+		}
+
+		if existing != image.ID {
+
+			continue
+
+		}
+
+		key, err := stub.CreateCompositeKey(HashesIndexName, []string{algorithm, digest, image.Organization})
+
+		if err != nil {
+
+			return WrapError(err, "Error creating hash key")
+
+		}
+
+		if err = stub.DelState(key); err != nil {
+
+			return WrapError(err, "Error releasing hash of image " + image.ID)
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// Whether the digests of an image stay registered, see the hashes index
+func holdsHashes(image Image) bool {
+
+	return image.Status != StatusArchived || image.Revocation != nil
+
+}
+
+//=======================================================================================================================
+//  Register legacy hashes - Images delivered before the hash registry only have md5-hash, which may hold a digest of
+//  any algorithm. Index them by digest length, so that they can be verified too. Images written by the same
+//  transaction are not visible in the index yet and are passed as migrated. Returns the number of images indexed.
+//=======================================================================================================================
+
+func RegisterLegacyHashes(stub shim.ChaincodeStubInterface, migrated []Image) (int, error) {
+
+	images := migrated
+
+	err := ForEachInIndex(stub, ImagesIndexName, func(imageID string, imageAsBytes []byte) error {
+
+		var image Image
+
+		if err := json.Unmarshal(imageAsBytes, &image); err != nil {
+
+			return WrapError(err, "Error while unmarshalling image " + imageID)
+
+		}
+
+		images = append(images, image)
+
+		return nil
+
+	})
+
+	if err != nil {
+
+		return 0, err
+
+	}
+
+	count := 0
+
+	// Hashes registered by this transaction, which FindImageByHash does not see either
+	registered := map[string]string{}
+
+	for _, image := range images {
+
+		if len(image.Hashes) > 0 || image.MD5Hash == "" {
+
+			continue
+
+		}
+
+		algorithm, digest, err := ParseDigest(image.MD5Hash)
+
+		if err != nil {
+
+			// Placeholders like UNDEFINED
+			continue
+
+		}
+
+		if existing, found := registered[image.Organization + ":" + algorithm + ":" + digest]; found {
+
+			logger.Warningf("Not indexing hash of image %v, the file is already registered as image %v", image.ID, existing)
+			continue
+
+		}
+
+		image.Hashes = map[string]string{algorithm: digest}
+
+		if err = RegisterImageHashes(stub, image); err != nil {
+
+			logger.Warningf("Not indexing hash of image %v: %v", image.ID, err)
+			continue
+
+		}
+
+		if err = SaveImage(stub, image); err != nil {
+
+			return 0, err
+
+		}
+
+		registered[image.Organization + ":" + algorithm + ":" + digest] = image.ID
+		count++
+
+	}
+
+	return count, nil
+
+}
+
+//=======================================================================================================================
+// Hash verification - Whether the file with a digest is licensed, to whom and under which terms
+//=======================================================================================================================
+
+type HashVerification struct {
+
+	Licensed        bool        `json:"licensed"`
+	Algorithm       string      `json:"algorithm"`
+	Digest          string      `json:"digest"`
+	ImageID         string      `json:"image-id,omitempty"`
+	Name            string      `json:"name,omitempty"`
+	LicensedTo      string      `json:"licensed-to,omitempty"`
+	Author          string      `json:"author,omitempty"`
+	Source          string      `json:"source,omitempty"`
+	PurchaseDate    string      `json:"purchase-date,omitempty"`
+	Status          string      `json:"status,omitempty"`
+	License         *License    `json:"license,omitempty"`         // the terms the image is held under
+
+}
+
+//=======================================================================================================================
+//  Verify image by hash - args[0] = digest, see ParseDigest. Files that are not registered for the caller's organization
+//  are not licensed, files of revoked images fail with LICENSE_REVOKED.
+//=======================================================================================================================
+
+func VerifyImageByHash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	algorithm, digest, err := ParseDigest(args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	verification := HashVerification{Algorithm: algorithm, Digest: digest}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	imageID, err := FindImageByHash(stub, algorithm, digest, caller.Organization)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if imageID != "" {
+
+		image, err := LoadImage(stub, imageID)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		if err = RevokedError(image); err != nil {
+
+			return nil, err
+
+		}
+
+		verification.Licensed = image.Status == StatusDelivered
+		verification.ImageID = image.ID
+		verification.Name = image.Name
+		verification.LicensedTo = image.User
+		verification.Author = image.Author
+		verification.Source = image.URL
+		verification.PurchaseDate = image.PurchaseDate
+		verification.Status = image.Status.String()
+		verification.License = image.License
+
+	}
+
+	return json.Marshal(verification)
+
+}
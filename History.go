@@ -0,0 +1,335 @@
+package main
+
+import (
+
+	"sort"
+	"time"
+	"bytes"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Image version - A write of an image in the ledger history, with the fields it changed. Fields that were added have
+// no old value, fields that were removed (e.g. by a deletion) no new value.
+//=======================================================================================================================
+
+type FieldChange struct {
+
+	Field       string              `json:"field"`
+	Old         json.RawMessage     `json:"old,omitempty"`
+	New         json.RawMessage     `json:"new,omitempty"`
+
+}
+
+type ImageVersion struct {
+
+	TxID        string              `json:"tx-id"`
+	Timestamp   string              `json:"timestamp"`
+	Actor       string              `json:"actor,omitempty"`
+	Deleted     bool                `json:"deleted,omitempty"`
+	Value       json.RawMessage     `json:"value,omitempty"`
+	Changes     []FieldChange       `json:"changes"`
+
+}
+
+//=======================================================================================================================
+//  Get image history - args[0] = image ID. Walks the ledger history of the image, including the key it had before
+//  the composite key migration, oldest version first. Needs the history database of the peer
+//  (core.ledger.history.enableHistoryDatabase).
+//=======================================================================================================================
+
+func GetImageHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	key, err := CreateKey(stub, ImagesIndexName, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	// The plain key may have held anything, e.g. a legacy user, so only existing images are looked up
+	imageAsBytes, err := stub.GetState(key)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Failed to get image " + args[0])
+
+	}
+
+	if imageAsBytes == nil {
+
+		return nil, NewError(CodeNotFound, "Image " + args[0] + " does not exist")
+
+	}
+
+	// Legacy images were stored under their plain ID until they were migrated, so those versions come first
+	legacyVersions, err := keyHistory(stub, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	versions, err := keyHistory(stub, key)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	versions = append(legacyImageVersions(legacyVersions, args[0]), versions...)
+
+	var previous json.RawMessage
+
+	for i := range versions {
+
+		versions[i].Changes, err = diffFields(previous, versions[i].Value)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		versions[i].Actor = versionActor(versions[i])
+		previous = versions[i].Value
+
+	}
+
+	return json.Marshal(map[string][]ImageVersion{"versions": versions})
+
+}
+
+// Fabric 1.x returns the writes of a key oldest first
+func keyHistory(stub shim.ChaincodeStubInterface, key string) ([]ImageVersion, error) {
+
+	iterator, err := stub.GetHistoryForKey(key)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Failed to get the history of " + key)
+
+	}
+
+	defer iterator.Close()
+
+	var versions []ImageVersion
+
+	for iterator.HasNext() {
+
+		modification, err := iterator.Next()
+
+		if err != nil {
+
+			return nil, WrapError(err, "Error iterating the history of " + key)
+
+		}
+
+		version := ImageVersion{TxID: modification.TxId, Deleted: modification.IsDelete}
+
+		if modification.Timestamp != nil {
+
+			version.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339)
+
+		}
+
+		if !modification.IsDelete {
+
+			version.Value = json.RawMessage(modification.Value)
+
+		}
+
+		versions = append(versions, version)
+
+	}
+
+	return versions, nil
+
+}
+
+// The versions of a plain key that hold the image with the ID, and the deletions that follow them
+func legacyImageVersions(versions []ImageVersion, imageID string) []ImageVersion {
+
+	var imageVersions []ImageVersion
+
+	holdsImage := false
+
+	for _, version := range versions {
+
+		if version.Deleted {
+
+			if holdsImage {
+
+				imageVersions = append(imageVersions, version)
+
+			}
+
+			holdsImage = false
+			continue
+
+		}
+
+		var image Image
+
+		holdsImage = json.Unmarshal(version.Value, &image) == nil && image.ID == imageID
+
+		if holdsImage {
+
+			imageVersions = append(imageVersions, version)
+
+		}
+
+	}
+
+	return imageVersions
+
+}
+
+//=======================================================================================================================
+//  Version actor - History does not record the creator, so it is taken from what the change recorded with its
+//  transaction ID: a status change, an ownership transfer or a purchase record. Writes that record none, e.g. the
+//  migrations and hash backfills run by an admin, have no actor.
+//=======================================================================================================================
+
+func versionActor(version ImageVersion) string {
+
+	if version.Value == nil {
+
+		return ""
+
+	}
+
+	var image Image
+
+	if err := json.Unmarshal(version.Value, &image); err != nil {
+
+		return ""
+
+	}
+
+	for _, change := range image.StatusChanges {
+
+		if change.TxID == version.TxID {
+
+			return change.By
+
+		}
+
+	}
+
+	for _, transfer := range image.OwnershipChain {
+
+		if transfer.TxID == version.TxID {
+
+			return transfer.By
+
+		}
+
+	}
+
+	if image.PurchaseRecord != nil && image.PurchaseRecord.TxID == version.TxID {
+
+		return image.PurchaseRecord.RecordedBy
+
+	}
+
+	return ""
+
+}
+
+//=======================================================================================================================
+//  Diff fields - The top-level fields that differ between two JSON objects, by field name
+//=======================================================================================================================
+
+func diffFields(before json.RawMessage, after json.RawMessage) ([]FieldChange, error) {
+
+	oldFields, err := jsonFields(before)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	newFields, err := jsonFields(after)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	changes := []FieldChange{}
+
+	for field, oldValue := range oldFields {
+
+		if newValue, found := newFields[field]; !found {
+
+			changes = append(changes, FieldChange{Field: field, Old: oldValue})
+
+		} else if !bytes.Equal(compactJSON(oldValue), compactJSON(newValue)) {
+
+			changes = append(changes, FieldChange{Field: field, Old: oldValue, New: newValue})
+
+		}
+
+	}
+
+	for field, newValue := range newFields {
+
+		if _, found := oldFields[field]; !found {
+
+			changes = append(changes, FieldChange{Field: field, New: newValue})
+
+		}
+
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+
+		return changes[i].Field < changes[j].Field
+
+	})
+
+	return changes, nil
+
+}
+
+func jsonFields(value json.RawMessage) (map[string]json.RawMessage, error) {
+
+	fields := map[string]json.RawMessage{}
+
+	if value == nil {
+
+		return fields, nil
+
+	}
+
+	if err := json.Unmarshal(value, &fields); err != nil {
+
+		return nil, WrapError(err, "Error while unmarshalling image version")
+
+	}
+
+	return fields, nil
+
+}
+
+func compactJSON(value json.RawMessage) []byte {
+
+	var buffer bytes.Buffer
+
+	if err := json.Compact(&buffer, value); err != nil {
+
+		return value
+
+	}
+
+	return buffer.Bytes()
+
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+
+)
+
+//=======================================================================================================================
+// Certificate attributes - Set by the CA when enrolling an identity (Fabric CA "attrs")
+//=======================================================================================================================
+
+const UsernameAttribute  =   "plv.username"
+const RoleAttribute      =   "plv.role"
+
+//=======================================================================================================================
+// Identities index - Maps (MSP ID, certificate ID) to the username of the user the certificate belongs to
+//=======================================================================================================================
+
+const IdentitiesIndexName  =   "identity~msp~id"
+
+//=======================================================================================================================
+// Caller - The identity of the transaction creator and the user it maps to
+//=======================================================================================================================
+
+type Caller struct {
+
+	ID          string      `json:"id"`
+	MSPID       string      `json:"msp-id"`
+	Subject     string      `json:"subject"`
+	Username    string      `json:"username,omitempty"`
+	Role        string      `json:"role,omitempty"`
+	Organization string     `json:"organization,omitempty"`
+
+	identity    cid.ClientIdentity
+	roleTrusted bool        // the certificate is from one of the admin MSPs, so its plv.role attribute counts
+	networkAdmin bool       // an unregistered admin of one of the network admin MSPs
+
+
+}
+
+//=======================================================================================================================
+//  Get caller - Derive the caller from the creator certificate. A certificate maps to a user through the plv.username
+//  attribute or, if it has none, through the identity registered with addUser. The plv.role attribute only counts on
+//  certificates of the admin MSPs of the config.
+//=======================================================================================================================
+
+func GetCaller(stub shim.ChaincodeStubInterface) (Caller, error) {
+
+	identity, err := cid.New(stub)
+
+	if err != nil {
+
+		return Caller{}, NewError(CodeForbidden, "Could not read the creator identity, reason: " + err.Error())
+
+	}
+
+	id, err := identity.GetID()
+
+	if err != nil {
+
+		return Caller{}, NewError(CodeForbidden, "Could not read the creator ID, reason: " + err.Error())
+
+	}
+
+	mspID, err := identity.GetMSPID()
+
+	if err != nil {
+
+		return Caller{}, NewError(CodeForbidden, "Could not read the creator MSP ID, reason: " + err.Error())
+
+	}
+
+	cert, err := identity.GetX509Certificate()
+
+	if err != nil {
+
+		return Caller{}, NewError(CodeForbidden, "Could not read the creator certificate, reason: " + err.Error())
+
+	}
+
+	caller := Caller{
+
+		ID:       id,
+		MSPID:    mspID,
+		Subject:  cert.Subject.CommonName,
+		identity: identity,
+
+	}
+
+	config, err := GetConfig(stub)
+
+	if err != nil {
+
+		return Caller{}, err
+
+	}
+
+	caller.roleTrusted = contains(config.AdminMSPs, mspID)
+
+	username, found := caller.Attribute(UsernameAttribute)
+
+	if !found {
+
+		username, err = GetUsernameForIdentity(stub, mspID, id)
+
+		if err != nil {
+
+			return Caller{}, err
+
+		}
+
+	}
+
+	if username != "" {
+
+		user, err := GetUser(stub, username)
+
+		if err != nil {
+
+			return Caller{}, NewError(CodeForbidden, "Certificate of " + caller.Subject + " maps to unknown user " + username)
+
+		}
+
+		if found {
+
+			if err = checkUsernameClaim(stub, config, caller, user); err != nil {
+
+				return Caller{}, err
+
+			}
+
+		}
+
+		caller.Username = user.Username
+		caller.Role = user.PType
+		caller.Organization = user.Organization
+
+	} else if role, found := caller.Attribute(RoleAttribute); found {
+
+		caller.Role = role
+
+		if caller.IsAdmin() {
+
+			if err = scopeUnregisteredAdmin(stub, config, &caller); err != nil {
+
+				return Caller{}, err
+
+			}
+
+		}
+
+	}
+
+	return caller, nil
+
+}
+
+// Unregistered admins of the network admin MSPs see every organization, the others only the organization of their
+// MSP, or the default organization if their MSP has none
+func scopeUnregisteredAdmin(stub shim.ChaincodeStubInterface, config Config, caller *Caller) error {
+
+	if contains(config.NetworkAdminMSPs, caller.MSPID) {
+
+		caller.networkAdmin = true
+		return nil
+
+	}
+
+	return ForEachInIndex(stub, OrganizationsIndexName, func(id string, value []byte) error {
+
+		var organization Organization
+
+		if err := json.Unmarshal(value, &organization); err != nil {
+
+			return WrapError(err, "Error unmarshalling organization " + id)
+
+		}
+
+		if organization.MSPID == caller.MSPID && caller.Organization == "" {
+
+			caller.Organization = organization.ID
+
+		}
+
+		return nil
+
+	})
+
+}
+
+// A plv.username attribute only maps to a user if the certificate is issued by the MSP of the user, or else of the
+// user's organization, or else, for users with neither, by one of the admin MSPs
+func checkUsernameClaim(stub shim.ChaincodeStubInterface, config Config, caller Caller, user User) error {
+
+	if user.MSPID != "" {
+
+		if caller.MSPID == user.MSPID {
+
+			return nil
+
+		}
+
+	} else if user.Organization != "" {
+
+		organization, err := GetOrganization(stub, user.Organization)
+
+		if err != nil {
+
+			return err
+
+		}
+
+		if caller.MSPID == organization.MSPID {
+
+			return nil
+
+		}
+
+	} else if contains(config.AdminMSPs, caller.MSPID) {
+
+		return nil
+
+	}
+
+	return NewError(CodeForbidden, "Certificate of " + caller.Subject + " (" + caller.MSPID + ") cannot claim user " + user.Username)
+
+}
+
+//=======================================================================================================================
+//  Attribute - Value of a certificate attribute. plv.role is only read from certificates of the admin MSPs.
+//=======================================================================================================================
+
+func (c Caller) Attribute(name string) (string, bool) {
+
+	if c.identity == nil || (name == RoleAttribute && !c.roleTrusted) {
+
+		return "", false
+
+	}
+
+	value, found, err := c.identity.GetAttributeValue(name)
+
+	if err != nil {
+
+		logger.Warningf("Could not read attribute %v of %v: %v", name, c.Subject, err)
+		return "", false
+
+	}
+
+	return value, found
+
+}
+
+//=======================================================================================================================
+//  Name - The username of the caller, or the certificate subject of callers that map to no user
+//=======================================================================================================================
+
+func (c Caller) Name() string {
+
+	if c.Username != "" {
+
+		return c.Username
+
+	}
+
+	return c.Subject
+
+}
+
+//=======================================================================================================================
+//  Is admin - Admins are users with participant type admin, or certificates of an admin MSP with the admin role
+//  attribute
+//=======================================================================================================================
+
+func (c Caller) IsAdmin() bool {
+
+	if strings.EqualFold(c.Role, ParticipantAdmin) {
+
+		return true
+
+	}
+
+	role, found := c.Attribute(RoleAttribute)
+
+	return found && strings.EqualFold(role, ParticipantAdmin)
+
+}
+
+//=======================================================================================================================
+//  Resolve acting user - The user a call acts as. Callers act as their own user; admins, and unregistered callers in
+//  legacy mode, may name another existing user instead (the claimed user).
+//=======================================================================================================================
+
+func ResolveActingUser(stub shim.ChaincodeStubInterface, caller Caller, claimed string) (string, error) {
+
+	if claimed == "" || claimed == caller.Username {
+
+		if caller.Username == "" {
+
+			return "", NewError(CodeForbidden, "Creator " + caller.Subject + " (" + caller.MSPID + ") is not registered as a user")
+
+		}
+
+		return caller.Username, nil
+
+	}
+
+	onBehalf := caller.IsAdmin()
+
+	if !onBehalf && caller.Username == "" {
+
+		config, err := GetConfig(stub)
+
+		if err != nil {
+
+			return "", err
+
+		}
+
+		onBehalf = config.LegacyAuth
+
+	}
+
+	if !onBehalf {
+
+		return "", NewError(CodeForbidden, "Creator " + caller.Subject + " cannot act on behalf of " + claimed)
+
+	}
+
+	if _, err := GetUser(stub, claimed); err != nil {
+
+		return "", err
+
+	}
+
+	return claimed, nil
+
+}
+
+//=======================================================================================================================
+//  Get username for identity - Look up the user registered for a certificate, "" if there is none
+//=======================================================================================================================
+
+func GetUsernameForIdentity(stub shim.ChaincodeStubInterface, mspID string, id string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(IdentitiesIndexName, []string{mspID, id})
+
+	if err != nil {
+
+		return "", WrapError(err, "Error creating identity key")
+
+	}
+
+	username, err := stub.GetState(key)
+
+	if err != nil {
+
+		return "", WrapError(err, "Could not retrieve identity")
+
+	}
+
+	return string(username), nil
+
+}
+
+//=======================================================================================================================
+//  Register identity - Bind a certificate to a user
+//=======================================================================================================================
+
+func RegisterIdentity(stub shim.ChaincodeStubInterface, mspID string, id string, username string) error {
+
+	existing, err := GetUsernameForIdentity(stub, mspID, id)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if existing != "" {
+
+		return NewError(CodeAlreadyExists, "Identity is already registered for user " + existing)
+
+	}
+
+	key, err := stub.CreateCompositeKey(IdentitiesIndexName, []string{mspID, id})
+
+	if err != nil {
+
+		return WrapError(err, "Error creating identity key")
+
+	}
+
+	return stub.PutState(key, []byte(username))
+
+}
+
+//=======================================================================================================================
+//  Who am I - The caller as seen by the chaincode, used to find the ID to register with addUser
+//=======================================================================================================================
+
+func WhoAmI(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return json.Marshal(caller)
+
+}
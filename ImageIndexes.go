@@ -0,0 +1,454 @@
+package main
+
+import (
+
+	"net/url"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Secondary indexes - Images are also listed under (user, ID), (author, ID), (status, ID), (provider, ID) and
+// (organization, ID), so lookups by those fields read one key range instead of every image. The entries are written
+// together with the image by StoreImage and SaveImage; empty values are not indexed.
+//=======================================================================================================================
+
+const ImagesByUserIndexName      =   "image~user~id"
+const ImagesByAuthorIndexName    =   "image~author~id"
+const ImagesByStatusIndexName    =   "image~status~id"
+const ImagesByProviderIndexName  =   "image~provider~id"
+
+// Set once the images stored before the secondary indexes have been indexed
+const SecondaryIndexesKey  =   "secondary-indexes"
+
+// The peer treats an empty value as a deletion
+var indexEntryValue = []byte{0x00}
+
+//=======================================================================================================================
+//  Image provider - The picture agency of an image: its registered provider, see Providers.go, or else the host of its
+//  URL without www.
+//=======================================================================================================================
+
+func ImageProvider(image Image) string {
+
+	if image.Provider != "" {
+
+		return image.Provider
+
+	}
+
+	return urlHost(image.URL)
+
+}
+
+func urlHost(rawURL string) string {
+
+	parsed, err := url.Parse(rawURL)
+
+	if err != nil {
+
+		return ""
+
+	}
+
+	return strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+
+}
+
+func secondaryKeys(stub shim.ChaincodeStubInterface, image Image) (map[string]bool, error) {
+
+	keys := map[string]bool{}
+
+	values := map[string]string{
+
+		ImagesByUserIndexName:          image.User,
+		ImagesByAuthorIndexName:        image.Author,
+		ImagesByStatusIndexName:        image.Status.Key(),
+		ImagesByProviderIndexName:      ImageProvider(image),
+		ImagesByOrganizationIndexName:  image.Organization,
+
+	}
+
+	for indexName, value := range values {
+
+		if value == "" {
+
+			continue
+
+		}
+
+		key, err := stub.CreateCompositeKey(indexName, []string{value, image.ID})
+
+		if err != nil {
+
+			return nil, NewError(CodeInvalidArgument, "Error creating key for image " + image.ID + " in index '" + indexName + "', reason: " + err.Error())
+
+		}
+
+		keys[key] = true
+
+	}
+
+	return keys, nil
+
+}
+
+//=======================================================================================================================
+//  Index image - Replace the secondary index entries of the previous version of an image (nil for a new image) by
+//  those of the new one
+//=======================================================================================================================
+
+func IndexImage(stub shim.ChaincodeStubInterface, previous *Image, image Image) error {
+
+	keys, err := secondaryKeys(stub, image)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if previous != nil {
+
+		previousKeys, err := secondaryKeys(stub, *previous)
+
+		if err != nil {
+
+			return err
+
+		}
+
+		for key := range previousKeys {
+
+			if keys[key] {
+
+				delete(keys, key)
+				continue
+
+			}
+
+			if err = stub.DelState(key); err != nil {
+
+				return WrapError(err, "Error removing image " + image.ID + " from a secondary index")
+
+			}
+
+		}
+
+	}
+
+	for key := range keys {
+
+		if err = stub.PutState(key, indexEntryValue); err != nil {
+
+			return WrapError(err, "Error adding image " + image.ID + " to a secondary index")
+
+		}
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Store image - Add a new image and its index entries, ALREADY_EXISTS if the ID is taken
+//=======================================================================================================================
+
+func StoreImage(stub shim.ChaincodeStubInterface, image Image) error {
+
+	imageAsBytes, err := json.Marshal(image)
+
+	if err != nil {
+
+		return WrapError(err, "Error marshalling image")
+
+	}
+
+	if err = Store(stub, image.ID, ImagesIndexName, imageAsBytes); err != nil {
+
+		return err
+
+	}
+
+	return IndexImage(stub, nil, image)
+
+}
+
+//=======================================================================================================================
+//  Index existing images - Add the images stored before the secondary indexes, once. Images migrated by the same
+//  transaction are not visible in the images index yet and are passed as migrated. Returns the number indexed.
+//=======================================================================================================================
+
+func IndexExistingImages(stub shim.ChaincodeStubInterface, migrated []Image) (int, error) {
+
+	images := migrated
+
+	done, err := stub.GetState(SecondaryIndexesKey)
+
+	if err != nil {
+
+		return 0, WrapError(err, "Could not retrieve " + SecondaryIndexesKey)
+
+	}
+
+	if done == nil {
+
+		err = ForEachInIndex(stub, ImagesIndexName, func(imageID string, imageAsBytes []byte) error {
+
+			var image Image
+
+			if err := json.Unmarshal(imageAsBytes, &image); err != nil {
+
+				return WrapError(err, "Error while unmarshalling image " + imageID)
+
+			}
+
+			images = append(images, image)
+
+			return nil
+
+		})
+
+		if err != nil {
+
+			return 0, err
+
+		}
+
+		if err = stub.PutState(SecondaryIndexesKey, []byte("1")); err != nil {
+
+			return 0, WrapError(err, "Error storing " + SecondaryIndexesKey)
+
+		}
+
+	}
+
+	for _, image := range images {
+
+		if err = IndexImage(stub, nil, image); err != nil {
+
+			return 0, err
+
+		}
+
+	}
+
+	return len(images), nil
+
+}
+
+//=======================================================================================================================
+//  Page images in index - args: the page request as parsed by ParsePageRequest from offset. Lists the images under
+//  value in a secondary index that are in the caller's organization; ascending pages by ID are read with PageKeys
+//  unless the index spans organizations, and sorting by ID needs no image to be read before the page is known.
+//=======================================================================================================================
+
+func PageImagesInIndex(stub shim.ChaincodeStubInterface, args []string, offset int, indexName string, value string) ([]byte, error) {
+
+	return pageImagesUnder(stub, args, offset, indexName, []string{value})
+
+}
+
+// Like PageImagesInIndex, for the images under any prefix of an index whose last attribute is the image ID
+func pageImagesUnder(stub shim.ChaincodeStubInterface, args []string, offset int, indexName string, prefix []string) ([]byte, error) {
+
+	request, err := ParsePageRequest(args, offset, SortByID, SortByPurchaseDate, SortByStatus)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	// The entries of an organization's own index need no check
+	scope := OrganizationScope(caller)
+
+	if indexName == ImagesByOrganizationIndexName {
+
+		scope = nil
+
+	}
+
+	if scope == nil && request.byKey() {
+
+		ids, page, err := PageKeys(stub, request, indexName, prefix)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		return loadImagesPage(stub, page, ids)
+
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(indexName, prefix)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Failed to get " + indexName)
+
+	}
+
+	defer iterator.Close()
+
+	var entries []pageEntry
+
+	for iterator.HasNext() {
+
+		entry, err := iterator.Next()
+
+		if err != nil {
+
+			return nil, WrapError(err, "Error iterating index '" + indexName + "'")
+
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(entry.Key)
+
+		if err != nil || len(attributes) != len(prefix) + 1 {
+
+			return nil, NewError(CodeInternal, "Malformed key in index '" + indexName + "'")
+
+		}
+
+		imageID := attributes[len(prefix)]
+		sortKey := imageID
+
+		if request.Field != SortByID || scope != nil {
+
+			image, err := LoadImage(stub, imageID)
+
+			if err != nil {
+
+				return nil, err
+
+			}
+
+			if scope != nil && !scope.Matches(image) {
+
+				continue
+
+			}
+
+			sortKey = imageSortKey(image, request.Field)
+
+		}
+
+		entries = append(entries, pageEntry{id: imageID, sortKey: sortKey})
+
+	}
+
+	return pageOfImages(stub, request, entries)
+
+}
+
+//=======================================================================================================================
+//  For each image in index - Calls handle with every image under value in a secondary index
+//=======================================================================================================================
+
+func ForEachImageInIndex(stub shim.ChaincodeStubInterface, indexName string, value string, handle func(image Image) error) error {
+
+	iterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{value})
+
+	if err != nil {
+
+		return WrapError(err, "Failed to get " + indexName)
+
+	}
+
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+
+		entry, err := iterator.Next()
+
+		if err != nil {
+
+			return WrapError(err, "Error iterating index '" + indexName + "'")
+
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(entry.Key)
+
+		if err != nil || len(attributes) != 2 {
+
+			return NewError(CodeInternal, "Malformed key in index '" + indexName + "'")
+
+		}
+
+		image, err := LoadImage(stub, attributes[1])
+
+		if err != nil {
+
+			return err
+
+		}
+
+		if err = handle(image); err != nil {
+
+			return err
+
+		}
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Get images by author, status and provider - args[0] = author, status (number or name) or provider (registered ID
+//  or host), args[1..3] = page size, bookmark and sort as described in Pagination.go
+//=======================================================================================================================
+
+func GetImagesByAuthor(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	return PageImagesInIndex(stub, args, 1, ImagesByAuthorIndexName, args[0])
+
+}
+
+func GetImagesByStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	status, err := ParseImageStatus(args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return PageImagesInIndex(stub, args, 1, ImagesByStatusIndexName, status.Key())
+
+}
+
+func GetImagesByProvider(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	provider := args[0]
+
+	// Images of unregistered providers are listed by host
+	if _, err := GetProvider(stub, provider); HasCode(err, CodeNotFound) {
+
+		provider = strings.TrimPrefix(strings.ToLower(provider), "www.")
+
+	} else if err != nil {
+
+		return nil, err
+
+	}
+
+	return PageImagesInIndex(stub, args, 1, ImagesByProviderIndexName, provider)
+
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+
+	"sort"
+	"time"
+	"regexp"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Image filter - A JSON object of conditions on image fields, all of which must hold. A condition is a value, or an
+// object of operators: {"author":"ildogesto", "status":{"$in":["Delivered","Expired"]},
+// "purchase-date":{"$gte":"2017-01-01","$lt":"2018-01-01"}, "url-domain":"istockphoto.com"}.
+//
+// With CouchDB as state database the filter is sent as a rich query selector, otherwise the images index is scanned.
+// Both ways every image is checked against the filter by the chaincode, so the results are identical: the selector
+// only narrows what is read. Purchase dates are stored in two layouts and are only checked by the chaincode.
+//=======================================================================================================================
+
+var equalityOperators = []string{"$eq", "$in"}
+var rangeOperators    = []string{"$eq", "$in", "$gt", "$gte", "$lt", "$lte"}
+
+type filterField struct {
+
+	operators   []string
+	expected    string                                      // what a value must be, for validation errors
+	parse       func(raw json.RawMessage) (interface{}, bool)
+	value       func(image Image) interface{}
+
+}
+
+var imageFilterFields = map[string]filterField{
+
+	"id":               {equalityOperators, "a string", parseFilterString, func(image Image) interface{} { return image.ID }},
+	"user":             {equalityOperators, "a string", parseFilterString, func(image Image) interface{} { return image.User }},
+	"author":           {equalityOperators, "a string", parseFilterString, func(image Image) interface{} { return image.Author }},
+	"name":             {equalityOperators, "a string", parseFilterString, func(image Image) interface{} { return image.Name }},
+	"provider":         {equalityOperators, "a provider ID or host", parseFilterString, func(image Image) interface{} { return ImageProvider(image) }},
+	"organization":     {equalityOperators, "an organization ID", parseFilterString, func(image Image) interface{} { return image.Organization }},
+	"status":           {rangeOperators, "a status number or name", parseFilterStatus, func(image Image) interface{} { return image.Status }},
+	"purchase-date":    {rangeOperators, "a date as " + LicenseDateLayout, parseFilterDate, func(image Image) interface{} { return normalizedPurchaseDate(image) }},
+	"url-domain":       {equalityOperators, "a domain name", parseFilterDomain, nil},
+
+}
+
+type filterCondition struct {
+
+	field       string
+	operator    string
+	values      []interface{}
+	pattern     string      // url-domain only, matched against the URL
+
+}
+
+type ImageFilter struct {
+
+	conditions  []filterCondition
+
+}
+
+//=======================================================================================================================
+//  Parse image filter - Decode and validate a filter document, failures are returned as INVALID_ARGUMENT details
+//=======================================================================================================================
+
+func ParseImageFilter(filterAsJSON string) (*ImageFilter, error) {
+
+	var document map[string]json.RawMessage
+
+	if err := json.Unmarshal([]byte(filterAsJSON), &document); err != nil || document == nil {
+
+		return nil, NewError(CodeInvalidArgument, "Filter must be a JSON object")
+
+	}
+
+	var validation Validation
+	filter := &ImageFilter{}
+
+	// In field order, so conditions and errors do not depend on map iteration
+	for _, field := range sortedKeys(document) {
+
+		spec, known := imageFilterFields[field]
+
+		if !known {
+
+			validation.Fail("filter." + field, "is not one of " + strings.Join(filterFieldNames(), ", "))
+			continue
+
+		}
+
+		operators := map[string]json.RawMessage{}
+
+		if raw := strings.TrimSpace(string(document[field])); !strings.HasPrefix(raw, "{") {
+
+			operators["$eq"] = document[field]
+
+		} else if err := json.Unmarshal(document[field], &operators); err != nil || len(operators) == 0 {
+
+			validation.Fail("filter." + field, "must be a value or an object of operators")
+			continue
+
+		}
+
+		for _, operator := range sortedKeys(operators) {
+
+			if !contains(spec.operators, operator) {
+
+				validation.Fail("filter." + field, "supports " + strings.Join(spec.operators, ", ") + ", not " + operator)
+				continue
+
+			}
+
+			operands := []json.RawMessage{operators[operator]}
+
+			if operator == "$in" {
+
+				if err := json.Unmarshal(operators[operator], &operands); err != nil || len(operands) == 0 {
+
+					validation.Fail("filter." + field, "$in must be a non-empty array")
+					continue
+
+				}
+
+			}
+
+			condition := filterCondition{field: field, operator: operator}
+
+			for _, operand := range operands {
+
+				value, ok := spec.parse(operand)
+
+				if !ok {
+
+					validation.Fail("filter." + field, "must be " + spec.expected + ", got " + string(operand))
+					continue
+
+				}
+
+				condition.values = append(condition.values, value)
+
+			}
+
+			if field == "url-domain" {
+
+				condition.pattern = domainPattern(condition.values)
+
+			}
+
+			filter.conditions = append(filter.conditions, condition)
+
+		}
+
+	}
+
+	if err := validation.Error("Invalid image filter"); err != nil {
+
+		return nil, err
+
+	}
+
+	return filter, nil
+
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+
+	var keys []string
+
+	for key := range m {
+
+		keys = append(keys, key)
+
+	}
+
+	sort.Strings(keys)
+
+	return keys
+
+}
+
+func filterFieldNames() []string {
+
+	var names []string
+
+	for name := range imageFilterFields {
+
+		names = append(names, name)
+
+	}
+
+	sort.Strings(names)
+
+	return names
+
+}
+
+func parseFilterString(raw json.RawMessage) (interface{}, bool) {
+
+	var value string
+
+	return value, json.Unmarshal(raw, &value) == nil
+
+}
+
+func parseFilterStatus(raw json.RawMessage) (interface{}, bool) {
+
+	var value interface{}
+
+	if json.Unmarshal(raw, &value) != nil {
+
+		return nil, false
+
+	}
+
+	// Numbers as they are stored, or names
+	switch value.(type) {
+
+	case float64, string:
+
+		status, err := ParseImageStatus(strings.Trim(string(raw), `"`))
+
+		return status, err == nil
+
+	}
+
+	return nil, false
+
+}
+
+func parseFilterDate(raw json.RawMessage) (interface{}, bool) {
+
+	var value string
+
+	if json.Unmarshal(raw, &value) != nil {
+
+		return nil, false
+
+	}
+
+	_, err := time.Parse(LicenseDateLayout, value)
+
+	return value, err == nil
+
+}
+
+var domainName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+func parseFilterDomain(raw json.RawMessage) (interface{}, bool) {
+
+	var value string
+
+	if json.Unmarshal(raw, &value) != nil {
+
+		return nil, false
+
+	}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	return value, domainName.MatchString(value)
+
+}
+
+//=======================================================================================================================
+//  Domain pattern - Matches http(s) URLs whose host is one of the domains or a subdomain of one. Written for both Go
+//  and CouchDB (PCRE) regular expressions, which agree on this subset.
+//=======================================================================================================================
+
+func domainPattern(domains []interface{}) string {
+
+	var alternatives []string
+
+	for _, domain := range domains {
+
+		alternatives = append(alternatives, regexp.QuoteMeta(domain.(string)))
+
+	}
+
+	return `(?i)^https?://([^/?#@]*@)?([^/?#@:]*\.)?(` + strings.Join(alternatives, "|") + `)(:[0-9]*)?([/?#]|$)`
+
+}
+
+//=======================================================================================================================
+//  And - A filter of the conditions of both filters, either of which may be nil
+//=======================================================================================================================
+
+func (f *ImageFilter) And(other *ImageFilter) *ImageFilter {
+
+	if f == nil {
+
+		return other
+
+	}
+
+	if other == nil {
+
+		return f
+
+	}
+
+	return &ImageFilter{conditions: append(append([]filterCondition{}, f.conditions...), other.conditions...)}
+
+}
+
+//=======================================================================================================================
+//  Matches - Whether an image satisfies every condition of the filter
+//=======================================================================================================================
+
+func (f *ImageFilter) Matches(image Image) bool {
+
+	for _, condition := range f.conditions {
+
+		if !condition.matches(image) {
+
+			return false
+
+		}
+
+	}
+
+	return true
+
+}
+
+func (c filterCondition) matches(image Image) bool {
+
+	if c.field == "url-domain" {
+
+		matched, err := regexp.MatchString(c.pattern, image.URL)
+
+		return err == nil && matched
+
+	}
+
+	value := imageFilterFields[c.field].value(image)
+
+	// Images without a purchase date match no condition on it
+	if value == "" && c.field == "purchase-date" {
+
+		return false
+
+	}
+
+	for _, operand := range c.values {
+
+		order := compareFilterValues(value, operand)
+
+		switch c.operator {
+
+		case "$eq", "$in":
+
+			if order == 0 {
+
+				return true
+
+			}
+
+		case "$gt":
+
+			return order > 0
+
+		case "$gte":
+
+			return order >= 0
+
+		case "$lt":
+
+			return order < 0
+
+		case "$lte":
+
+			return order <= 0
+
+		}
+
+	}
+
+	return false
+
+}
+
+func hasEmptyValue(values []interface{}) bool {
+
+	for _, value := range values {
+
+		if value == "" {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+func compareFilterValues(a interface{}, b interface{}) int {
+
+	if status, ok := a.(ImageStatus); ok {
+
+		return int(status) - int(b.(ImageStatus))
+
+	}
+
+	return strings.Compare(a.(string), b.(string))
+
+}
+
+//=======================================================================================================================
+//  Selector - The CouchDB rich query of the filter, nil when no condition can be expressed in one
+//=======================================================================================================================
+
+func (f *ImageFilter) selector() map[string]interface{} {
+
+	var conditions []interface{}
+
+	for _, condition := range f.conditions {
+
+		// The default organization also matches images without the field, which a selector cannot express
+		if condition.field == "organization" && hasEmptyValue(condition.values) {
+
+			continue
+
+		}
+
+		switch condition.field {
+
+		// Normalized dates and the URL host of images without provider are not fields of the stored image
+		case "purchase-date", "provider":
+
+			continue
+
+		case "url-domain":
+
+			conditions = append(conditions, map[string]interface{}{"url": map[string]interface{}{"$regex": condition.pattern}})
+
+		default:
+
+			var operand interface{} = condition.values[0]
+
+			if condition.operator == "$in" {
+
+				operand = condition.values
+
+			}
+
+			conditions = append(conditions, map[string]interface{}{condition.field: map[string]interface{}{condition.operator: operand}})
+
+		}
+
+	}
+
+	if len(conditions) == 0 {
+
+		return nil
+
+	}
+
+	return map[string]interface{}{"selector": map[string]interface{}{"$and": conditions}}
+
+}
+
+//=======================================================================================================================
+//  For each image - Call handle for every image matching the filter (all images if it is nil), using a rich query
+//  if the state database supports them
+//=======================================================================================================================
+
+func ForEachImage(stub shim.ChaincodeStubInterface, filter *ImageFilter, handle func(image Image) error) error {
+
+	check := func(imageID string, imageAsBytes []byte) error {
+
+		var image Image
+
+		if err := json.Unmarshal(imageAsBytes, &image); err != nil {
+
+			return WrapError(err, "Error while unmarshalling image " + imageID)
+
+		}
+
+		if filter != nil && !filter.Matches(image) {
+
+			return nil
+
+		}
+
+		return handle(image)
+
+	}
+
+	if filter == nil || filter.selector() == nil {
+
+		return ForEachInIndex(stub, ImagesIndexName, check)
+
+	}
+
+	query, err := json.Marshal(filter.selector())
+
+	if err != nil {
+
+		return WrapError(err, "Error marshalling image query")
+
+	}
+
+	iterator, err := stub.GetQueryResult(string(query))
+
+	// LevelDB does not support rich queries
+	if err != nil {
+
+		logger.Debugf("Rich query not available, scanning %v: %v", ImagesIndexName, err)
+		return ForEachInIndex(stub, ImagesIndexName, check)
+
+	}
+
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+
+		entry, err := iterator.Next()
+
+		if err != nil {
+
+			return WrapError(err, "Error iterating image query")
+
+		}
+
+		// Other objects may have the queried fields too
+		indexName, attributes, err := stub.SplitCompositeKey(entry.Key)
+
+		if err != nil || indexName != ImagesIndexName || len(attributes) != 1 {
+
+			continue
+
+		}
+
+		if err = check(attributes[0], entry.Value); err != nil {
+
+			return err
+
+		}
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Query images - args[0] = filter, args[1..3] = page size, bookmark and sort as described in Pagination.go
+//=======================================================================================================================
+
+func QueryImages(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	filter, err := ParseImageFilter(args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return PageImages(stub, args, 1, filter)
+
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+
+	"time"
+	"strconv"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Image status - License state of an image. The numeric values are stored in Image.Status, 1 and 2 keep the meaning
+// they had before the state machine was introduced.
+//=======================================================================================================================
+
+type ImageStatus int
+
+const (
+	StatusNone       ImageStatus = 0
+	StatusDemanded   ImageStatus = 1
+	StatusDelivered  ImageStatus = 2
+	StatusApproved   ImageStatus = 3
+	StatusRejected   ImageStatus = 4
+	StatusExpired    ImageStatus = 5
+	StatusRevoked    ImageStatus = 6
+	StatusArchived   ImageStatus = 7
+)
+
+var statusNames = map[ImageStatus]string{
+	StatusNone:       "None",
+	StatusDemanded:   "Demanded",
+	StatusDelivered:  "Delivered",
+	StatusApproved:   "Approved",
+	StatusRejected:   "Rejected",
+	StatusExpired:    "Expired",
+	StatusRevoked:    "Revoked",
+	StatusArchived:   "Archived",
+}
+
+//=======================================================================================================================
+// Transition table - Allowed next states for every state. StatusNone is the state of an image that does not exist yet.
+//=======================================================================================================================
+
+var imageTransitions = map[ImageStatus][]ImageStatus{
+	StatusNone:       {StatusDemanded},
+	StatusDemanded:   {StatusApproved, StatusRejected},
+	StatusApproved:   {StatusDelivered, StatusRejected},
+	StatusRejected:   {StatusArchived},
+	StatusDelivered:  {StatusExpired, StatusRevoked, StatusArchived},
+	StatusExpired:    {StatusRevoked, StatusArchived},
+	StatusRevoked:    {StatusArchived},
+	StatusArchived:   {},
+}
+
+//=======================================================================================================================
+// Status change - One recorded transition of an image
+//=======================================================================================================================
+
+type StatusChange struct {
+
+	From        ImageStatus     `json:"from"`
+	To          ImageStatus     `json:"to"`
+	By          string          `json:"by"`
+	At          string          `json:"at"`
+	TxID        string          `json:"tx-id"`
+	Reason      string          `json:"reason,omitempty"`
+
+}
+
+//=======================================================================================================================
+// Status info - A status with its name, as returned by GetAllowedTransitions
+//=======================================================================================================================
+
+type StatusInfo struct {
+
+	Status      ImageStatus     `json:"status"`
+	Name        string          `json:"name"`
+
+}
+
+//=======================================================================================================================
+// Allowed transitions - The states reachable from a status, optionally for a given image
+//=======================================================================================================================
+
+type AllowedTransitions struct {
+
+	ImageID     string          `json:"image-id,omitempty"`
+	Status      ImageStatus     `json:"status"`
+	Name        string          `json:"name"`
+	Allowed     []StatusInfo    `json:"allowed"`
+
+}
+
+//=======================================================================================================================
+//  String - Name of the status
+//=======================================================================================================================
+
+func (s ImageStatus) String() string {
+
+	if name, ok := statusNames[s]; ok {
+
+		return name
+
+	}
+
+	return "Unknown"
+
+}
+
+//=======================================================================================================================
+//  Key - The status as an attribute of a composite key
+//=======================================================================================================================
+
+func (s ImageStatus) Key() string {
+
+	return strconv.Itoa(int(s))
+
+}
+
+//=======================================================================================================================
+//  Parse image status - A status by number or by name, case-insensitive
+//=======================================================================================================================
+
+func ParseImageStatus(value string) (ImageStatus, error) {
+
+	value = strings.TrimSpace(value)
+
+	if number, err := strconv.Atoi(value); err == nil {
+
+		if _, known := statusNames[ImageStatus(number)]; known {
+
+			return ImageStatus(number), nil
+
+		}
+
+	}
+
+	for status, name := range statusNames {
+
+		if strings.EqualFold(value, name) {
+
+			return status, nil
+
+		}
+
+	}
+
+	return StatusNone, NewError(CodeInvalidArgument, "'" + value + "' is not an image status")
+
+}
+
+//=======================================================================================================================
+//  Can transition - Check the transition table
+//=======================================================================================================================
+
+func CanTransition(from ImageStatus, to ImageStatus) bool {
+
+	for _, allowed := range imageTransitions[from] {
+
+		if allowed == to {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+//=======================================================================================================================
+//  Get transaction time - The transaction timestamp, identical on every endorsing peer unlike the wall clock
+//=======================================================================================================================
+
+func GetTransactionTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+
+	timestamp, err := stub.GetTxTimestamp()
+
+	if err != nil {
+
+		return time.Time{}, WrapError(err, "Could not get transaction timestamp")
+
+	}
+
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+
+}
+
+//=======================================================================================================================
+//  Transition image - Move the image to a new status, record who did it, when and why, and emit Image<Status>
+//=======================================================================================================================
+
+func TransitionImage(stub shim.ChaincodeStubInterface, image *Image, to ImageStatus, actor string, reason string) error {
+
+	if !CanTransition(image.Status, to) {
+
+		return NewError(CodeInvalidState, "Image " + image.ID + " cannot go from " + image.Status.String() + " to " + to.String())
+
+	}
+
+	now, err := GetTransactionTime(stub)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	image.StatusChanges = append(image.StatusChanges, StatusChange{
+
+		From: image.Status,
+		To:   to,
+		By:   actor,
+		At:   now.Format(time.RFC3339),
+		TxID: stub.GetTxID(),
+		Reason: reason,
+
+	})
+
+	from := image.Status
+	image.Status = to
+
+	return EmitImageEvent(stub, image.ID, from, to, actor, reason)
+
+}
+
+//=======================================================================================================================
+//  Get allowed transitions - For one image (args[0]) or, without arguments, for every status
+//=======================================================================================================================
+
+func GetAllowedTransitions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) == 0 {
+
+		var table []AllowedTransitions
+
+		for status := StatusDemanded; status <= StatusArchived; status++ {
+
+			table = append(table, allowedTransitionsFrom(status))
+
+		}
+
+		return json.Marshal(table)
+
+	}
+
+	image, err := LoadImage(stub, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	transitions := allowedTransitionsFrom(image.Status)
+	transitions.ImageID = image.ID
+
+	return json.Marshal(transitions)
+
+}
+
+func allowedTransitionsFrom(status ImageStatus) AllowedTransitions {
+
+	allowed := []StatusInfo{}
+
+	for _, to := range imageTransitions[status] {
+
+		allowed = append(allowed, StatusInfo{Status: to, Name: to.String()})
+
+	}
+
+	return AllowedTransitions{
+
+		Status:  status,
+		Name:    status.String(),
+		Allowed: allowed,
+
+	}
+
+}
+
+//=======================================================================================================================
+//  Archive image - args[0] = image ID, args[1] = reason (optional). Retires a rejected, delivered, expired or revoked
+//  image; archived images are kept with their history but can no longer change.
+//=======================================================================================================================
+
+func ArchiveImage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	image, err := LoadImage(stub, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if err = TransitionImage(stub, &image, StatusArchived, caller.Name(), strings.TrimSpace(optionalArg(args, 1))); err != nil {
+
+		return nil, err
+
+	}
+
+	if err = SaveImage(stub, image); err != nil {
+
+		return nil, err
+
+	}
+
+	return json.Marshal(image)
+
+}
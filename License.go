@@ -0,0 +1,347 @@
+package main
+
+import (
+
+	"time"
+	"bytes"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// License types - Royalty-free pictures may be used without time limit, rights-managed ones for a limited period,
+// editorial ones not in advertising
+//=======================================================================================================================
+
+const LicenseRoyaltyFree     =   "royalty-free"
+const LicenseRightsManaged   =   "rights-managed"
+const LicenseEditorial       =   "editorial"
+
+var licenseTypes = map[string]bool{LicenseRoyaltyFree: true, LicenseRightsManaged: true, LicenseEditorial: true}
+
+//=======================================================================================================================
+// Media and territories - Where a picture may be used. Territories are ISO 3166 country codes, or worldwide.
+//=======================================================================================================================
+
+const MediumAdvertising  =   "advertising"
+
+var licenseMedia = map[string]bool{"print": true, "web": true, "social-media": true, MediumAdvertising: true,
+	"broadcast": true, "internal": true}
+
+const TerritoryWorldwide  =   "worldwide"
+
+// Layout of license dates and of the date of CheckUsageAllowed
+const LicenseDateLayout = "2006-01-02"
+
+//=======================================================================================================================
+// License - The terms an image was bought under, captured when it is delivered
+//=======================================================================================================================
+
+type License struct {
+
+	Type                    string      `json:"type"`
+	Media                   []string    `json:"media"`
+	Territories             []string    `json:"territories"`
+	Seats                   int         `json:"seats"`
+	StartDate               string      `json:"start-date"`
+	EndDate                 string      `json:"end-date,omitempty"`        // none for a perpetual license
+	AttributionRequired     bool        `json:"attribution-required"`
+	Attribution             string      `json:"attribution,omitempty"`     // credit line, if required
+	ProviderLicenseID       string      `json:"provider-license-id,omitempty"`
+	Transferable            bool        `json:"transferable"`              // whether the image may be moved to another user
+
+}
+
+//=======================================================================================================================
+//  Parse license - Decode and validate the license JSON of DeliverImage, failures are added to the validation
+//=======================================================================================================================
+
+func ParseLicense(licenseAsJSON string, validation *Validation) *License {
+
+	var license License
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(licenseAsJSON)))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&license); err != nil {
+
+		validation.Fail("license", "is not a valid license, reason: " + err.Error())
+		return nil
+
+	}
+
+	license.Type = strings.ToLower(license.Type)
+
+	if !licenseTypes[license.Type] {
+
+		validation.Fail("license.type", "must be one of " + LicenseRoyaltyFree + ", " + LicenseRightsManaged + ", " + LicenseEditorial)
+
+	}
+
+	if len(license.Media) == 0 {
+
+		validation.Fail("license.media", "is required")
+
+	}
+
+	for i, medium := range license.Media {
+
+		license.Media[i] = strings.ToLower(medium)
+
+		if !licenseMedia[license.Media[i]] {
+
+			validation.Fail("license.media", medium + " is not one of print, web, social-media, advertising, broadcast, internal")
+
+		} else if license.Media[i] == MediumAdvertising && license.Type == LicenseEditorial {
+
+			validation.Fail("license.media", "editorial licenses do not allow advertising")
+
+		}
+
+	}
+
+	if len(license.Territories) == 0 {
+
+		validation.Fail("license.territories", "is required")
+
+	}
+
+	for i, territory := range license.Territories {
+
+		license.Territories[i] = normalizeTerritory(territory)
+
+		if !isTerritory(license.Territories[i]) {
+
+			validation.Fail("license.territories", territory + " is not a country code or " + TerritoryWorldwide)
+
+		}
+
+	}
+
+	if license.Seats < 1 {
+
+		validation.Fail("license.seats", "must be at least 1")
+
+	}
+
+	start, err := time.Parse(LicenseDateLayout, license.StartDate)
+
+	if err != nil {
+
+		validation.Fail("license.start-date", "must be a date as " + LicenseDateLayout)
+
+	}
+
+	if license.EndDate != "" {
+
+		end, endErr := time.Parse(LicenseDateLayout, license.EndDate)
+
+		if endErr != nil {
+
+			validation.Fail("license.end-date", "must be a date as " + LicenseDateLayout)
+
+		} else if err == nil && end.Before(start) {
+
+			validation.Fail("license.end-date", "must not be before the start date")
+
+		}
+
+	} else if license.Type == LicenseRightsManaged {
+
+		validation.Fail("license.end-date", "is required for rights-managed licenses")
+
+	}
+
+	if license.AttributionRequired && strings.TrimSpace(license.Attribution) == "" {
+
+		validation.Fail("license.attribution", "is required when attribution is required")
+
+	}
+
+	return &license
+
+}
+
+// Country codes are upper case, worldwide lower case
+func normalizeTerritory(territory string) string {
+
+	territory = strings.TrimSpace(territory)
+
+	if strings.EqualFold(territory, TerritoryWorldwide) {
+
+		return TerritoryWorldwide
+
+	}
+
+	return strings.ToUpper(territory)
+
+}
+
+func isTerritory(territory string) bool {
+
+	if territory == TerritoryWorldwide {
+
+		return true
+
+	}
+
+	return len(territory) == 2 && territory[0] >= 'A' && territory[0] <= 'Z' && territory[1] >= 'A' && territory[1] <= 'Z'
+
+}
+
+//=======================================================================================================================
+//  Allows - The reasons a use is not covered by the license, none if it is
+//=======================================================================================================================
+
+func (l License) Allows(medium string, territory string, date string) []string {
+
+	var reasons []string
+
+	if !contains(l.Media, medium) {
+
+		reasons = append(reasons, "medium " + medium + " is not licensed, only " + strings.Join(l.Media, ", "))
+
+	}
+
+	if !contains(l.Territories, TerritoryWorldwide) && !contains(l.Territories, territory) {
+
+		reasons = append(reasons, "territory " + territory + " is not licensed, only " + strings.Join(l.Territories, ", "))
+
+	}
+
+	// Dates as YYYY-MM-DD compare like strings
+	if date < l.StartDate {
+
+		reasons = append(reasons, "the license starts on " + l.StartDate)
+
+	}
+
+	if l.EndDate != "" && date > l.EndDate {
+
+		reasons = append(reasons, "the license ended on " + l.EndDate)
+
+	}
+
+	return reasons
+
+}
+
+func contains(values []string, value string) bool {
+
+	for _, v := range values {
+
+		if v == value {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+//=======================================================================================================================
+// Usage check - Whether an image may be used in a medium, in a territory, on a date
+//=======================================================================================================================
+
+type UsageCheck struct {
+
+	ImageID                 string      `json:"image-id"`
+	Medium                  string      `json:"medium"`
+	Territory               string      `json:"territory"`
+	Date                    string      `json:"date"`
+	Allowed                 bool        `json:"allowed"`
+	Reasons                 []string    `json:"reasons,omitempty"`
+	AttributionRequired     bool        `json:"attribution-required,omitempty"`
+	Attribution             string      `json:"attribution,omitempty"`
+
+}
+
+//=======================================================================================================================
+//  Check usage allowed - args: image ID, medium, territory, date (optional, YYYY-MM-DD, defaults to the transaction
+//  date). Revoked images fail with LICENSE_REVOKED instead of being reported as not allowed.
+//=======================================================================================================================
+
+func CheckUsageAllowed(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var validation Validation
+
+	check := UsageCheck{ImageID: args[0], Medium: strings.ToLower(args[1]), Territory: normalizeTerritory(args[2]), Date: optionalArg(args, 3)}
+
+	if !licenseMedia[check.Medium] {
+
+		validation.Fail("medium", args[1] + " is not one of print, web, social-media, advertising, broadcast, internal")
+
+	}
+
+	if check.Territory == TerritoryWorldwide || !isTerritory(check.Territory) {
+
+		validation.Fail("territory", "must be a country code")
+
+	}
+
+	if check.Date == "" {
+
+		txTime, err := GetTransactionTime(stub)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		check.Date = txTime.Format(LicenseDateLayout)
+
+	} else if _, err := time.Parse(LicenseDateLayout, check.Date); err != nil {
+
+		validation.Fail("date", "must be a date as " + LicenseDateLayout)
+
+	}
+
+	if err := validation.Error("Invalid usage check"); err != nil {
+
+		return nil, err
+
+	}
+
+	image, err := LoadImage(stub, check.ImageID)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if err = RevokedError(image); err != nil {
+
+		return nil, err
+
+	}
+
+	if image.Status != StatusDelivered {
+
+		check.Reasons = append(check.Reasons, "image " + image.ID + " is " + image.Status.String() + ", not delivered")
+
+	}
+
+	if image.License == nil {
+
+		check.Reasons = append(check.Reasons, "no license terms are recorded for image " + image.ID)
+
+	} else {
+
+		check.Reasons = append(check.Reasons, image.License.Allows(check.Medium, check.Territory, check.Date)...)
+		check.AttributionRequired = image.License.AttributionRequired
+		check.Attribution = image.License.Attribution
+
+	}
+
+	check.Allowed = len(check.Reasons) == 0
+
+	return json.Marshal(check)
+
+}
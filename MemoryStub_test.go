@@ -0,0 +1,956 @@
+package main
+
+import (
+
+	"fmt"
+	"sort"
+	"io/ioutil"
+	"time"
+	"regexp"
+	"reflect"
+	"strings"
+	"testing"
+	"math/big"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"unicode/utf8"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+)
+
+//=======================================================================================================================
+// Memory stub - In-memory stand-in for the peer. Unlike shim.MockStub it has a creator certificate, and like a real
+// peer it reads committed state only: writes become visible when the transaction succeeds and are dropped when it
+// fails. Stub methods the chaincode does not use are left to the embedded nil interface.
+//=======================================================================================================================
+
+var testEpoch = time.Date(2017, time.May, 19, 10, 0, 0, 0, time.UTC)
+
+type memoryStub struct {
+
+	shim.ChaincodeStubInterface
+
+	t           *testing.T
+	cc          *SampleChaincode
+	state       map[string][]byte
+	writes      map[string][]byte
+	deletes     map[string]bool
+	args        [][]byte
+	creator     []byte
+	txCount     int
+	txID        string
+	txTime      time.Time
+	eventName   string          // event of the last transaction, a peer keeps only the last SetEvent
+	event       []byte
+	history     map[string][]*queryresult.KeyModification
+	couchDB     bool            // whether rich queries are supported, like a peer with CouchDB as state database
+	queries     []string
+	private     map[string]map[string][]byte    // private data by collection, all collections are on this peer
+	collections map[string]bool                 // the collections of collections_config.json
+	pvtWrites   map[string]map[string][]byte    // private data written by the running transaction
+	transient   map[string][]byte               // transient data of the next transaction
+	paginated   bool            // the running transaction made a paginated query, after which a peer refuses writes
+
+}
+
+func newMemoryStub(t *testing.T) *memoryStub {
+
+	s := &memoryStub{
+
+		t:              t,
+		cc:             new(SampleChaincode),
+		state:          map[string][]byte{},
+		history:        map[string][]*queryresult.KeyModification{},
+		private:        map[string]map[string][]byte{},
+		collections:    map[string]bool{},
+
+	}
+
+	configAsBytes, err := ioutil.ReadFile("collections_config.json")
+
+	if err != nil {
+
+		t.Fatalf("Could not read the collection config: %v", err)
+
+	}
+
+	var collections []struct{ Name string `json:"name"` }
+
+	if err = json.Unmarshal(configAsBytes, &collections); err != nil {
+
+		t.Fatalf("Invalid collection config: %v", err)
+
+	}
+
+	for _, collection := range collections {
+
+		s.collections[collection.Name] = true
+
+	}
+
+	return s
+
+}
+
+//=======================================================================================================================
+//  Transactions
+//=======================================================================================================================
+
+func (s *memoryStub) begin(creator []byte, args []string) {
+
+	s.txCount++
+	s.txID = fmt.Sprintf("tx%04d", s.txCount)
+	s.txTime = testEpoch.Add(time.Duration(s.txCount) * time.Minute)
+	s.creator = creator
+	s.writes = map[string][]byte{}
+	s.deletes = map[string]bool{}
+	s.pvtWrites = map[string]map[string][]byte{}
+	s.args = nil
+	s.eventName, s.event = "", nil
+	s.paginated = false
+
+	for _, arg := range args {
+
+		s.args = append(s.args, []byte(arg))
+
+	}
+
+}
+
+func (s *memoryStub) end(response pb.Response) pb.Response {
+
+	if response.Status < shim.ERRORTHRESHOLD {
+
+		txTimestamp := &timestamp.Timestamp{Seconds: s.txTime.Unix(), Nanos: int32(s.txTime.Nanosecond())}
+
+		for key, value := range s.writes {
+
+			s.state[key] = value
+			s.history[key] = append(s.history[key], &queryresult.KeyModification{TxId: s.txID, Value: value, Timestamp: txTimestamp})
+
+		}
+
+		for key := range s.deletes {
+
+			delete(s.state, key)
+			s.history[key] = append(s.history[key], &queryresult.KeyModification{TxId: s.txID, Timestamp: txTimestamp, IsDelete: true})
+
+		}
+
+	}
+
+	if response.Status < shim.ERRORTHRESHOLD {
+
+		for collection, writes := range s.pvtWrites {
+
+			if s.private[collection] == nil {
+
+				s.private[collection] = map[string][]byte{}
+
+			}
+
+			for key, value := range writes {
+
+				s.private[collection][key] = value
+
+			}
+
+		}
+
+	}
+
+	s.writes, s.deletes, s.pvtWrites, s.transient = nil, nil, nil, nil
+
+	return response
+
+}
+
+func (s *memoryStub) init(creator []byte, args ...string) pb.Response {
+
+	s.begin(creator, append([]string{"Init"}, args...))
+
+	return s.end(s.cc.Init(s))
+
+}
+
+func (s *memoryStub) invoke(creator []byte, function string, args ...string) pb.Response {
+
+	s.begin(creator, append([]string{function}, args...))
+
+	return s.end(s.cc.Invoke(s))
+
+}
+
+// mustInvoke fails the test unless the call succeeds
+func (s *memoryStub) mustInvoke(creator []byte, function string, args ...string) []byte {
+
+	s.t.Helper()
+
+	response := s.invoke(creator, function, args...)
+
+	if response.Status != shim.OK {
+
+		s.t.Fatalf("%v%v: expected status 200, got %v: %v", function, args, response.Status, response.Message)
+
+	}
+
+	return response.Payload
+
+}
+
+// mustFail fails the test unless the call returns an error with the given code
+func (s *memoryStub) mustFail(creator []byte, code ErrorCode, function string, args ...string) ChaincodeError {
+
+	s.t.Helper()
+
+	response := s.invoke(creator, function, args...)
+
+	var chaincodeError ChaincodeError
+
+	if err := json.Unmarshal([]byte(response.Message), &chaincodeError); err != nil {
+
+		s.t.Fatalf("%v%v: expected an error envelope, got status %v: %v", function, args, response.Status, response.Message)
+
+	}
+
+	if chaincodeError.Code != code || response.Status != errorStatuses[code] {
+
+		s.t.Fatalf("%v%v: expected %v (%v), got %v: %v", function, args, code, errorStatuses[code], response.Status, response.Message)
+
+	}
+
+	return chaincodeError
+
+}
+
+//=======================================================================================================================
+//  ChaincodeStubInterface
+//=======================================================================================================================
+
+func (s *memoryStub) GetArgs() [][]byte {
+
+	return s.args
+
+}
+
+func (s *memoryStub) GetStringArgs() []string {
+
+	var args []string
+
+	for _, arg := range s.args {
+
+		args = append(args, string(arg))
+
+	}
+
+	return args
+
+}
+
+func (s *memoryStub) GetFunctionAndParameters() (string, []string) {
+
+	args := s.GetStringArgs()
+
+	if len(args) == 0 {
+
+		return "", []string{}
+
+	}
+
+	return args[0], args[1:]
+
+}
+
+func (s *memoryStub) GetTxID() string {
+
+	return s.txID
+
+}
+
+func (s *memoryStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+
+	return &timestamp.Timestamp{Seconds: s.txTime.Unix(), Nanos: int32(s.txTime.Nanosecond())}, nil
+
+}
+
+func (s *memoryStub) GetCreator() ([]byte, error) {
+
+	return s.creator, nil
+
+}
+
+func (s *memoryStub) GetState(key string) ([]byte, error) {
+
+	return s.state[key], nil
+
+}
+
+func (s *memoryStub) PutState(key string, value []byte) error {
+
+	if key == "" {
+
+		return fmt.Errorf("key must not be empty")
+
+	}
+
+	if s.paginated {
+
+		return fmt.Errorf("transaction has already performed a paginated query. Writes are not allowed")
+
+	}
+
+	delete(s.deletes, key)
+	s.writes[key] = value
+
+	return nil
+
+}
+
+func (s *memoryStub) DelState(key string) error {
+
+	if s.paginated {
+
+		return fmt.Errorf("transaction has already performed a paginated query. Writes are not allowed")
+
+	}
+
+	delete(s.writes, key)
+	s.deletes[key] = true
+
+	return nil
+
+}
+
+func (s *memoryStub) SetEvent(name string, payload []byte) error {
+
+	if name == "" {
+
+		return fmt.Errorf("event name can not be nil string")
+
+	}
+
+	s.eventName, s.event = name, payload
+
+	return nil
+
+}
+
+func (s *memoryStub) GetTransient() (map[string][]byte, error) {
+
+	return s.transient, nil
+
+}
+
+func (s *memoryStub) GetPrivateData(collection string, key string) ([]byte, error) {
+
+	if !s.collections[collection] {
+
+		return nil, fmt.Errorf("collection plv/%v could not be found", collection)
+
+	}
+
+	return s.private[collection][key], nil
+
+}
+
+func (s *memoryStub) PutPrivateData(collection string, key string, value []byte) error {
+
+	if !s.collections[collection] {
+
+		return fmt.Errorf("collection plv/%v could not be found", collection)
+
+	}
+
+	if s.pvtWrites[collection] == nil {
+
+		s.pvtWrites[collection] = map[string][]byte{}
+
+	}
+
+	s.pvtWrites[collection][key] = value
+
+	return nil
+
+}
+
+func (s *memoryStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+
+	return &memoryHistoryIterator{entries: s.history[key]}, nil
+
+}
+
+func (s *memoryStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+
+	return createCompositeKey(objectType, attributes)
+
+}
+
+func (s *memoryStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+
+	var components []string
+	start := 1
+
+	for i := 1; i < len(compositeKey); i++ {
+
+		if compositeKey[i] == 0 {
+
+			components = append(components, compositeKey[start:i])
+			start = i + 1
+
+		}
+
+	}
+
+	if len(components) == 0 {
+
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+
+	}
+
+	return components[0], components[1:], nil
+
+}
+
+func (s *memoryStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+
+	prefix, err := createCompositeKey(objectType, attributes)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	var keys []string
+
+	for key := range s.state {
+
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+
+			keys = append(keys, key)
+
+		}
+
+	}
+
+	sort.Strings(keys)
+
+	iterator := &memoryIterator{}
+
+	for _, key := range keys {
+
+		iterator.entries = append(iterator.entries, &queryresult.KV{Key: key, Value: s.state[key]})
+
+	}
+
+	return iterator, nil
+
+}
+
+// Like a peer, the bookmark is the first key of the page and the returned bookmark the first key of the next one
+func (s *memoryStub) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+
+	s.paginated = true
+
+	all, err := s.GetStateByPartialCompositeKey(objectType, attributes)
+
+	if err != nil {
+
+		return nil, nil, err
+
+	}
+
+	iterator := &memoryIterator{}
+	metadata := &pb.QueryResponseMetadata{}
+
+	for _, entry := range all.(*memoryIterator).entries {
+
+		if entry.Key < bookmark {
+
+			continue
+
+		}
+
+		if len(iterator.entries) == int(pageSize) {
+
+			metadata.Bookmark = entry.Key
+			break
+
+		}
+
+		iterator.entries = append(iterator.entries, entry)
+
+	}
+
+	metadata.FetchedRecordsCount = int32(len(iterator.entries))
+
+	return iterator, metadata, nil
+
+}
+
+// Returns the JSON objects in the state matching the selector, like CouchDB for the operators the chaincode uses
+func (s *memoryStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+
+	if !s.couchDB {
+
+		return nil, fmt.Errorf("ExecuteQuery not supported for leveldb")
+
+	}
+
+	s.queries = append(s.queries, query)
+
+	var parsed struct {
+
+		Selector    map[string]interface{}  `json:"selector"`
+
+	}
+
+	if err := json.Unmarshal([]byte(query), &parsed); err != nil || parsed.Selector == nil {
+
+		return nil, fmt.Errorf("invalid query %s", query)
+
+	}
+
+	var keys []string
+
+	for key, value := range s.state {
+
+		var object map[string]interface{}
+
+		if json.Unmarshal(value, &object) != nil {
+
+			continue
+
+		}
+
+		matches, err := matchesSelector(object, parsed.Selector)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		if matches {
+
+			keys = append(keys, key)
+
+		}
+
+	}
+
+	sort.Strings(keys)
+
+	iterator := &memoryIterator{}
+
+	for _, key := range keys {
+
+		iterator.entries = append(iterator.entries, &queryresult.KV{Key: key, Value: s.state[key]})
+
+	}
+
+	return iterator, nil
+
+}
+
+// Fields are matched by value or by an object of operators, missing fields match nothing
+func matchesSelector(object map[string]interface{}, selector map[string]interface{}) (bool, error) {
+
+	for field, condition := range selector {
+
+		if field == "$and" {
+
+			conditions, ok := condition.([]interface{})
+
+			if !ok {
+
+				return false, fmt.Errorf("$and needs an array, got %v", condition)
+
+			}
+
+			for _, sub := range conditions {
+
+				subSelector, ok := sub.(map[string]interface{})
+
+				if !ok {
+
+					return false, fmt.Errorf("$and needs selectors, got %v", sub)
+
+				}
+
+				if matches, err := matchesSelector(object, subSelector); err != nil || !matches {
+
+					return false, err
+
+				}
+
+			}
+
+			continue
+
+		}
+
+		operators, ok := condition.(map[string]interface{})
+
+		if !ok {
+
+			operators = map[string]interface{}{"$eq": condition}
+
+		}
+
+		value, found := object[field]
+
+		for operator, operand := range operators {
+
+			matches, err := matchesOperator(value, operator, operand)
+
+			if err != nil {
+
+				return false, fmt.Errorf("field %v: %v", field, err)
+
+			}
+
+			if !found || !matches {
+
+				return false, nil
+
+			}
+
+		}
+
+	}
+
+	return true, nil
+
+}
+
+func matchesOperator(value interface{}, operator string, operand interface{}) (bool, error) {
+
+	switch operator {
+
+	case "$eq":
+
+		return compareJSON(value, operand) == 0, nil
+
+	case "$in":
+
+		operands, ok := operand.([]interface{})
+
+		if !ok {
+
+			return false, fmt.Errorf("$in needs an array, got %v", operand)
+
+		}
+
+		for _, candidate := range operands {
+
+			if compareJSON(value, candidate) == 0 {
+
+				return true, nil
+
+			}
+
+		}
+
+		return false, nil
+
+	case "$regex":
+
+		pattern, ok := operand.(string)
+
+		if !ok {
+
+			return false, fmt.Errorf("$regex needs a string, got %v", operand)
+
+		}
+
+		expression, err := regexp.Compile(pattern)
+
+		if err != nil {
+
+			return false, err
+
+		}
+
+		text, isString := value.(string)
+
+		return isString && expression.MatchString(text), nil
+
+	case "$gt", "$gte", "$lt", "$lte":
+
+		order := compareJSON(value, operand)
+
+		if order == incomparable {
+
+			return false, nil
+
+		}
+
+		return map[string]bool{"$gt": order > 0, "$gte": order >= 0, "$lt": order < 0, "$lte": order <= 0}[operator], nil
+
+	}
+
+	return false, fmt.Errorf("operator %v is not supported by the memory stub", operator)
+
+}
+
+const incomparable = 2
+
+// Orders numbers and strings, values of other or different types only equal themselves
+func compareJSON(a interface{}, b interface{}) int {
+
+	switch x := a.(type) {
+
+	case float64:
+
+		if y, ok := b.(float64); ok {
+
+			switch {
+
+			case x < y:
+
+				return -1
+
+			case x > y:
+
+				return 1
+
+			}
+
+			return 0
+
+		}
+
+	case string:
+
+		if y, ok := b.(string); ok {
+
+			return strings.Compare(x, y)
+
+		}
+
+	}
+
+	if reflect.DeepEqual(a, b) {
+
+		return 0
+
+	}
+
+	return incomparable
+
+}
+
+// Same format as the shim, so keys look like the ones a peer stores
+func createCompositeKey(objectType string, attributes []string) (string, error) {
+
+	key := "\x00" + objectType + "\x00"
+
+	for _, attribute := range attributes {
+
+		if !utf8.ValidString(attribute) {
+
+			return "", fmt.Errorf("not a valid utf8 string: [%x]", attribute)
+
+		}
+
+		for _, r := range attribute {
+
+			if r == 0 || r == utf8.MaxRune {
+
+				return "", fmt.Errorf("attribute %q contains a forbidden rune", attribute)
+
+			}
+
+		}
+
+		key += attribute + "\x00"
+
+	}
+
+	return key, nil
+
+}
+
+//=======================================================================================================================
+//  Iterators
+//=======================================================================================================================
+
+type memoryIterator struct {
+
+	entries     []*queryresult.KV
+	position    int
+
+}
+
+func (i *memoryIterator) HasNext() bool {
+
+	return i.position < len(i.entries)
+
+}
+
+func (i *memoryIterator) Next() (*queryresult.KV, error) {
+
+	if !i.HasNext() {
+
+		return nil, fmt.Errorf("no more entries")
+
+	}
+
+	i.position++
+
+	return i.entries[i.position-1], nil
+
+}
+
+func (i *memoryIterator) Close() error {
+
+	return nil
+
+}
+
+// Writes of a key, oldest first like Fabric 1.x
+type memoryHistoryIterator struct {
+
+	entries     []*queryresult.KeyModification
+	position    int
+
+}
+
+func (i *memoryHistoryIterator) HasNext() bool {
+
+	return i.position < len(i.entries)
+
+}
+
+func (i *memoryHistoryIterator) Next() (*queryresult.KeyModification, error) {
+
+	if !i.HasNext() {
+
+		return nil, fmt.Errorf("no more entries")
+
+	}
+
+	i.position++
+
+	return i.entries[i.position-1], nil
+
+}
+
+func (i *memoryHistoryIterator) Close() error {
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Identities - Certificates issued by a test CA, serialized the way the peer hands them to the chaincode
+//=======================================================================================================================
+
+var testCA struct {
+
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+
+}
+
+func newIdentity(t *testing.T, mspID string, commonName string, attributes map[string]string) []byte {
+
+	t.Helper()
+
+	if testCA.cert == nil {
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		if err != nil {
+
+			t.Fatal(err)
+
+		}
+
+		template := &x509.Certificate{
+
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "ca.example.com"},
+			NotBefore:             testEpoch.Add(-time.Hour),
+			NotAfter:              testEpoch.Add(10 * 365 * 24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+		if err != nil {
+
+			t.Fatal(err)
+
+		}
+
+		testCA.key = key
+		testCA.cert, _ = x509.ParseCertificate(der)
+
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+
+	template := &x509.Certificate{
+
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    testEpoch.Add(-time.Hour),
+		NotAfter:     testEpoch.Add(10 * 365 * 24 * time.Hour),
+
+	}
+
+	if len(attributes) > 0 {
+
+		// Fabric CA attribute extension
+		value, _ := json.Marshal(map[string]map[string]string{"attrs": attributes})
+
+		template.ExtraExtensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: value}}
+
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, testCA.cert, &key.PublicKey, testCA.key)
+
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+
+	})
+
+	if err != nil {
+
+		t.Fatal(err)
+
+	}
+
+	return creator
+
+}
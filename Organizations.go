@@ -0,0 +1,357 @@
+package main
+
+import (
+
+	"bytes"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Organizations - Companies sharing the channel. A user belongs to at most one organization, set by addUser, and an
+// image to the organization of the user it was demanded for. Callers only see users and images of their own
+// organization; users and images without one form the default organization of earlier versions. Network admins,
+// certificates with plv.role=admin that map to no user, see every organization.
+//=======================================================================================================================
+
+const OrganizationsIndexName          =   "org~id"
+const UsersByOrganizationIndexName    =   "user~organization~username"
+const ImagesByOrganizationIndexName   =   "image~organization~id"
+
+type Organization struct {
+
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	MSPID           string      `json:"msp-id"`
+	BillingContact  string      `json:"billing-contact"`
+
+}
+
+//=======================================================================================================================
+//  Can access organization - Whether the caller may see the users and images of an organization
+//=======================================================================================================================
+
+func (c Caller) CanAccessOrganization(organization string) bool {
+
+	return organization == c.Organization || c.IsNetworkAdmin()
+
+}
+
+func (c Caller) IsNetworkAdmin() bool {
+
+	return c.networkAdmin
+
+}
+
+//=======================================================================================================================
+//  Organization scope - The filter of the images the caller may see, nil if they may see all
+//=======================================================================================================================
+
+func OrganizationScope(caller Caller) *ImageFilter {
+
+	if caller.IsNetworkAdmin() {
+
+		return nil
+
+	}
+
+	return &ImageFilter{conditions: []filterCondition{{field: "organization", operator: "$eq", values: []interface{}{caller.Organization}}}}
+
+}
+
+//=======================================================================================================================
+//  Get organization - NOT_FOUND if it does not exist
+//=======================================================================================================================
+
+func GetOrganization(stub shim.ChaincodeStubInterface, organizationID string) (Organization, error) {
+
+	organizationAsBytes, err := GetObject(stub, OrganizationsIndexName, organizationID)
+
+	if err != nil {
+
+		return Organization{}, WrapError(err, "Could not retrieve organization " + organizationID)
+
+	}
+
+	if organizationAsBytes == nil {
+
+		return Organization{}, NewError(CodeNotFound, "Organization " + organizationID + " does not exist")
+
+	}
+
+	var organization Organization
+
+	if err = json.Unmarshal(organizationAsBytes, &organization); err != nil {
+
+		return Organization{}, WrapError(err, "Error while unmarshalling organization " + organizationID)
+
+	}
+
+	return organization, nil
+
+}
+
+//=======================================================================================================================
+//  Add organization - args[0] = organization ID, args[1] = organization as JSON. ALREADY_EXISTS if the ID or the MSP
+//  ID is taken.
+//=======================================================================================================================
+
+func AddOrganization(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var organization Organization
+	var validation Validation
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[1])))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&organization); err != nil {
+
+		return nil, NewError(CodeInvalidArgument, "Organization is not valid JSON, reason: " + err.Error())
+
+	}
+
+	if organization.ID != "" && organization.ID != args[0] {
+
+		validation.Fail("id", "must match the organization ID argument")
+
+	}
+
+	for _, field := range []struct{ name, value string }{{"name", organization.Name}, {"msp-id", organization.MSPID},
+		{"billing-contact", organization.BillingContact}} {
+
+		if strings.TrimSpace(field.value) == "" {
+
+			validation.Fail(field.name, "is required")
+
+		}
+
+	}
+
+	if err := validation.Error("Invalid organization"); err != nil {
+
+		return nil, err
+
+	}
+
+	organization.ID = args[0]
+
+	// The MSP ID maps unregistered admins to the organization, so it must be unique
+	err := ForEachInIndex(stub, OrganizationsIndexName, func(id string, value []byte) error {
+
+		var existing Organization
+
+		if err := json.Unmarshal(value, &existing); err != nil {
+
+			return WrapError(err, "Error unmarshalling organization " + id)
+
+		}
+
+		if existing.MSPID == organization.MSPID {
+
+			return NewError(CodeAlreadyExists, "Organization " + id + " already has MSP ID " + organization.MSPID)
+
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	organizationAsBytes, err := json.Marshal(organization)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Error marshalling organization")
+
+	}
+
+	if err = Store(stub, organization.ID, OrganizationsIndexName, organizationAsBytes); err != nil {
+
+		return nil, err
+
+	}
+
+	return organizationAsBytes, nil
+
+}
+
+//=======================================================================================================================
+//  Check user organization - The organization a new user joins must exist, the caller must belong to it, and a bound
+//  certificate must be issued by its MSP
+//=======================================================================================================================
+
+func checkUserOrganization(stub shim.ChaincodeStubInterface, caller Caller, user User) error {
+
+	if user.Organization == "" {
+
+		if !caller.CanAccessOrganization("") {
+
+			return NewError(CodeForbidden, caller.Name() + " can only add users to organization " + caller.Organization)
+
+		}
+
+		return nil
+
+	}
+
+	organization, err := GetOrganization(stub, user.Organization)
+
+	if HasCode(err, CodeNotFound) {
+
+		return NewError(CodeInvalidArgument, "Organization " + user.Organization + " does not exist")
+
+	}
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if !caller.CanAccessOrganization(organization.ID) {
+
+		return NewError(CodeForbidden, caller.Name() + " cannot add users to organization " + organization.ID)
+
+	}
+
+	if user.MSPID != "" && user.MSPID != organization.MSPID {
+
+		return NewError(CodeInvalidArgument, "Users of organization " + organization.ID + " must have certificates of " + organization.MSPID)
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Index user organization - Add a new user to the users index of their organization
+//=======================================================================================================================
+
+func indexUserOrganization(stub shim.ChaincodeStubInterface, user User) error {
+
+	if user.Organization == "" {
+
+		return nil
+
+	}
+
+	key, err := stub.CreateCompositeKey(UsersByOrganizationIndexName, []string{user.Organization, user.Username})
+
+	if err != nil {
+
+		return NewError(CodeInvalidArgument, "Error creating key for user " + user.Username + " in index '" + UsersByOrganizationIndexName + "', reason: " + err.Error())
+
+	}
+
+	if err = stub.PutState(key, indexEntryValue); err != nil {
+
+		return WrapError(err, "Error adding user " + user.Username + " to organization " + user.Organization)
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Get organization by ID - args[0] = organization ID
+//=======================================================================================================================
+
+func GetOrganizationByID(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	organization, err := GetOrganization(stub, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return json.Marshal(organization)
+
+}
+
+//=======================================================================================================================
+//  Get images and users by organization - args[0] = organization ID, args[1..3] = page size, bookmark and sort as
+//  described in Pagination.go
+//=======================================================================================================================
+
+func GetImagesByOrganization(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if _, err := GetOrganization(stub, args[0]); err != nil {
+
+		return nil, err
+
+	}
+
+	return PageImagesInIndex(stub, args, 1, ImagesByOrganizationIndexName, args[0])
+
+}
+
+func GetUsersByOrganization(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if _, err := GetOrganization(stub, args[0]); err != nil {
+
+		return nil, err
+
+	}
+
+	request, err := ParsePageRequest(args, 1, SortByID)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if request.byKey() {
+
+		return pageOfUsersByKey(stub, request, UsersByOrganizationIndexName, []string{args[0]})
+
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(UsersByOrganizationIndexName, []string{args[0]})
+
+	if err != nil {
+
+		return nil, WrapError(err, "Failed to get " + UsersByOrganizationIndexName)
+
+	}
+
+	defer iterator.Close()
+
+	var entries []pageEntry
+
+	for iterator.HasNext() {
+
+		entry, err := iterator.Next()
+
+		if err != nil {
+
+			return nil, WrapError(err, "Error iterating index '" + UsersByOrganizationIndexName + "'")
+
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(entry.Key)
+
+		if err != nil || len(attributes) != 2 {
+
+			return nil, NewError(CodeInternal, "Malformed key in index '" + UsersByOrganizationIndexName + "'")
+
+		}
+
+		entries = append(entries, pageEntry{id: attributes[1], sortKey: attributes[1]})
+
+	}
+
+	return pageOfUsers(stub, request, entries)
+
+}
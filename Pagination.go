@@ -0,0 +1,578 @@
+package main
+
+import (
+
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"encoding/json"
+	"encoding/base64"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Pagination - List queries take an optional page size, bookmark and sort as their last arguments and return one
+// page. The bookmark is the sort key and ID of the last item returned, so pages stay consistent when items are added
+// between calls. A "-" before the sort field sorts descending; items with equal sort keys are ordered by ID.
+//
+// Unfiltered lists sorted by ascending ID are read a page at a time from an index with the paginated query of the
+// peer, see PageKeys. Their total count comes from a scan of the index keys, without loading the items; like every
+// paginated query they only run in read-only transactions. Other sorts and filters read every entry to sort and count
+// them, so they cost a scan of the whole list.
+//=======================================================================================================================
+
+const DefaultPageSize  =   50
+const MaxPageSize      =   500
+
+const SortByID             =   "id"
+const SortByPurchaseDate   =   "purchase-date"
+const SortByStatus         =   "status"
+
+type PageRequest struct {
+
+	Size        int
+	Bookmark    string
+	Sort        string      // as given, with the "-" of a descending sort
+	Field       string
+	Descending  bool
+
+}
+
+type Page struct {
+
+	Items       interface{}     `json:"items"`
+	Bookmark    string          `json:"bookmark"`
+	HasMore     bool            `json:"hasMore"`
+	TotalCount  int             `json:"totalCount"`
+
+}
+
+// An item to be paged, by ID and the value of the sort field
+type pageEntry struct {
+
+	id          string
+	sortKey     string
+
+}
+
+//=======================================================================================================================
+//  Parse page request - args[offset] = page size, args[offset+1] = bookmark, args[offset+2] = sort, all optional.
+//  The sort must be one of fields and defaults to the ID.
+//=======================================================================================================================
+
+func ParsePageRequest(args []string, offset int, fields ...string) (PageRequest, error) {
+
+	var validation Validation
+
+	request := PageRequest{Size: DefaultPageSize, Bookmark: optionalArg(args, offset + 1), Sort: optionalArg(args, offset + 2)}
+
+	if size := optionalArg(args, offset); size != "" {
+
+		var err error
+
+		if request.Size, err = strconv.Atoi(size); err != nil || request.Size < 1 || request.Size > MaxPageSize {
+
+			validation.Fail("page-size", "must be a number from 1 to " + strconv.Itoa(MaxPageSize))
+
+		}
+
+	}
+
+	if request.Sort == "" {
+
+		request.Sort = SortByID
+
+	}
+
+	request.Descending = strings.HasPrefix(request.Sort, "-")
+	request.Field = strings.TrimPrefix(request.Sort, "-")
+
+	if !contains(fields, request.Field) {
+
+		validation.Fail("sort", "must be one of " + strings.Join(fields, ", ") + ", optionally prefixed by - for descending order")
+
+	}
+
+	return request, validation.Error("Invalid page request")
+
+}
+
+// Whether the page can be read with PageKeys
+func (r PageRequest) byKey() bool {
+
+	return r.Field == SortByID && !r.Descending
+
+}
+
+//=======================================================================================================================
+//  Bookmarks - The sort, sort key and ID of the last item of a page, URL-safe base64 encoded
+//=======================================================================================================================
+
+func encodeBookmark(sortBy string, entry pageEntry) string {
+
+	return base64.RawURLEncoding.EncodeToString([]byte(sortBy + "\x00" + entry.sortKey + "\x00" + entry.id))
+
+}
+
+func decodeBookmark(request PageRequest) (pageEntry, error) {
+
+	decoded, err := base64.RawURLEncoding.DecodeString(request.Bookmark)
+	parts := strings.Split(string(decoded), "\x00")
+
+	if err != nil || len(parts) != 3 {
+
+		return pageEntry{}, NewError(CodeInvalidArgument, "Bookmark '" + request.Bookmark + "' is malformed")
+
+	}
+
+	if parts[0] != request.Sort {
+
+		return pageEntry{}, NewError(CodeInvalidArgument, "Bookmark was issued for sort " + parts[0] + ", not " + request.Sort)
+
+	}
+
+	return pageEntry{id: parts[2], sortKey: parts[1]}, nil
+
+}
+
+//=======================================================================================================================
+//  Paginate - Sort the entries and return the IDs of the requested page, with the bookmark of the next one
+//=======================================================================================================================
+
+func Paginate(request PageRequest, entries []pageEntry) ([]string, string, bool, error) {
+
+	before := func(a pageEntry, b pageEntry) bool {
+
+		if a.sortKey != b.sortKey {
+
+			return (a.sortKey < b.sortKey) != request.Descending
+
+		}
+
+		return a.id != b.id && (a.id < b.id) != request.Descending
+
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+
+		return before(entries[i], entries[j])
+
+	})
+
+	start := 0
+
+	if request.Bookmark != "" {
+
+		last, err := decodeBookmark(request)
+
+		if err != nil {
+
+			return nil, "", false, err
+
+		}
+
+		// The first entry after the last one returned, which may have been removed since
+		start = sort.Search(len(entries), func(i int) bool {
+
+			return before(last, entries[i])
+
+		})
+
+	}
+
+	end := start + request.Size
+
+	if end > len(entries) {
+
+		end = len(entries)
+
+	}
+
+	ids := []string{}
+
+	for _, entry := range entries[start:end] {
+
+		ids = append(ids, entry.id)
+
+	}
+
+	if end == len(entries) {
+
+		return ids, "", false, nil
+
+	}
+
+	return ids, encodeBookmark(request.Sort, entries[end - 1]), true, nil
+
+}
+
+//=======================================================================================================================
+//  Page keys - The IDs of the requested page of an ascending ID sort, read from the keys under prefix in an index,
+//  whose last attribute is the ID, and the page without items. Only the entries of the page are parsed, the others
+//  are just counted.
+//=======================================================================================================================
+
+func PageKeys(stub shim.ChaincodeStubInterface, request PageRequest, indexName string, prefix []string) ([]string, Page, error) {
+
+	total, err := countKeys(stub, indexName, prefix)
+
+	if err != nil {
+
+		return nil, Page{}, err
+
+	}
+
+	start := ""
+
+	if request.Bookmark != "" {
+
+		last, err := decodeBookmark(request)
+
+		if err != nil {
+
+			return nil, Page{}, err
+
+		}
+
+		key, err := stub.CreateCompositeKey(indexName, append(append([]string{}, prefix...), last.id))
+
+		if err != nil {
+
+			return nil, Page{}, NewError(CodeInvalidArgument, "Bookmark '" + request.Bookmark + "' is malformed")
+
+		}
+
+		// The smallest key after the last one returned, which may have been removed since
+		start = key + "\x00"
+
+	}
+
+	// One more than the page, to know whether there is a next one
+	iterator, _, err := stub.GetStateByPartialCompositeKeyWithPagination(indexName, prefix, int32(request.Size + 1), start)
+
+	if err != nil {
+
+		return nil, Page{}, WrapError(err, "Failed to get " + indexName)
+
+	}
+
+	defer iterator.Close()
+
+	ids := []string{}
+
+	for iterator.HasNext() {
+
+		entry, err := iterator.Next()
+
+		if err != nil {
+
+			return nil, Page{}, WrapError(err, "Error iterating index '" + indexName + "'")
+
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(entry.Key)
+
+		if err != nil || len(attributes) != len(prefix) + 1 {
+
+			return nil, Page{}, NewError(CodeInternal, "Malformed key in index '" + indexName + "'")
+
+		}
+
+		ids = append(ids, attributes[len(prefix)])
+
+	}
+
+	if len(ids) <= request.Size {
+
+		return ids, Page{TotalCount: total}, nil
+
+	}
+
+	ids = ids[:request.Size]
+	last := ids[len(ids) - 1]
+
+	return ids, Page{Bookmark: encodeBookmark(request.Sort, pageEntry{id: last, sortKey: last}), HasMore: true, TotalCount: total}, nil
+
+}
+
+// The number of entries under prefix in an index
+func countKeys(stub shim.ChaincodeStubInterface, indexName string, prefix []string) (int, error) {
+
+	iterator, err := stub.GetStateByPartialCompositeKey(indexName, prefix)
+
+	if err != nil {
+
+		return 0, WrapError(err, "Failed to get " + indexName)
+
+	}
+
+	defer iterator.Close()
+
+	count := 0
+
+	for iterator.HasNext() {
+
+		if _, err = iterator.Next(); err != nil {
+
+			return 0, WrapError(err, "Error iterating index '" + indexName + "'")
+
+		}
+
+		count++
+
+	}
+
+	return count, nil
+
+}
+
+//=======================================================================================================================
+//  Page images - args: the page request as parsed by ParsePageRequest from offset. Keeps only the sort keys of the
+//  images matching the filter (all if it is nil) in the caller's organization, and loads the images of the requested
+//  page. Without filter, pages by ID are read from the images or organization index; callers of the default
+//  organization, which has no index entries, read every image.
+//=======================================================================================================================
+
+func PageImages(stub shim.ChaincodeStubInterface, args []string, offset int, filter *ImageFilter) ([]byte, error) {
+
+	request, err := ParsePageRequest(args, offset, SortByID, SortByPurchaseDate, SortByStatus)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	scope := OrganizationScope(caller)
+
+	if filter == nil && request.byKey() && (scope == nil || caller.Organization != "") {
+
+		indexName, prefix := ImagesIndexName, []string{}
+
+		if scope != nil {
+
+			indexName, prefix = ImagesByOrganizationIndexName, []string{caller.Organization}
+
+		}
+
+		ids, page, err := PageKeys(stub, request, indexName, prefix)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		return loadImagesPage(stub, page, ids)
+
+	}
+
+	var entries []pageEntry
+
+	err = ForEachImage(stub, filter.And(scope), func(image Image) error {
+
+		entries = append(entries, pageEntry{id: image.ID, sortKey: imageSortKey(image, request.Field)})
+		return nil
+
+	})
+
+	if err != nil {
+
+		return nil, WrapError(err, "Unable to retrieve images")
+
+	}
+
+	return pageOfImages(stub, request, entries)
+
+}
+
+// Loads the images of the requested page
+func pageOfImages(stub shim.ChaincodeStubInterface, request PageRequest, entries []pageEntry) ([]byte, error) {
+
+	ids, bookmark, hasMore, err := Paginate(request, entries)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return loadImagesPage(stub, Page{Bookmark: bookmark, HasMore: hasMore, TotalCount: len(entries)}, ids)
+
+}
+
+func loadImagesPage(stub shim.ChaincodeStubInterface, page Page, ids []string) ([]byte, error) {
+
+	images := []Image{}
+
+	for _, id := range ids {
+
+		image, err := LoadImage(stub, id)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		images = append(images, image)
+
+	}
+
+	page.Items = images
+
+	return json.Marshal(page)
+
+}
+
+// Images without a purchase date sort first
+func imageSortKey(image Image, field string) string {
+
+	switch field {
+
+	case SortByPurchaseDate:
+
+		return normalizedPurchaseDate(image)
+
+	case SortByStatus:
+
+		return fmt.Sprintf("%03d", image.Status)
+
+	}
+
+	return image.ID
+
+}
+
+//=======================================================================================================================
+//  Page users - args: the page request as parsed by ParsePageRequest from offset. Lists the users of the caller's
+//  organization, sorted by username only. Like images, ascending pages are read from the users or organization
+//  index, except for callers of the default organization.
+//=======================================================================================================================
+
+func PageUsers(stub shim.ChaincodeStubInterface, args []string, offset int) ([]byte, error) {
+
+	request, err := ParsePageRequest(args, offset, SortByID)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if request.byKey() && (caller.IsNetworkAdmin() || caller.Organization != "") {
+
+		indexName, prefix := UsersIndexName, []string{}
+
+		if !caller.IsNetworkAdmin() {
+
+			indexName, prefix = UsersByOrganizationIndexName, []string{caller.Organization}
+
+		}
+
+		return pageOfUsersByKey(stub, request, indexName, prefix)
+
+	}
+
+	var entries []pageEntry
+
+	err = ForEachInIndex(stub, UsersIndexName, func(userID string, userAsBytes []byte) error {
+
+		var user User
+
+		if err := json.Unmarshal(userAsBytes, &user); err != nil {
+
+			return WrapError(err, "Error while unmarshalling user " + userID)
+
+		}
+
+		if caller.CanAccessOrganization(user.Organization) {
+
+			entries = append(entries, pageEntry{id: userID, sortKey: userID})
+
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+
+		return nil, WrapError(err, "Could not retrieve users")
+
+	}
+
+	return pageOfUsers(stub, request, entries)
+
+}
+
+// Loads the users of the requested page
+func pageOfUsers(stub shim.ChaincodeStubInterface, request PageRequest, entries []pageEntry) ([]byte, error) {
+
+	ids, bookmark, hasMore, err := Paginate(request, entries)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return loadUsersPage(stub, Page{Bookmark: bookmark, HasMore: hasMore, TotalCount: len(entries)}, ids)
+
+}
+
+func pageOfUsersByKey(stub shim.ChaincodeStubInterface, request PageRequest, indexName string, prefix []string) ([]byte, error) {
+
+	ids, page, err := PageKeys(stub, request, indexName, prefix)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return loadUsersPage(stub, page, ids)
+
+}
+
+func loadUsersPage(stub shim.ChaincodeStubInterface, page Page, ids []string) ([]byte, error) {
+
+	users := []User{}
+
+	for _, id := range ids {
+
+		user, err := GetUser(stub, id)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		users = append(users, user.Public())
+
+	}
+
+	page.Items = users
+
+	return json.Marshal(page)
+
+}
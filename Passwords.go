@@ -0,0 +1,172 @@
+package main
+
+import (
+
+	"strconv"
+	"strings"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Password hashes - Stored as "$<scheme>$<version>$<iterations>$<salt>$<key>" so the parameters can be raised later
+// without breaking existing users. Salt and key are unpadded base64.
+//=======================================================================================================================
+
+const PasswordHashScheme      =   "pbkdf2-sha256"
+const PasswordHashVersion     =   "v1"
+const PasswordHashIterations  =   50000
+const PasswordSaltLength      =   16
+const PasswordKeyLength       =   32
+const PasswordTransientKey    =   "password"
+
+// Compared against when the user does not exist, so that unknown users take as long as wrong passwords
+var dummyPasswordHash = "$" + PasswordHashScheme + "$" + PasswordHashVersion + "$" + strconv.Itoa(PasswordHashIterations) + "$AAAAAAAAAAAAAAAAAAAAAA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+//=======================================================================================================================
+//  Transient password - Passwords are passed in the transient data of the proposal, so they do not end up in the
+//  transaction. Empty if none was given.
+//=======================================================================================================================
+
+func TransientPassword(stub shim.ChaincodeStubInterface) (string, error) {
+
+	transient, err := stub.GetTransient()
+
+	if err != nil {
+
+		return "", WrapError(err, "Could not read the transient data")
+
+	}
+
+	return string(transient[PasswordTransientKey]), nil
+
+}
+
+//=======================================================================================================================
+//  Hash password - Salted PBKDF2 hash in the current format
+//=======================================================================================================================
+
+func HashPassword(stub shim.ChaincodeStubInterface, username string, password string) (string, error) {
+
+	if password == "" {
+
+		return "", NewError(CodeInvalidArgument, "Password must not be empty")
+
+	}
+
+	// Every endorsing peer has to compute the same hash, so the salt is derived from the transaction ID, which is
+	// unique per transaction, instead of a random source
+	saltSource := sha256.Sum256([]byte(stub.GetTxID() + "\x00" + username))
+	salt := saltSource[:PasswordSaltLength]
+
+	key := pbkdf2SHA256([]byte(password), salt, PasswordHashIterations, PasswordKeyLength)
+
+	return strings.Join([]string{
+
+		"",
+		PasswordHashScheme,
+		PasswordHashVersion,
+		strconv.Itoa(PasswordHashIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+
+	}, "$"), nil
+
+}
+
+//=======================================================================================================================
+//  Verify password - Constant time check of a password against a stored hash. needsRehash is set when the hash was
+//  made with other parameters than the current ones.
+//=======================================================================================================================
+
+func VerifyPassword(encodedHash string, password string) (matches bool, needsRehash bool, err error) {
+
+	parts := strings.Split(encodedHash, "$")
+
+	if len(parts) != 6 || parts[0] != "" || parts[1] != PasswordHashScheme || parts[2] != PasswordHashVersion {
+
+		return false, false, NewError(CodeInternal, "Unsupported password hash format")
+
+	}
+
+	iterations, err := strconv.Atoi(parts[3])
+
+	if err != nil || iterations <= 0 {
+
+		return false, false, NewError(CodeInternal, "Invalid iteration count in password hash")
+
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+
+		return false, false, NewError(CodeInternal, "Invalid salt in password hash")
+
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil || len(expected) == 0 {
+
+		return false, false, NewError(CodeInternal, "Invalid key in password hash")
+
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, iterations, len(expected))
+
+	matches = subtle.ConstantTimeCompare(key, expected) == 1
+
+	return matches, iterations != PasswordHashIterations || len(salt) != PasswordSaltLength || len(expected) != PasswordKeyLength, nil
+
+}
+
+//=======================================================================================================================
+//  PBKDF2 with HMAC-SHA256 (RFC 8018)
+//=======================================================================================================================
+
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLength int) []byte {
+
+	prf := hmac.New(sha256.New, password)
+	blocks := (keyLength + prf.Size() - 1) / prf.Size()
+
+	var key []byte
+	block := make([]byte, 4)
+
+	for i := 1; i <= blocks; i++ {
+
+		block[0], block[1], block[2], block[3] = byte(i>>24), byte(i>>16), byte(i>>8), byte(i)
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(block)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+
+		for n := 1; n < iterations; n++ {
+
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for x := range t {
+
+				t[x] ^= u[x]
+
+			}
+
+		}
+
+		key = append(key, t...)
+
+	}
+
+	return key[:keyLength]
+
+}
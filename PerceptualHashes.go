@@ -0,0 +1,386 @@
+package main
+
+import (
+
+	"sort"
+	"strconv"
+	"strings"
+	"math/bits"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Perceptual hashes - 64-bit hashes of the picture content (pHash, dHash) that survive resizing and recompression.
+// Similar pictures have hashes with a small Hamming distance; hashes of different algorithms are not comparable.
+//=======================================================================================================================
+
+const PerceptualPHash   =   "phash"
+const PerceptualDHash   =   "dhash"
+
+var perceptualAlgorithms = map[string]bool{PerceptualPHash: true, PerceptualDHash: true}
+
+type PerceptualHash struct {
+
+	Algorithm   string      `json:"algorithm"`
+	Hash        string      `json:"hash"`           // 16 hex digits
+
+}
+
+// Largest distance a lookup can ask for, every pair of 64-bit hashes is within 64
+const MaxPerceptualDistance = 64
+
+//=======================================================================================================================
+// Perceptual index - The 8 bytes of a hash are indexed separately under (algorithm, position, byte, image ID). Two
+// hashes within distance 7 differ in at most 7 bytes, so they share at least one byte at the same position and a
+// lookup only needs to read 8 buckets. Larger distances fall back to a scan of all images.
+//=======================================================================================================================
+
+const PerceptualIndexName  =   "phash~algorithm~position~byte~id"
+
+const perceptualBuckets = 8
+
+//=======================================================================================================================
+//  Is perceptual hash - Whether a hash argument is a perceptual hash, which always carries its algorithm prefix
+//=======================================================================================================================
+
+func IsPerceptualHash(value string) bool {
+
+	separator := strings.Index(value, ":")
+
+	return separator >= 0 && perceptualAlgorithms[strings.ToLower(strings.TrimSpace(value[:separator]))]
+
+}
+
+//=======================================================================================================================
+//  Parse perceptual hash - "<algorithm>:<16 hex digits>"
+//=======================================================================================================================
+
+func ParsePerceptualHash(value string) (PerceptualHash, error) {
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	separator := strings.Index(value, ":")
+
+	if separator < 0 || !perceptualAlgorithms[value[:separator]] {
+
+		return PerceptualHash{}, NewError(CodeInvalidArgument, "'" + value + "' is not a phash or dhash perceptual hash")
+
+	}
+
+	hash := PerceptualHash{Algorithm: value[:separator], Hash: value[separator + 1:]}
+
+	if _, err := strconv.ParseUint(hash.Hash, 16, 64); err != nil || len(hash.Hash) != 16 {
+
+		return PerceptualHash{}, NewError(CodeInvalidArgument, "'" + value + "' is not a 64-bit hash of 16 hex digits")
+
+	}
+
+	return hash, nil
+
+}
+
+//=======================================================================================================================
+//  Distance - Hamming distance of two hashes of the same algorithm
+//=======================================================================================================================
+
+func (h PerceptualHash) Distance(other PerceptualHash) int {
+
+	a, _ := strconv.ParseUint(h.Hash, 16, 64)
+	b, _ := strconv.ParseUint(other.Hash, 16, 64)
+
+	return bits.OnesCount64(a ^ b)
+
+}
+
+// Bucket i is the i-th byte of the hash, as 2 hex digits
+func (h PerceptualHash) bucket(position int) string {
+
+	return h.Hash[2 * position:2 * position + 2]
+
+}
+
+//=======================================================================================================================
+//  Perceptual keys - The bucket keys of an image's perceptual hash, none once the image is archived
+//=======================================================================================================================
+
+func perceptualKeys(stub shim.ChaincodeStubInterface, image Image) (map[string]bool, error) {
+
+	keys := map[string]bool{}
+
+	if image.PerceptualHash == nil || image.Status == StatusArchived {
+
+		return keys, nil
+
+	}
+
+	for position := 0; position < perceptualBuckets; position++ {
+
+		key, err := stub.CreateCompositeKey(PerceptualIndexName, []string{image.PerceptualHash.Algorithm, strconv.Itoa(position),
+			image.PerceptualHash.bucket(position), image.ID})
+
+		if err != nil {
+
+			return nil, WrapError(err, "Error creating perceptual hash key")
+
+		}
+
+		keys[key] = true
+
+	}
+
+	return keys, nil
+
+}
+
+//=======================================================================================================================
+//  Index perceptual hash - Replace the buckets of the previous version of an image (nil for a new image) by those of
+//  the image, like IndexImage does for the secondary indexes
+//=======================================================================================================================
+
+func IndexPerceptualHash(stub shim.ChaincodeStubInterface, previous *Image, image Image) error {
+
+	keys, err := perceptualKeys(stub, image)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if previous != nil {
+
+		previousKeys, err := perceptualKeys(stub, *previous)
+
+		if err != nil {
+
+			return err
+
+		}
+
+		for key := range previousKeys {
+
+			if keys[key] {
+
+				delete(keys, key)
+				continue
+
+			}
+
+			if err = stub.DelState(key); err != nil {
+
+				return WrapError(err, "Error removing perceptual hash of image " + image.ID)
+
+			}
+
+		}
+
+	}
+
+	for key := range keys {
+
+		if err = stub.PutState(key, []byte(image.PerceptualHash.Hash)); err != nil {
+
+			return WrapError(err, "Error indexing perceptual hash of image " + image.ID)
+
+		}
+
+	}
+
+	return nil
+
+}
+
+//=======================================================================================================================
+//  Perceptual candidates - IDs of the images whose hash may be within distance of the given hash
+//=======================================================================================================================
+
+func perceptualCandidates(stub shim.ChaincodeStubInterface, hash PerceptualHash, distance int) ([]string, error) {
+
+	var candidates []string
+	seen := map[string]bool{}
+
+	if distance >= perceptualBuckets {
+
+		err := ForEachInIndex(stub, ImagesIndexName, func(imageID string, imageAsBytes []byte) error {
+
+			candidates = append(candidates, imageID)
+			return nil
+
+		})
+
+		return candidates, err
+
+	}
+
+	for position := 0; position < perceptualBuckets; position++ {
+
+		iterator, err := stub.GetStateByPartialCompositeKey(PerceptualIndexName, []string{hash.Algorithm, strconv.Itoa(position),
+			hash.bucket(position)})
+
+		if err != nil {
+
+			return nil, WrapError(err, "Failed to get " + PerceptualIndexName)
+
+		}
+
+		for iterator.HasNext() {
+
+			entry, err := iterator.Next()
+
+			if err != nil {
+
+				iterator.Close()
+				return nil, WrapError(err, "Error iterating index '" + PerceptualIndexName + "'")
+
+			}
+
+			_, attributes, err := stub.SplitCompositeKey(entry.Key)
+
+			if err != nil || len(attributes) != 4 {
+
+				iterator.Close()
+				return nil, NewError(CodeInternal, "Malformed key in index '" + PerceptualIndexName + "'")
+
+			}
+
+			if imageID := attributes[3]; !seen[imageID] {
+
+				seen[imageID] = true
+				candidates = append(candidates, imageID)
+
+			}
+
+		}
+
+		iterator.Close()
+
+	}
+
+	return candidates, nil
+
+}
+
+//=======================================================================================================================
+// Similar image - A licensed image whose perceptual hash is within distance of the one looked up
+//=======================================================================================================================
+
+type SimilarImage struct {
+
+	ImageID         string      `json:"image-id"`
+	Name            string      `json:"name"`
+	LicensedTo      string      `json:"licensed-to"`
+	Author          string      `json:"author"`
+	Source          string      `json:"source"`
+	PurchaseDate    string      `json:"purchase-date"`
+	PerceptualHash  string      `json:"perceptual-hash"`
+	Distance        int         `json:"distance"`
+
+}
+
+//=======================================================================================================================
+//  Find similar images - args[0] = perceptual hash, args[1] = maximum Hamming distance (optional, defaults to the
+//  similar-image-distance of the config). Returns the licensed images of the caller's organization within the
+//  distance, closest first.
+//=======================================================================================================================
+
+func FindSimilarImages(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	hash, err := ParsePerceptualHash(args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	config, err := GetConfig(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	distance := config.SimilarImageDistance
+
+	if value := optionalArg(args, 1); value != "" {
+
+		distance, err = strconv.Atoi(value)
+
+		if err != nil || distance < 0 || distance > MaxPerceptualDistance {
+
+			return nil, NewError(CodeInvalidArgument, "Distance must be a number from 0 to " + strconv.Itoa(MaxPerceptualDistance))
+
+		}
+
+	}
+
+	candidates, err := perceptualCandidates(stub, hash, distance)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	similar := []SimilarImage{}
+
+	for _, imageID := range candidates {
+
+		image, err := LoadImage(stub, imageID)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		if image.Status != StatusDelivered || !caller.CanAccessOrganization(image.Organization) || image.PerceptualHash == nil || image.PerceptualHash.Algorithm != hash.Algorithm {
+
+			continue
+
+		}
+
+		if d := hash.Distance(*image.PerceptualHash); d <= distance {
+
+			similar = append(similar, SimilarImage{
+
+				ImageID:        image.ID,
+				Name:           image.Name,
+				LicensedTo:     image.User,
+				Author:         image.Author,
+				Source:         image.URL,
+				PurchaseDate:   image.PurchaseDate,
+				PerceptualHash: image.PerceptualHash.Hash,
+				Distance:       d,
+
+			})
+
+		}
+
+	}
+
+	sort.SliceStable(similar, func(i, j int) bool {
+
+		if similar[i].Distance != similar[j].Distance {
+
+			return similar[i].Distance < similar[j].Distance
+
+		}
+
+		return similar[i].ImageID < similar[j].ImageID
+
+	})
+
+	return json.Marshal(map[string][]SimilarImage{"images": similar})
+
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 
-	"errors"
 	"fmt"
+	"strconv"
+	"crypto/subtle"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
 	"encoding/json"
 	
 )
@@ -12,15 +14,30 @@ import (
 var logger = shim.NewLogger("PLVChaincode")
 
 //=======================================================================================================================
-// Index name
+// Index name - users and images are stored under composite keys (index name, ID), so every object has its own key
+// and listing is a partial composite key scan instead of one shared JSON array.
 //=======================================================================================================================
 
-const UsersIndexName   =   "users"
-const ImagesIndexName  =   "images"
+const UsersIndexName   =   "user~username"
+const ImagesIndexName  =   "image~id"
 
-var indexNames = []string{
-	UsersIndexName,
-	ImagesIndexName,
+//=======================================================================================================================
+// Legacy index names - JSON arrays of IDs used by earlier versions, only read by the migration
+//=======================================================================================================================
+
+const LegacyUsersIndexName   =   "users"
+const LegacyImagesIndexName  =   "images"
+
+type legacyIndex struct {
+
+	Name        string
+	IndexName   string
+	
+}
+
+var legacyIndexes = []legacyIndex{
+	{LegacyUsersIndexName, UsersIndexName},
+	{LegacyImagesIndexName, ImagesIndexName},
 }
 
 
@@ -45,9 +62,20 @@ type Image struct {
 	URL				string      `json:"url"`
 	User        	string      `json:"user"`
 	MD5Hash      	string      `json:"md5-hash"`
+	Hashes          map[string]string `json:"hashes,omitempty"`
+	PerceptualHash  *PerceptualHash `json:"perceptual-hash,omitempty"`
+	License         *License    `json:"license,omitempty"`
 	Remarks     	string      `json:"remarks"`
 	PurchaseDate	string      `json:"purchase-date"`
-	Status          int         `json:"status"`
+	Status          ImageStatus `json:"status"`
+	StatusChanges   []StatusChange `json:"status-changes,omitempty"`
+	PurchaseRecord  *PurchaseRecordLink `json:"purchase-record,omitempty"`
+	OwnershipChain  []OwnershipTransfer `json:"ownership-chain,omitempty"`
+	Revocation      *Revocation `json:"revocation,omitempty"`
+	Organization    string      `json:"organization,omitempty"`    // of the user the image was demanded for
+	BudgetReservation *BudgetReservation `json:"budget-reservation,omitempty"`
+	Provider        string      `json:"provider,omitempty"`        // registered provider, see Providers.go
+	ProviderAssetID string      `json:"provider-asset-id,omitempty"`
 	
 } 
 
@@ -55,32 +83,45 @@ type Image struct {
 // User - participant type could be Empoloyee or Marketing		   
 //=======================================================================================================================
 
+const ParticipantEmployee   =   "employee"
+const ParticipantMarketing  =   "marketing"
+const ParticipantAdmin      =   "admin"
+
 type User struct {
 
 	Username        string      `json:"username"`
-	Password 		string 		`json:"password"`
+	Password 		string 		`json:"password,omitempty"`         // plaintext of legacy users, never stored by this version
+	PasswordHash    string      `json:"password-hash,omitempty"`
 	PType           string      `json:"participant-type"`
+	MSPID           string      `json:"msp-id,omitempty"`
+	Identity        string      `json:"identity,omitempty"`        // certificate ID as returned by WhoAmI
+	Department      string      `json:"department,omitempty"`
+	Organization    string      `json:"organization,omitempty"`
 
 }
 
 //=======================================================================================================================
-// Authentication result 		   
+// Public - Copy of the user without any password material, for responses
 //=======================================================================================================================
 
-type UserAuthenticationResult struct {
+func (u User) Public() User {
 
-	User        	User
-	Authenticated 	bool
+	u.Password = ""
+	u.PasswordHash = ""
+	
+	return u
 	
 }
 
 //=======================================================================================================================
-// Users 		   
+// Authentication result 		   
 //=======================================================================================================================
 
-type Users struct {
+type UserAuthenticationResult struct {
 
-	Users 	[]User	 `json:"users"`
+	User        			User
+	Authenticated 			bool
+	PasswordUpgradeNeeded 	bool 	`json:",omitempty"`     // submit UpgradePasswordHash to store the password in the current format
 	
 }
 
@@ -94,53 +135,39 @@ type Images struct {
 	Images 	[]Image	 `json:"images"`
 	
 }
-
 //=======================================================================================================================
 //  Query Functions
 //=======================================================================================================================
-//  Get index - Get index of images or users
+//  Create key - Build the composite key of an object in the given index
 //=======================================================================================================================
 
-func GetIndex(stub shim.ChaincodeStubInterface, indexName string) ([]string, error) {
+func CreateKey(stub shim.ChaincodeStubInterface, indexName string, id string) (string, error) {
 
-	indexAsBytes, err := stub.GetState(indexName)
+	if id == "" {
 	
-	if err != nil {
-	
-		return nil, errors.New("Failed to get " + indexName)
+		return "", NewError(CodeInvalidArgument, "Missing ID for index '" + indexName + "'")
 		
 	}
 
-	var index []string
-	
-	err = json.Unmarshal(indexAsBytes, &index)
+	key, err := stub.CreateCompositeKey(indexName, []string{id})
 	
 	if err != nil {
 	
-		return nil, errors.New("Error unmarshalling index '" + indexName + "': " + err.Error())
+		return "", NewError(CodeInvalidArgument, "Error creating key for '" + id + "' in index '" + indexName + "', reason: " + err.Error())
 		
 	}
 
-	return index, nil
+	return key, nil
 	
 }
 
-
 //=======================================================================================================================
-//  Add ID to the index
+//  Get object - Get the stored bytes of an object, nil if it does not exist
 //=======================================================================================================================
 
-func AddIDToIndex(stub shim.ChaincodeStubInterface, indexName string, id string) ([]byte, error) {
-
-	result, err := DoesIDExist(stub, id, indexName)
-	
-	if result == true {
-		
-		return nil, errors.New("ID already exists")
-	
-	}
+func GetObject(stub shim.ChaincodeStubInterface, indexName string, id string) ([]byte, error) {
 
-	index, err := GetIndex(stub, indexName)
+	key, err := CreateKey(stub, indexName, id)
 	
 	if err != nil {
 	
@@ -148,445 +175,972 @@ func AddIDToIndex(stub shim.ChaincodeStubInterface, indexName string, id string)
 		
 	}
 
-	index = append(index, id)
-
-	jsonAsBytes, err := json.Marshal(index)
-	
-	if err != nil {
-	
-		return nil, errors.New("Error marshalling index '" + indexName + "': " + err.Error())
-		
-	}
-
-	err = stub.PutState(indexName, jsonAsBytes)
+	objectAsBytes, err := stub.GetState(key)
 	
 	if err != nil {
 	
-		return nil, errors.New("Error storing new " + indexName + " into ledger")
+		return nil, WrapError(err, "Failed to get '" + id + "' from " + indexName)
 		
 	}
 
-	return []byte(id), nil
+	return objectAsBytes, nil
 	
 }
 
 //=======================================================================================================================
-//  Store the object in the ledger 
+//  For each in index - Call handle for every object of the index, in key order
 //=======================================================================================================================
 
-func Store(stub shim.ChaincodeStubInterface, objectID string, indexName string, object []byte) error {
+func ForEachInIndex(stub shim.ChaincodeStubInterface, indexName string, handle func(id string, value []byte) error) error {
 
-	ID, err := AddIDToIndex(stub, indexName, objectID)
+	iterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{})
 	
 	if err != nil {
 	
-		return errors.New("Writing ID to index: " + indexName + "Reason: " + err.Error())
+		return WrapError(err, "Failed to get " + indexName)
 		
 	}
-
-	fmt.Println("adding: ", string(object))
-
-	err = stub.PutState(string(ID), object)
 	
-	if err != nil {
+	defer iterator.Close()
+
+	for iterator.HasNext() {
 	
-		return errors.New("Putstate error: " + err.Error())
+		entry, err := iterator.Next()
+		
+		if err != nil {
+		
+			return WrapError(err, "Error iterating index '" + indexName + "'")
+			
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(entry.Key)
+		
+		if err != nil || len(attributes) != 1 {
+		
+			return NewError(CodeInternal, "Malformed key in index '" + indexName + "'")
+			
+		}
+
+		if err = handle(attributes[0], entry.Value); err != nil {
+		
+			return err
+			
+		}
 		
 	}
 
 	return nil
+	
 }
 
 //=======================================================================================================================
-//  Add user
+//  Get index - Get the IDs of images or users
 //=======================================================================================================================
 
-func addUser(stub shim.ChaincodeStubInterface, index string, userJSONObject string) error {
+func GetIndex(stub shim.ChaincodeStubInterface, indexName string) ([]string, error) {
 
-	id, err := AddIDToIndex(stub, UsersIndexName, index)
-	
-	if err != nil {
+	index := []string{}
+
+	err := ForEachInIndex(stub, indexName, func(id string, value []byte) error {
 	
-		return errors.New("Error creating new id for user " + index)
+		index = append(index, id)
+		return nil
 		
-	}
-
-	err = stub.PutState(string(id), []byte(userJSONObject))
+	})
 	
 	if err != nil {
 	
-		return errors.New("Error putting user data on ledger")
+		return nil, err
 		
 	}
 
-	return nil
+	return index, nil
+	
 }
 
 //=======================================================================================================================
-//  Demand Image function 
+//  Store the object in the ledger 
 //=======================================================================================================================
 
-func DemandImage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
+func Store(stub shim.ChaincodeStubInterface, objectID string, indexName string, object []byte) error {
 
-	if len(args) != 1 {
-	
-        logger.Debug("Invalid number of args")
-        return nil, errors.New("Expected at least one argument for demanding new image")
-		
-    }
-	
-	imageAsJSON := args[0]
-	
-	var image Image
+	exists, err := DoesIDExist(stub, objectID, indexName)
 	
-	if err := json.Unmarshal([]byte(imageAsJSON), &image); err != nil {
+	if err != nil {
 	
-		return nil, errors.New("Error while unmarshalling image, reason: " + err.Error())
+		return WrapError(err, "Checking ID in index: " + indexName)
 		
 	}
 	
-	imageAsBytes, err := json.Marshal(image)
+	if exists {
 	
-	if err != nil {
+		return NewError(CodeAlreadyExists, "ID " + objectID + " already exists in " + indexName)
 	
-		return nil, errors.New("Error marshalling image, reason: " + err.Error())
-		
 	}
-	
-	Store(stub, image.ID, ImagesIndexName, imageAsBytes)
-	
-	return nil, nil
 
+	fmt.Println("adding: ", string(object))
+
+	return Update(stub, objectID, indexName, object)
+	
 }
 
 //=======================================================================================================================
-//  Deliver Image function 
+//  Update the object in the ledger 
 //=======================================================================================================================
 
-func DeliverImage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error){
+func Update(stub shim.ChaincodeStubInterface, objectID string, indexName string, object []byte) error {
 
-    if len(args) < 4 {
-	
-        logger.Debug("Invalid number of args")
-        return nil, errors.New("Expected at least four arguments for delivering new image")
-		
-    }
- 
-    var imageId   		=  args[0]
-	var Name            =  args[1]
-    var MD5Hash   		=  args[2]
-	var PurchaseDate    =  args[3]
-	
-	imageBytes, err := stub.GetState(imageId)
-	
-	if err != nil {
-	
-		logger.Error("Could not fetch the image from ledger", err)
-		return nil, err
-		
-	}
-	
-	var image Image 
-	err = json.Unmarshal(imageBytes, &image)
-	image.MD5Hash = MD5Hash
-	image.PurchaseDate = PurchaseDate
-	image.Name = Name
-	image.Status = 2
-	
-	imageBytes, err = json.Marshal(&image)
+	key, err := CreateKey(stub, indexName, objectID)
 	
 	if err != nil {
 	
-		logger.Error("Could not marshal image post update", err)
-		return nil, err
+		return err
 		
 	}
-	
-	err = stub.PutState(imageId, imageBytes)
+
+	err = stub.PutState(key, object)
 	
 	if err != nil {
 	
-		logger.Error("Could not save image post update", err)
-		return nil, err
+		return WrapError(err, "Putstate error")
 		
 	}
- 
-    fmt.Println("The image is successfully delivered")
-	
-    return nil, nil
 
+	return nil
+	
 }
 
 //=======================================================================================================================
-//  Query Functions
-//=======================================================================================================================
-//  Get User
+//  Load image - Get an image, NOT_FOUND if it does not exist
 //=======================================================================================================================
 
-func GetUser(stub shim.ChaincodeStubInterface, username string) (User, error) {
+func LoadImage(stub shim.ChaincodeStubInterface, imageID string) (Image, error) {
 
-	userAsBytes, err := stub.GetState(username)
+	imageAsBytes, err := GetObject(stub, ImagesIndexName, imageID)
 	
 	if err != nil {
 	
-		return User{}, errors.New("Could not retrieve information for this user")
+		return Image{}, err
+		
+	}
+	
+	if imageAsBytes == nil {
+	
+		return Image{}, NewError(CodeNotFound, "Image " + imageID + " does not exist")
 		
 	}
 
-	var user User
+	var image Image
 	
-	if err = json.Unmarshal(userAsBytes, &user); err != nil {
+	if err = json.Unmarshal(imageAsBytes, &image); err != nil {
 	
-		return User{}, errors.New("Cannot get user, reason: " + err.Error())
+		return Image{}, WrapError(err, "Error while unmarshalling image")
 		
 	}
 
-	return user, nil
+	return image, nil
+	
 }
 
 //=======================================================================================================================
-//   Authenticate User
+//  Save image - Update an existing image, its secondary index entries and perceptual hash buckets. The entries
+//  replaced are those of the committed version, an image is saved once per transaction.
 //=======================================================================================================================
 
-func AuthenticateAsUser(stub shim.ChaincodeStubInterface, user User, password string) (UserAuthenticationResult) {
+func SaveImage(stub shim.ChaincodeStubInterface, image Image) error {
 
-	if user == (User{}) {
+	previousAsBytes, err := GetObject(stub, ImagesIndexName, image.ID)
 	
-		fmt.Println("User not found")
+	if err != nil {
+	
+		return err
 		
-		return UserAuthenticationResult{
+	}
+
+	var previous *Image
+	
+	if previousAsBytes != nil {
+	
+		previous = &Image{}
 		
-			User: user,
-			Authenticated: false,
+		if err = json.Unmarshal(previousAsBytes, previous); err != nil {
+		
+			return WrapError(err, "Error while unmarshalling image")
 			
 		}
 		
 	}
 
-	if user.Password != password {
+	imageAsBytes, err := json.Marshal(image)
 	
-		fmt.Println("Password does not match")
+	if err != nil {
+	
+		return WrapError(err, "Error marshalling image")
 		
-		return UserAuthenticationResult{
+	}
+
+	if err = Update(stub, image.ID, ImagesIndexName, imageAsBytes); err != nil {
+	
+		return err
 		
-			User: user,
-			Authenticated: false,
+	}
+
+	if previous != nil && holdsHashes(*previous) && !holdsHashes(image) {
+	
+		if err = ReleaseImageHashes(stub, image); err != nil {
+		
+			return err
 			
 		}
 		
 	}
 
-	return UserAuthenticationResult{
+	if err = IndexPerceptualHash(stub, previous, image); err != nil {
 	
-		User: user,
-		
-		Authenticated: true,
+		return err
 		
 	}
-	
-}
-
-//=======================================================================================================================
-//  Get Image
-//=======================================================================================================================
 
-func getImage(stub shim.ChaincodeStubInterface, imageID string) ([]byte, error) {
-    fmt.Println("Get image zone")
- 
-    if imageID == "" {
-        fmt.Println("Invalid number of arguments")
-        return nil, errors.New("Missing image ID")
-    } 
-    bytes, err := stub.GetState(imageID)
-    if err != nil {
-        fmt.Println("Could not fetch an image with the demand id "+imageID+" from ledger", err)
-        return nil, err
-    }
+	return IndexImage(stub, previous, image)
 	
-    return bytes, nil
 }
 
 //=======================================================================================================================
-//  Get All Images By User Function 
+//  Migrate legacy indexes - Move objects listed in the old JSON array indexes to their composite keys, and index the
+//  hashes of images delivered before the hash registry and the images stored before the secondary indexes
 //=======================================================================================================================
 
-func GetImagesByUser(stub shim.ChaincodeStubInterface, User string) ([]byte, error) {
+func MigrateLegacyIndexes(stub shim.ChaincodeStubInterface) ([]byte, error) {
 
-	imagesIndex, err := GetIndex(stub, ImagesIndexName)
-	
-	if err != nil {
-	
-		return nil, errors.New("Unable to retrieve imagesIndex, reason: " + err.Error())
-		
-	}
+	migrated := map[string]int{}
+	var migratedImages []Image
 
-	// imageIDs := []string{}
-	
-	var images []Image
+	for _, legacy := range legacyIndexes {
 	
-	for _, imageID := range imagesIndex {
-	
-		imageAsBytes, err := stub.GetState(imageID)
+		indexAsBytes, err := stub.GetState(legacy.Name)
 		
 		if err != nil {
 		
-			return nil, errors.New("Could not retrieve image for ID " + imageID + " reason: " + err.Error())
+			return nil, WrapError(err, "Failed to get " + legacy.Name)
 			
 		}
-
-		var image Image
 		
-		err = json.Unmarshal(imageAsBytes, &image)
+		if indexAsBytes == nil {
 		
-		if err != nil {
-		
-			return nil, errors.New("Error while unmarshalling imageAsBytes, reason: " + err.Error())
+			continue
 			
 		}
+
+		var index []string
 		
+		if err = json.Unmarshal(indexAsBytes, &index); err != nil {
 		
+			return nil, WrapError(err, "Error unmarshalling index '" + legacy.Name + "'")
+			
+		}
 
-		if image.User == User {
+		for _, id := range index {
 		
-			// imageIDs = append(imageIDs, strconv.Itoa(image.ID))
+			objectAsBytes, err := stub.GetState(id)
+			
+			if err != nil {
+			
+				return nil, WrapError(err, "Could not retrieve " + id + " from legacy index " + legacy.Name)
+				
+			}
+			
+			if objectAsBytes == nil {
+			
+				logger.Warningf("Legacy index %v references missing ID %v, skipping", legacy.Name, id)
+				continue
+				
+			}
+
+			if err = Update(stub, id, legacy.IndexName, objectAsBytes); err != nil {
+			
+				return nil, err
+				
+			}
+			
+			var image Image
 			
-			images = append(images, image);
+			if legacy.IndexName == ImagesIndexName && json.Unmarshal(objectAsBytes, &image) == nil {
 			
+				migratedImages = append(migratedImages, image)
+				
+			}
+			
+			if err = stub.DelState(id); err != nil {
 			
+				return nil, WrapError(err, "Error deleting legacy key " + id)
+				
+			}
 			
+			migrated[legacy.IndexName]++
 			
 		}
-		
-	}
-
-	// return imageIDs, nil
-	
-	return json.Marshal(Images {Images: images})
-	
-}
 
-//=======================================================================================================================
-//  Get All users as objects
-//=======================================================================================================================
+		if err = stub.DelState(legacy.Name); err != nil {
+		
+			return nil, WrapError(err, "Error deleting legacy index " + legacy.Name)
+			
+		}
 
-func GetAllUsers(stub shim.ChaincodeStubInterface) ([]User, error) {
+		logger.Infof("Migrated %v entries from %v to %v", migrated[legacy.IndexName], legacy.Name, legacy.IndexName)
+		
+	}
 
-	usersIndex, err := GetIndex(stub, UsersIndexName)
+	hashes, err := RegisterLegacyHashes(stub, migratedImages)
 	
 	if err != nil {
 	
-		return []User{}, errors.New("Could not retrieve userIndex, reason: " + err.Error())
+		return nil, err
 		
 	}
-
-	var users []User
 	
-	for _, userID := range usersIndex {
+	if hashes > 0 {
 	
-		userAsBytes, err := stub.GetState(userID)
-		
-		if err != nil {
-		
-			return []User{}, errors.New("Could not retrieve user with ID: " + userID + ", reason: " + err.Error())
-			
-		}
-
-		var user User
-		
-		err = json.Unmarshal(userAsBytes, &user)
-		
-		if err != nil {
-		
-			return []User{}, errors.New("Error while unmarshalling user, reason: " + err.Error())
-			
-		}
-		
-		user.Username = userID
-
-		users = append(users, user)
+		migrated[HashesIndexName] = hashes
 		
 	}
 
-	return users, nil
-}
-
-//=======================================================================================================================
-//  Get all users as bytes
-//=======================================================================================================================
-
-func GetUsers(stub shim.ChaincodeStubInterface) ([]byte, error) {
-
-	users, err := GetAllUsers(stub)
+	indexed, err := IndexExistingImages(stub, migratedImages)
 	
 	if err != nil {
 	
 		return nil, err
 		
 	}
+	
+	if indexed > 0 {
+	
+		logger.Infof("Added %v images to the secondary indexes", indexed)
+		
+	}
 
-	return json.Marshal( Users {Users: users})
+	return json.Marshal(migrated)
 	
 }
 
 //=======================================================================================================================
-//  Get images as objects
+//  Add user
 //=======================================================================================================================
 
-func GetAllImages(stub shim.ChaincodeStubInterface) ([]Image, error) {
+func addUser(stub shim.ChaincodeStubInterface, index string, userJSONObject string) error {
 
-	imagesIndex, err := GetIndex(stub, ImagesIndexName)
+	var user User
+	
+	if err := json.Unmarshal([]byte(userJSONObject), &user); err != nil {
+	
+		return NewError(CodeInvalidArgument, "Error while unmarshalling user, reason: " + err.Error())
+		
+	}
+	
+	caller, err := GetCaller(stub)
 	
 	if err != nil {
 	
-		return []Image{}, errors.New("Could not retrieve ImagesIndex, reason: " + err.Error())
+		return err
 		
 	}
-
-	var images []Image
 	
-	for _, imageID := range imagesIndex {
+	user.Username = index
+	
+	if err = checkUserOrganization(stub, caller, user); err != nil {
 	
-		imageAsBytes, err := stub.GetState(imageID)
+		return err
+		
+	}
+	
+	config, err := GetConfig(stub)
+	
+	if err != nil {
+	
+		return err
+		
+	}
+	
+	if user.Password != "" {
+	
+		return NewError(CodeInvalidArgument, "The password of user " + index + " must be passed as transient data '" + PasswordTransientKey + "'")
+		
+	}
+	
+	password, err := TransientPassword(stub)
+	
+	if err != nil {
+	
+		return err
+		
+	}
+	
+	// Passwords are only needed for username/password authentication
+	if password != "" || config.LegacyAuth {
+	
+		passwordHash, err := HashPassword(stub, index, password)
+		
+		if err != nil {
+		
+			return WrapError(err, "Error creating new user " + index)
+			
+		}
+		
+		user.PasswordHash = passwordHash
+		
+	}
+	
+	if (user.MSPID == "") != (user.Identity == "") {
+	
+		return NewError(CodeInvalidArgument, "Both msp-id and identity are needed to bind a certificate to user " + index)
+		
+	}
+	
+	if user.Identity != "" {
+	
+		if err = RegisterIdentity(stub, user.MSPID, user.Identity, index); err != nil {
+		
+			return WrapError(err, "Error registering identity of user " + index)
+			
+		}
+		
+	}
+	
+	user.Username = index
+	user.Password = ""
+	
+	userAsBytes, err := json.Marshal(user)
+	
+	if err != nil {
+	
+		return WrapError(err, "Error marshalling user")
+		
+	}
+
+	err = Store(stub, index, UsersIndexName, userAsBytes)
+	
+	if err != nil {
+	
+		return WrapError(err, "Error creating new user " + index)
+		
+	}
+	
+	if err = indexUserOrganization(stub, user); err != nil {
+	
+		return err
+		
+	}
+
+	return EmitEvent(stub, ChaincodeEvent{Type: UserAddedEvent, Username: index, Actor: caller.Name()})
+}
+
+//=======================================================================================================================
+//  Demand Image function 
+//=======================================================================================================================
+
+func DemandImage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+
+	if len(args) != 1 {
+	
+        logger.Debug("Invalid number of args")
+        return nil, NewError(CodeInvalidArgument, "Expected at least one argument for demanding new image")
+		
+    }
+	
+	image, err := ValidateImageDemand(stub, args[0])
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	caller, err := GetCaller(stub)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	// The image belongs to the caller, the user in the payload is only honoured for callers acting on behalf of others
+	image.User, err = ResolveActingUser(stub, caller, image.User)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	owner, err := GetUser(stub, image.User)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	if !caller.CanAccessOrganization(owner.Organization) {
+	
+		return nil, NewError(CodeForbidden, caller.Name() + " cannot demand images for users of another organization")
+		
+	}
+	
+	image.Organization = owner.Organization
+	
+	if err = IdentifyProvider(stub, &image); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	if err = RegisterProviderAsset(stub, image); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	price, err := TransientPrice(stub)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	if err = ReserveBudget(stub, &image, owner, price, caller.MSPID); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	// The status is owned by the chaincode, whatever the caller sent every image starts as demanded
+	image.Status = StatusNone
+	image.StatusChanges = nil
+	
+	// The caller is the actor, also when demanding on behalf of the owner
+	if err := TransitionImage(stub, &image, StatusDemanded, caller.Name(), ""); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	err = StoreImage(stub, image)
+	
+	if err != nil {
+	
+		return nil, WrapError(err, "Error storing image " + image.ID)
+		
+	}
+	
+	return nil, nil
+
+}
+
+//=======================================================================================================================
+//  Deliver Image function 
+//=======================================================================================================================
+
+func DeliverImage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error){
+
+    if len(args) < 4 {
+	
+        logger.Debug("Invalid number of args")
+        return nil, NewError(CodeInvalidArgument, "Expected at least four arguments for delivering new image")
+		
+    }
+ 
+	config, err := GetConfig(stub)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+ 
+	delivery, err := ValidateImageDelivery(args, config.LegacyDigests)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	caller, err := GetCaller(stub)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	// args[4] = delivering user (optional, see ResolveActingUser), args[5] = license JSON (optional)
+	deliveredBy, err := ResolveActingUser(stub, caller, optionalArg(args, 4))
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	image, err := LoadImage(stub, delivery.ImageID)
+	
+	if err != nil {
+	
+		logger.Error("Could not fetch the image from ledger", err)
+		return nil, err
+		
+	}
+	
+	if err = CheckProviderLicense(stub, image, delivery.License); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	if err = TransitionImage(stub, &image, StatusDelivered, deliveredBy, ""); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	if err = SettleBudget(stub, &image, ReservationConsumed); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	// md5-hash is kept for clients reading it before the hash registry
+	image.Hashes = delivery.Hashes
+	image.MD5Hash = delivery.Hashes[HashMD5]
+	image.PerceptualHash = delivery.PerceptualHash
+	image.License = delivery.License
+	image.PurchaseDate = delivery.PurchaseDate
+	image.Name = delivery.Name
+	
+	if err = RegisterImageHashes(stub, image); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	if err = IndexLicenseExpiry(stub, image); err != nil {
+	
+		return nil, err
+		
+	}
+	
+	err = SaveImage(stub, image)
+	
+	if err != nil {
+	
+		logger.Error("Could not save image post update", err)
+		return nil, err
+		
+	}
+ 
+    fmt.Println("The image is successfully delivered")
+	
+    return nil, nil
+
+}
+
+//=======================================================================================================================
+//  Query Functions
+//=======================================================================================================================
+//  Get User
+//=======================================================================================================================
+
+func GetUser(stub shim.ChaincodeStubInterface, username string) (User, error) {
+
+	userAsBytes, err := GetObject(stub, UsersIndexName, username)
+	
+	if err != nil {
+	
+		return User{}, WrapError(err, "Could not retrieve information for this user")
+		
+	}
+	
+	if userAsBytes == nil {
+	
+		return User{}, NewError(CodeNotFound, "User " + username + " does not exist")
+		
+	}
+
+	var user User
+	
+	if err = json.Unmarshal(userAsBytes, &user); err != nil {
+	
+		return User{}, WrapError(err, "Cannot get user")
+		
+	}
+	
+	user.Username = username
+
+	return user, nil
+}
+
+//=======================================================================================================================
+//   Authenticate User
+//=======================================================================================================================
+
+func AuthenticateAsUser(stub shim.ChaincodeStubInterface, user User, password string) (UserAuthenticationResult) {
+
+	if user == (User{}) {
+	
+		fmt.Println("User not found")
+		
+		VerifyPassword(dummyPasswordHash, password)
+		
+		return UserAuthenticationResult{
+		
+			User: user,
+			Authenticated: false,
+			
+		}
+		
+	}
+
+	var matches, needsRehash bool
+	
+	if user.PasswordHash != "" {
+	
+		var err error
+		
+		matches, needsRehash, err = VerifyPassword(user.PasswordHash, password)
 		
 		if err != nil {
 		
-			return []Image{}, errors.New("Could not retrieve image with ID: " + imageID + ", reason: " + err.Error())
+			logger.Errorf("Cannot verify password of user %v: %v", user.Username, err)
 			
 		}
+		
+	} else {
+	
+		// Users stored before passwords were hashed, upgraded below on their first successful authentication
+		matches = user.Password != "" && subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+		needsRehash = true
+		
+	}
+
+	if !matches {
+	
+		fmt.Println("Password does not match")
+		
+		return UserAuthenticationResult{
+		
+			User: user.Public(),
+			Authenticated: false,
+			
+		}
+		
+	}
+	
+	return UserAuthenticationResult{
+	
+		User: user.Public(),
+		
+		Authenticated: true,
+		
+		PasswordUpgradeNeeded: needsRehash,
+		
+	}
+	
+}
+
+//=======================================================================================================================
+//   Upgrade password hash - args[0] = username, transient "password" = the password. Replaces a plaintext or outdated
+//   password hash after a successful authentication, in a transaction of its own so that AuthenticateAsUser never
+//   writes and can be evaluated as a query.
+//=======================================================================================================================
+
+func UpgradePasswordHash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	user, password, result, err := authenticateWithTransientPassword(stub, args)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+	
+	if !result.Authenticated {
+	
+		return nil, NewError(CodeForbidden, "Wrong username or password")
+		
+	}
+	
+	if !result.PasswordUpgradeNeeded {
+	
+		return json.Marshal(result)
+		
+	}
+	
+	passwordHash, err := HashPassword(stub, user.Username, password)
+	
+	if err != nil {
+	
+		return nil, WrapError(err, "Could not hash password of user " + user.Username)
+		
+	}
+	
+	user.Password = ""
+	user.PasswordHash = passwordHash
+	
+	userAsBytes, err := json.Marshal(user)
+	
+	if err != nil {
+	
+		return nil, WrapError(err, "Could not marshal user " + user.Username)
+		
+	}
+	
+	if err = Update(stub, user.Username, UsersIndexName, userAsBytes); err != nil {
+	
+		return nil, WrapError(err, "Could not upgrade password hash of user " + user.Username)
+		
+	}
+	
+	result.PasswordUpgradeNeeded = false
+	
+	return json.Marshal(result)
+	
+}
+
+//=======================================================================================================================
+//   Authenticate - args[0] = username, transient "password" = the password
+//=======================================================================================================================
+
+func Authenticate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	_, _, result, err := authenticateWithTransientPassword(stub, args)
+	
+	if err != nil {
+	
+		return nil, err
+		
+	}
+
+	return json.Marshal(result)
+	
+}
+
+// Authenticates args[0] with the transient password, returning the stored user and the password for an upgrade
+func authenticateWithTransientPassword(stub shim.ChaincodeStubInterface, args []string) (User, string, UserAuthenticationResult, error) {
+
+	if len(args) != 1 {
+	
+		logger.Debug("Invalid number of args")
+		return User{}, "", UserAuthenticationResult{}, NewError(CodeInvalidArgument, "Expected the username for authenticating, the password is passed as transient data '" + PasswordTransientKey + "'")
+		
+	}
+	
+	config, err := GetConfig(stub)
+	
+	if err != nil {
+	
+		return User{}, "", UserAuthenticationResult{}, err
+		
+	}
+	
+	if !config.LegacyAuth {
+	
+		return User{}, "", UserAuthenticationResult{}, NewError(CodeForbidden, "Username/password authentication is disabled, callers are identified by their certificate")
+		
+	}
+	
+	password, err := TransientPassword(stub)
+	
+	if err != nil {
+	
+		return User{}, "", UserAuthenticationResult{}, err
+		
+	}
+	
+	if password == "" {
+	
+		return User{}, "", UserAuthenticationResult{}, NewError(CodeInvalidArgument, "The password must be passed as transient data '" + PasswordTransientKey + "'")
+		
+	}
+
+	user, err := GetUser(stub, args[0])
+	
+	if err != nil {
+	
+		logger.Infof("User with id %v not found.", args[0])
+		
+	}
+
+	return user, password, AuthenticateAsUser(stub, user, password), nil
+	
+}
+
+//=======================================================================================================================
+//  Get Image
+//=======================================================================================================================
+
+func getImage(stub shim.ChaincodeStubInterface, imageID string) ([]byte, error) {
+    fmt.Println("Get image zone")
+ 
+    if imageID == "" {
+        fmt.Println("Invalid number of arguments")
+        return nil, NewError(CodeInvalidArgument, "Missing image ID")
+    } 
+    bytes, err := GetObject(stub, ImagesIndexName, imageID)
+    if err != nil {
+        fmt.Println("Could not fetch an image with the demand id "+imageID+" from ledger", err)
+        return nil, err
+    }
+    if bytes == nil {
+        return nil, NewError(CodeNotFound, "Image " + imageID + " does not exist")
+    }
+	
+    return bytes, nil
+}
 
-		var image Image
-		
-		err = json.Unmarshal(imageAsBytes, &image)
-		
-		if err != nil {
-		
-			return []Image{}, errors.New("Error while unmarshalling image, reason: " + err.Error())
-			
-		}
+//=======================================================================================================================
+//  Get images by user - args[0] = username, args[1..3] = page size, bookmark and sort as described in Pagination.go
+//=======================================================================================================================
 
-		images = append(images, image)
-		
-	}
+func GetImagesByUser(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	return images, nil
+	return PageImagesInIndex(stub, args, 1, ImagesByUserIndexName, args[0])
+	
 }
 
 //=======================================================================================================================
-//  Get all images as bytes 
+//  Get users - args[0..2] = page size, bookmark and sort, returns a page of users without password material
 //=======================================================================================================================
 
-func GetImages(stub shim.ChaincodeStubInterface) ([]byte, error) {
+func GetUsers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	images, err := GetAllImages(stub)
+	return PageUsers(stub, args, 0)
 	
-	if err != nil {
+}
+
+//=======================================================================================================================
+//  Get images - args[0..2] = page size, bookmark and sort, returns a page of all images
+//=======================================================================================================================
+
+func GetImages(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	return PageImages(stub, args, 0, nil)
 	
-		return nil, err
+}
+
+//=======================================================================================================================
+//  Optional argument - args[index], or "" if it was not given
+//=======================================================================================================================
+
+func optionalArg(args []string, index int) string {
+
+	if len(args) > index {
+	
+		return args[index]
 		
 	}
-
-	return json.Marshal( Images {Images: images})
+	
+	return ""
 	
 }
 
@@ -595,114 +1149,456 @@ func GetImages(stub shim.ChaincodeStubInterface) ([]byte, error) {
 //=======================================================================================================================
 
 func DoesIDExist(stub shim.ChaincodeStubInterface, id string, indexName string) (bool, error) {
-	index, err := GetIndex(stub, indexName)
+	objectAsBytes, err := GetObject(stub, indexName, id)
 	if err != nil {
 		return false, err
 	}
 
-	for _, indexElement := range index {
-		if indexElement == id {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	return objectAsBytes != nil, nil
 }
 
 
 
 //#######################################################################################################################
 //#																														#
-//#                  				Main functions (Init, Invoke and Query) 											#
+//#                  				Main functions (Init and Invoke) 													#
 //#																														#
 //#######################################################################################################################
 
 //=======================================================================================================================
-//   Init function - Called when the user deploys the chaincode.
+//   Expect args - The number of arguments must match the chaincode interface
 //=======================================================================================================================
 
-func (t *SampleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string)([]byte, error) {
+func expectArgs(function string, args []string, count int) error {
 
-	for _, indexName := range indexNames {
-		var emptyIndex []string
+	if len(args) < count {
+	
+		return NewError(CodeInvalidArgument, "Expected at least " + strconv.Itoa(count) + " arguments for " + function + ", got " + strconv.Itoa(len(args)))
+		
+	}
+	
+	return nil
+	
+}
 
-		empty, err := json.Marshal(emptyIndex)
-		if err != nil {
-			return nil, errors.New("Error marshalling")
-		}
+//=======================================================================================================================
+//   Response - Turn the result of a function into a peer response, errors as described in Errors.go
+//=======================================================================================================================
 
-		err = stub.PutState(indexName, empty);
-		if err != nil {
-			return nil, errors.New("Error deleting index")
-		}
+func response(payload []byte, err error) pb.Response {
 
-		logger.Infof("Delete with success from ledger: " + indexName)
+	if err == nil {
+	
+		return shim.Success(payload)
+		
 	}
-	return nil, nil
+	
+	return ErrorResponse(err)
+	
+}
+
+//=======================================================================================================================
+//   Init function - Called when the chaincode is instantiated or upgraded.
+//=======================================================================================================================
+
+func (t *SampleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+
+	_, args := stub.GetFunctionAndParameters()
+
+	// Ledgers deployed with the JSON array indexes are migrated to composite keys, fresh ledgers need no setup
+	_, err := MigrateLegacyIndexes(stub)
+	if err != nil {
+		return ErrorResponse(WrapError(err, "Error migrating legacy indexes"))
+	}
+
+	// args[0] = config JSON (optional), without it the stored or default config is kept
+	if len(args) > 0 {
+		if err = PutConfig(stub, args[0]); err != nil {
+			return ErrorResponse(WrapError(err, "Error storing config"))
+		}
+	}
+	return shim.Success(nil)
 	
 }
 
 //=======================================================================================================================
-//  Invoke function
+//  Invoke function - Entry point of every function, queries included. The function name is the first argument.
 //=======================================================================================================================
 
-func (t *SampleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SampleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+
+	function, args := stub.GetFunctionAndParameters()
+
+	if err := CheckAccess(stub, function, args); err != nil {
+	
+		return response(nil, err)
+		
+	}
+
+	events := NewEventCollector(stub)
+
+	payload, err := t.dispatch(events, function, args)
+	
+	if err != nil {
+	
+		return response(nil, err)
+		
+	}
+	
+	return response(payload, events.Flush())
+	
+}
+
+func (t *SampleChaincode) dispatch(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
-	if function == "addUser" {
+	switch function {
+	
+	case "addUser":
 	
 		// args[0] = new User ID (username)
-		// args[1] = new User Data (password, ptype)
+		// args[1] = new User Data (ptype, ...), transient "password" = the password
+		if err := expectArgs(function, args, 2); err != nil {
+		
+			return nil, err
+			
+		}
+		
 		return nil, addUser(stub, args[0], args[1])
 	
-	} else if  function == "DemandImage" {
+	case "DemandImage":
 	
 		return DemandImage(stub, args)
 		
-	} else if  function == "DeliverImage" {
+	case "DeliverImage":
 	
 		return DeliverImage(stub, args)
 		
-	}
+	case "ApproveImageDemand":
 	
-	return nil, nil
-}
-
-//=======================================================================================================================
-//  Query Function
-//=======================================================================================================================
-
-func (t *SampleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-									      
-		if function == "AuthenticateAsUser" {
+		return ApproveImageDemand(stub, args)
 		
-			user, err := GetUser(stub, args[0])
-			if err != nil {
-				logger.Infof("User with id %v not found.", args[0])
-			}
+	case "RejectImageDemand":
+	
+		return RejectImageDemand(stub, args)
 		
-		    return json.Marshal(AuthenticateAsUser(stub, user, args[1]))
+	case "MigrateLegacyIndexes":
+	
+		return MigrateLegacyIndexes(stub)
+		
+	case "ExpireLicenses":
+	
+		return ExpireLicenses(stub)
+		
+	case "AuthenticateAsUser":
+	
+		// args[0] : username, transient "password" : the password
+		return Authenticate(stub, args)
+		
+	case "UpgradePasswordHash":
+	
+		// args[0] : username, transient "password" : the password
+		return UpgradePasswordHash(stub, args)
+		
+	case "getUsers":
+	
+		// args[0] : page size, args[1] : bookmark, args[2] : sort (all optional)
+		return GetUsers(stub, args)
+		
+	case "GetImagesByUser":
+	
+		// args[0] : username, args[1] : page size, args[2] : bookmark, args[3] : sort (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
 			
-		} else if function == "getUsers" {
+		}
+		
+		return GetImagesByUser(stub, args)
 		
-			return GetUsers(stub)
-			 
-		} else if function == "GetImagesByUser" {
+	case "getImage":
+	
+		// args[0] : imageID
+		if err := expectArgs(function, args, 1); err != nil {
 		
-			// args[0] : username
-			return GetImagesByUser(stub , args[0])
+			return nil, err
 			
-		} else if function == "getImage" {
+		}
 		
-			// args[0] : imageID
-			return getImage(stub, args[0]);
+		return getImage(stub, args[0])
+		
+	case "GetImages":
+	
+		// args[0] : page size, args[1] : bookmark, args[2] : sort (all optional)
+		return GetImages(stub, args)
+		
+	case "GetPendingApprovals":
+	
+		return GetPendingApprovals(stub)
+		
+	case "WhoAmI":
+	
+		return WhoAmI(stub)
+		
+	case "GetAllowedTransitions":
+	
+		// args[0] : imageID (optional)
+		return GetAllowedTransitions(stub, args)
+		
+	case "VerifyImageByHash":
+	
+		// args[0] : digest
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
 			
-		} else if function == "GetImages" {
+		}
 		
-			return GetImages(stub)
+		return VerifyImageByHash(stub, args)
+		
+	case "FindSimilarImages":
+	
+		// args[0] : perceptual hash, args[1] : maximum distance (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
 			
 		}
 		
-	return nil, nil
+		return FindSimilarImages(stub, args)
+		
+	case "CheckUsageAllowed":
+	
+		// args[0] : imageID, args[1] : medium, args[2] : territory, args[3] : date (optional)
+		if err := expectArgs(function, args, 3); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return CheckUsageAllowed(stub, args)
+		
+	case "GetExpiringLicenses":
+	
+		// args[0] : from date, args[1] : to date
+		if err := expectArgs(function, args, 2); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetExpiringLicenses(stub, args)
+		
+	case "GetImageHistory":
+	
+		// args[0] : imageID
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetImageHistory(stub, args)
+		
+	case "QueryImages":
+	
+		// args[0] : filter, args[1] : page size, args[2] : bookmark, args[3] : sort (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return QueryImages(stub, args)
+		
+	case "GetImagesByAuthor":
+	
+		// args[0] : author, args[1] : page size, args[2] : bookmark, args[3] : sort (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetImagesByAuthor(stub, args)
+		
+	case "GetImagesByStatus":
+	
+		// args[0] : status number or name, args[1] : page size, args[2] : bookmark, args[3] : sort (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetImagesByStatus(stub, args)
+		
+	case "GetImagesByProvider":
+	
+		// args[0] : provider domain, args[1] : page size, args[2] : bookmark, args[3] : sort (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetImagesByProvider(stub, args)
+		
+	case "RecordImagePurchase":
+	
+		// args[0] : imageID, transient "purchase-record" : the record
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return RecordImagePurchase(stub, args)
+		
+	case "GetImagePurchaseRecord":
+	
+		// args[0] : imageID
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetImagePurchaseRecord(stub, args)
+		
+	case "TransferImageLicense":
+	
+		// args[0] : imageID, args[1] : new owner, args[2] : reason
+		if err := expectArgs(function, args, 3); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return TransferImageLicense(stub, args)
+		
+	case "ArchiveImage":
+	
+		// args[0] : imageID, args[1] : reason (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return ArchiveImage(stub, args)
+		
+	case "RevokeImageLicense":
+	
+		// args[0] : imageID, args[1] : reason, args[2] : evidence digest
+		if err := expectArgs(function, args, 3); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return RevokeImageLicense(stub, args)
+		
+	case "GetRevokedImages":
+	
+		// args[0] : page size, args[1] : bookmark, args[2] : sort (all optional)
+		return GetRevokedImages(stub, args)
+		
+	case "AddOrganization":
+	
+		// args[0] : organization ID, args[1] : organization JSON
+		if err := expectArgs(function, args, 2); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return AddOrganization(stub, args)
+		
+	case "GetOrganization":
+	
+		// args[0] : organization ID
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetOrganizationByID(stub, args)
+		
+	case "GetImagesByOrganization":
+	
+		// args[0] : organization ID, args[1] : page size, args[2] : bookmark, args[3] : sort (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetImagesByOrganization(stub, args)
+		
+	case "GetUsersByOrganization":
+	
+		// args[0] : organization ID, args[1] : page size, args[2] : bookmark (optional)
+		if err := expectArgs(function, args, 1); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetUsersByOrganization(stub, args)
+		
+	case "SetBudget":
+	
+		// args[0] : department, args[1] : period, transient budget JSON
+		if err := expectArgs(function, args, 2); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return SetBudget(stub, args)
+		
+	case "GetBudgetStatus":
+	
+		// args[0] : department, args[1] : period
+		if err := expectArgs(function, args, 2); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return GetBudgetStatus(stub, args)
+		
+	case "AddProvider":
+	
+		// args[0] : provider ID, args[1] : provider JSON
+		if err := expectArgs(function, args, 2); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return AddProvider(stub, args)
+		
+	case "UpdateProvider":
+	
+		// args[0] : provider ID, args[1] : provider JSON
+		if err := expectArgs(function, args, 2); err != nil {
+		
+			return nil, err
+			
+		}
+		
+		return UpdateProvider(stub, args)
+		
+	case "GetProviders":
+	
+		return GetProviders(stub)
+		
+	}
+	
+	return nil, NewError(CodeInvalidArgument, "Unknown function " + function)
+	
 }
 
 //=======================================================================================================================
@@ -0,0 +1,2522 @@
+package main
+
+import (
+
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+
+)
+
+//=======================================================================================================================
+// Fixture - A ledger with an admin certificate and three registered users
+//=======================================================================================================================
+
+type fixture struct {
+
+	*memoryStub
+
+	admin       []byte      // unregistered, plv.role=admin
+	alice       []byte      // employee
+	bob         []byte      // employee
+	maria       []byte      // marketing
+	stranger    []byte      // unregistered, no attributes
+
+}
+
+func newFixture(t *testing.T, config ...string) *fixture {
+
+	f := &fixture{
+
+		memoryStub: newMemoryStub(t),
+		admin:      newIdentity(t, "Org1MSP", "admin", map[string]string{RoleAttribute: ParticipantAdmin}),
+		alice:      newIdentity(t, "Org1MSP", "alice", map[string]string{UsernameAttribute: "alice@capgemini.com"}),
+		bob:        newIdentity(t, "Org1MSP", "bob", map[string]string{UsernameAttribute: "bob@capgemini.com"}),
+		maria:      newIdentity(t, "Org1MSP", "maria", map[string]string{UsernameAttribute: "maria@capgemini.com"}),
+		stranger:   newIdentity(t, "Org1MSP", "stranger", nil),
+
+	}
+
+	if response := f.init(f.admin, withAdminMSPs(t, config)); response.Status != 200 {
+
+		t.Fatalf("Init failed: %v", response.Message)
+
+	}
+
+	f.addUser("alice@capgemini.com", `{"participant-type":"employee"}`, "alice-secret")
+	f.addUser("bob@capgemini.com", `{"participant-type":"employee"}`, "bob-secret")
+	f.addUser("maria@capgemini.com", `{"participant-type":"marketing"}`, "maria-secret")
+
+	return f
+
+}
+
+// Adds a user as admin, with the password as transient data
+func (f *fixture) addUser(username string, userJSON string, password string) {
+
+	f.t.Helper()
+
+	f.transient = map[string][]byte{PasswordTransientKey: []byte(password)}
+	f.mustInvoke(f.admin, "addUser", username, userJSON)
+
+}
+
+// The config, or an empty one, with Org1MSP as admin and network admin MSP unless it names its own
+func withAdminMSPs(t *testing.T, config []string) string {
+
+	settings := map[string]interface{}{}
+
+	if len(config) > 0 {
+
+		if err := json.Unmarshal([]byte(config[0]), &settings); err != nil {
+
+			t.Fatalf("invalid fixture config: %v", err)
+
+		}
+
+	}
+
+	if _, found := settings["admin-msps"]; !found {
+
+		settings["admin-msps"] = []string{"Org1MSP"}
+
+	}
+
+	if _, found := settings["network-admin-msps"]; !found {
+
+		settings["network-admin-msps"] = settings["admin-msps"]
+
+	}
+
+	configAsBytes, _ := json.Marshal(settings)
+
+	return string(configAsBytes)
+
+}
+
+func demandJSON(id string, user string) string {
+
+	return `{"id":"` + id + `", "name":"UNDEFINED", "author":"ildogesto", "url":"http://www.istockphoto.com/vector/flat-design-icons-for-business-and-finance-gm509786662-85956153", "user":"` + user + `", "md5-hash":"UNDEFINED", "remarks":"UNDEFINED", "purchase-date":"UNDEFINED"}`
+
+}
+
+func (f *fixture) image(id string) Image {
+
+	f.t.Helper()
+
+	var image Image
+
+	if err := json.Unmarshal(f.mustInvoke(f.maria, "getImage", id), &image); err != nil {
+
+		f.t.Fatalf("getImage %v: %v", id, err)
+
+	}
+
+	return image
+
+}
+
+// A page of GetImages or GetImagesByUser
+type imagePage struct {
+
+	Items       []Image     `json:"items"`
+	Bookmark    string      `json:"bookmark"`
+	HasMore     bool        `json:"hasMore"`
+	TotalCount  int         `json:"totalCount"`
+
+}
+
+func (f *fixture) imagePage(creator []byte, function string, args ...string) imagePage {
+
+	f.t.Helper()
+
+	var page imagePage
+
+	if err := json.Unmarshal(f.mustInvoke(creator, function, args...), &page); err != nil {
+
+		f.t.Fatalf("%v: %v", function, err)
+
+	}
+
+	return page
+
+}
+
+func (f *fixture) images(creator []byte, function string, args ...string) []Image {
+
+	f.t.Helper()
+
+	var images Images
+
+	if err := json.Unmarshal(f.mustInvoke(creator, function, args...), &images); err != nil {
+
+		f.t.Fatalf("%v: %v", function, err)
+
+	}
+
+	return images.Images
+
+}
+
+//=======================================================================================================================
+//  Init
+//=======================================================================================================================
+
+func TestInitMigratesLegacyIndexes(t *testing.T) {
+
+	stub := newMemoryStub(t)
+	stub.state[LegacyUsersIndexName] = []byte(`["alice@capgemini.com"]`)
+	stub.state["alice@capgemini.com"] = []byte(`{"password":"123456","participant-type":"employee"}`)
+	stub.state[LegacyImagesIndexName] = []byte(`["IMG1","IMG2","MISSING"]`)
+	stub.state["IMG1"] = []byte(`{"id":"IMG1","user":"alice@capgemini.com","md5-hash":"UNDEFINED","status":1}`)
+	stub.state["IMG2"] = []byte(`{"id":"IMG2","user":"alice@capgemini.com","md5-hash":"da39a3ee5e6b4b0d3255bfef95601890afd80709","status":2}`)
+
+	if response := stub.init(nil); response.Status != 200 {
+
+		t.Fatalf("Init failed: %v", response.Message)
+
+	}
+
+	for _, key := range []string{LegacyUsersIndexName, LegacyImagesIndexName, "alice@capgemini.com", "IMG1"} {
+
+		if stub.state[key] != nil {
+
+			t.Errorf("legacy key %v was not removed", key)
+
+		}
+
+	}
+
+	userKey, _ := createCompositeKey(UsersIndexName, []string{"alice@capgemini.com"})
+	imageKey, _ := createCompositeKey(ImagesIndexName, []string{"IMG1"})
+
+	if stub.state[userKey] == nil || stub.state[imageKey] == nil {
+
+		t.Fatalf("migrated objects are missing")
+
+	}
+
+	// The hash of delivered legacy images is indexed by its length, placeholders are not
+	hashKey, _ := createCompositeKey(HashesIndexName, []string{HashSHA1, "da39a3ee5e6b4b0d3255bfef95601890afd80709", ""})
+
+	if string(stub.state[hashKey]) != "IMG2" {
+
+		t.Fatalf("expected the legacy hash of IMG2 to be indexed, got %q", stub.state[hashKey])
+
+	}
+
+	// Migrated images are added to the secondary indexes
+	byUserKey, _ := createCompositeKey(ImagesByUserIndexName, []string{"alice@capgemini.com", "IMG2"})
+	byStatusKey, _ := createCompositeKey(ImagesByStatusIndexName, []string{"2", "IMG2"})
+
+	if stub.state[byUserKey] == nil || stub.state[byStatusKey] == nil || stub.state[SecondaryIndexesKey] == nil {
+
+		t.Fatalf("expected IMG2 to be in the secondary indexes")
+
+	}
+
+	// Running it again is a no-op
+	if response := stub.init(nil); response.Status != 200 {
+
+		t.Fatalf("second Init failed: %v", response.Message)
+
+	}
+
+}
+
+func TestInitConfig(t *testing.T) {
+
+	f := newFixture(t, `{"approver-roles":["employee"], "legacy-auth":true}`)
+
+	config, err := GetConfig(f)
+
+	if err != nil || !config.LegacyAuth || !config.IsApproverRole("employee") || config.IsApproverRole("marketing") {
+
+		t.Fatalf("unexpected config %+v, %v", config, err)
+
+	}
+
+	if response := f.init(f.admin, `{"approver-roles":[]}`); response.Status != 400 {
+
+		t.Fatalf("expected an empty approver list to be rejected, got %v", response.Status)
+
+	}
+
+	if response := f.init(f.admin, `not json`); response.Status != 400 {
+
+		t.Fatalf("expected invalid config to be rejected, got %v", response.Status)
+
+	}
+
+	if response := f.init(f.admin, `{"admin-msps":["Org1MSP"], "network-admin-msps":["Org2MSP"]}`); response.Status != 400 {
+
+		t.Fatalf("expected network admin MSPs outside the admin MSPs to be rejected, got %v", response.Status)
+
+	}
+
+}
+
+//=======================================================================================================================
+//  addUser
+//=======================================================================================================================
+
+func TestAddUser(t *testing.T) {
+
+	f := newFixture(t)
+
+	userAsBytes, _ := GetObject(f, UsersIndexName, "alice@capgemini.com")
+
+	if strings.Contains(string(userAsBytes), "alice-secret") || !strings.Contains(string(userAsBytes), `"password-hash":"$pbkdf2-sha256$`) {
+
+		t.Fatalf("password not stored as hash: %s", userAsBytes)
+
+	}
+
+	f.mustFail(f.admin, CodeAlreadyExists, "addUser", "alice@capgemini.com", `{"participant-type":"employee"}`)
+	f.mustFail(f.admin, CodeInvalidArgument, "addUser", "carl@capgemini.com", `not json`)
+	f.mustFail(f.admin, CodeInvalidArgument, "addUser", "carl@capgemini.com")
+	f.mustFail(f.maria, CodeForbidden, "addUser", "carl@capgemini.com", `{"participant-type":"admin"}`)
+
+	// Passwords are only required for username/password authentication
+	f.mustInvoke(f.admin, "addUser", "carl@capgemini.com", `{"participant-type":"employee"}`)
+
+	// Passwords are only accepted as transient data
+	f.mustFail(f.admin, CodeInvalidArgument, "addUser", "dave@capgemini.com", `{"password":"dave-secret", "participant-type":"employee"}`)
+
+	f = newFixture(t, `{"legacy-auth":true}`)
+	f.mustFail(f.admin, CodeInvalidArgument, "addUser", "carl@capgemini.com", `{"participant-type":"employee"}`)
+
+}
+
+func TestAddUserBindsIdentity(t *testing.T) {
+
+	f := newFixture(t)
+	carl := newIdentity(t, "Org2MSP", "carl", nil)
+
+	var caller Caller
+	json.Unmarshal(f.mustInvoke(carl, "WhoAmI"), &caller)
+
+	if caller.MSPID != "Org2MSP" || caller.Username != "" {
+
+		t.Fatalf("unexpected caller %+v", caller)
+
+	}
+
+	user := `{"participant-type":"marketing", "msp-id":"Org2MSP", "identity":"` + caller.ID + `"}`
+
+	f.mustInvoke(f.admin, "addUser", "carl@capgemini.com", user)
+	json.Unmarshal(f.mustInvoke(carl, "WhoAmI"), &caller)
+
+	if caller.Username != "carl@capgemini.com" || caller.Role != ParticipantMarketing {
+
+		t.Fatalf("identity not bound: %+v", caller)
+
+	}
+
+	// The same certificate cannot be bound twice
+	f.mustFail(f.admin, CodeAlreadyExists, "addUser", "carl2@capgemini.com", user)
+	f.mustFail(f.admin, CodeInvalidArgument, "addUser", "carl3@capgemini.com", `{"participant-type":"marketing", "msp-id":"Org2MSP"}`)
+
+}
+
+func TestCertificatesOfOtherMSPsCannotClaimUsersOrRoles(t *testing.T) {
+
+	f := newFixture(t)
+	mallory := newIdentity(t, "Org2MSP", "mallory", map[string]string{UsernameAttribute: "alice@capgemini.com"})
+	root := newIdentity(t, "Org2MSP", "root", map[string]string{RoleAttribute: ParticipantAdmin})
+
+	f.mustFail(mallory, CodeForbidden, "DemandImage", demandJSON("IMG1", ""))
+	f.mustFail(mallory, CodeForbidden, "WhoAmI")
+	f.mustFail(root, CodeForbidden, "addUser", "carl@capgemini.com", `{"participant-type":"admin"}`)
+	f.mustFail(root, CodeForbidden, "MigrateLegacyIndexes")
+
+	var caller Caller
+	json.Unmarshal(f.mustInvoke(root, "WhoAmI"), &caller)
+
+	if caller.Role != "" {
+
+		t.Fatalf("expected the role of a foreign certificate to be ignored, got %+v", caller)
+
+	}
+
+}
+
+//=======================================================================================================================
+//  DemandImage
+//=======================================================================================================================
+
+func TestDemandImage(t *testing.T) {
+
+	f := newFixture(t)
+
+	// The owner comes from the certificate, the status from the chaincode
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+
+	image := f.image("IMG1")
+
+	if image.User != "alice@capgemini.com" || image.Status != StatusDemanded || len(image.StatusChanges) != 1 {
+
+		t.Fatalf("unexpected image %+v", image)
+
+	}
+
+	if change := image.StatusChanges[0]; change.By != "alice@capgemini.com" || change.TxID == "" || change.At == "" {
+
+		t.Fatalf("unexpected status change %+v", change)
+
+	}
+
+	f.mustFail(f.alice, CodeAlreadyExists, "DemandImage", demandJSON("IMG1", ""))
+	f.mustFail(f.alice, CodeForbidden, "DemandImage", demandJSON("IMG2", "bob@capgemini.com"))
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":`)
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage")
+	f.mustFail(f.stranger, CodeForbidden, "DemandImage", demandJSON("IMG3", ""))
+
+	// Admins demand on behalf of existing users
+	f.mustInvoke(f.admin, "DemandImage", demandJSON("IMG4", "bob@capgemini.com"))
+	f.mustFail(f.admin, CodeInvalidArgument, "DemandImage", demandJSON("IMG5", "nobody@capgemini.com"))
+
+	if image = f.image("IMG4"); image.User != "bob@capgemini.com" || image.StatusChanges[0].By != "admin" {
+
+		t.Fatalf("expected IMG4 to belong to bob and be demanded by admin, got %v %+v", image.User, image.StatusChanges)
+
+	}
+
+}
+
+func TestDemandImageValidation(t *testing.T) {
+
+	f := newFixture(t)
+
+	failure := f.mustFail(f.admin, CodeInvalidArgument, "DemandImage",
+		`{"id":"", "url":"ftp://example.com/a.png", "user":"nobody@capgemini.com", "status":3, "owner":"alice", "md5-hash":"abc"}`)
+
+	expected := []FieldError{
+		{"owner", "is not a field of an image"},
+		{"status", "is set by the chaincode"},
+		{"id", "is required"},
+		{"url", "must be an http or https URL"},
+		{"user", "user nobody@capgemini.com does not exist"},
+		{"md5-hash", "is set on delivery"},
+	}
+
+	if !reflect.DeepEqual(failure.Details, expected) {
+
+		t.Fatalf("unexpected details %+v", failure.Details)
+
+	}
+
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":"IMG1", "url":"not a url"}`)
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":"IMG1", "url":"http://example.com/a.png", "remarks":42}`)
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `["IMG1"]`)
+
+	// Placeholders of the legacy clients are cleared
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+
+	if image := f.image("IMG1"); image.Name != "" || image.MD5Hash != "" || image.PurchaseDate != "" || image.Remarks != "" {
+
+		t.Fatalf("expected placeholders to be cleared, got %+v", image)
+
+	}
+
+}
+
+//=======================================================================================================================
+//  VerifyImageByHash
+//=======================================================================================================================
+
+const emptyFileSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+const emptyFileMD5 = "d41d8cd98f00b204e9800998ecf8427e"
+
+func TestVerifyImageByHash(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG2", ""))
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG2")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "search-icon.png", "sha256:" + emptyFileSHA256 + ",md5:" + emptyFileMD5, "19.05.2017", "", rightsManagedLicense)
+
+	// A file can only be licensed once
+	f.mustFail(f.maria, CodeAlreadyExists, "DeliverImage", "IMG2", "copy.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+	f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG2", "copy.png", "md5:" + emptyFileMD5, "19.05.2017")
+
+	var verification HashVerification
+
+	for _, digest := range []string{"sha256:" + emptyFileSHA256, strings.ToUpper(emptyFileSHA256), emptyFileMD5} {
+
+		json.Unmarshal(f.mustInvoke(f.bob, "VerifyImageByHash", digest), &verification)
+
+		if !verification.Licensed || verification.ImageID != "IMG1" || verification.LicensedTo != "alice@capgemini.com" || verification.PurchaseDate != "19.05.2017" ||
+			verification.License == nil || verification.License.Type != "rights-managed" {
+
+			t.Fatalf("unexpected verification of %v: %+v", digest, verification)
+
+		}
+
+	}
+
+	verification = HashVerification{}
+	json.Unmarshal(f.mustInvoke(f.bob, "VerifyImageByHash", "sha512:" + strings.Repeat("ab", 64)), &verification)
+
+	if verification.Licensed || verification.ImageID != "" || verification.Algorithm != HashSHA512 {
+
+		t.Fatalf("expected an unknown file not to be licensed, got %+v", verification)
+
+	}
+
+	f.mustFail(f.bob, CodeInvalidArgument, "VerifyImageByHash", "sha256:" + emptyFileMD5)
+	f.mustFail(f.bob, CodeInvalidArgument, "VerifyImageByHash", "not a digest")
+	f.mustFail(f.bob, CodeInvalidArgument, "VerifyImageByHash")
+	f.mustFail(f.stranger, CodeForbidden, "VerifyImageByHash", emptyFileSHA256)
+
+	// Archiving the image releases the file
+	f.mustInvoke(f.maria, "ArchiveImage", "IMG1")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG2", "copy.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+}
+
+func TestImageHashesAreRegisteredPerOrganization(t *testing.T) {
+
+	f := newFixture(t)
+	ann := newIdentity(t, "Org1MSP", "ann", map[string]string{UsernameAttribute: "ann@acme.com"})
+	al := newIdentity(t, "Org1MSP", "al", map[string]string{UsernameAttribute: "al@acme.com"})
+
+	f.mustInvoke(f.admin, "AddOrganization", "acme", `{"name":"ACME", "msp-id":"Org1MSP", "billing-contact":"billing@acme.com"}`)
+	f.mustInvoke(f.admin, "addUser", "ann@acme.com", `{"participant-type":"marketing", "organization":"acme"}`)
+	f.mustInvoke(f.admin, "addUser", "al@acme.com", `{"participant-type":"employee", "organization":"acme"}`)
+
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "search-icon.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	for _, id := range []string{"ACME1", "ACME2"} {
+
+		f.mustInvoke(al, "DemandImage", demandJSON(id, ""))
+		f.mustInvoke(ann, "ApproveImageDemand", id)
+
+	}
+
+	// Another organization can license the same file, and a duplicate only names the organization's own image
+	f.mustInvoke(ann, "DeliverImage", "ACME1", "search-icon.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	if failure := f.mustFail(ann, CodeAlreadyExists, "DeliverImage", "ACME2", "copy.png", "sha256:" + emptyFileSHA256, "19.05.2017"); !strings.Contains(failure.Message, "ACME1") || strings.Contains(failure.Message, "IMG1") {
+
+		t.Fatalf("unexpected duplicate message %q", failure.Message)
+
+	}
+
+	for _, expected := range []struct{ creator []byte; id string }{{al, "ACME1"}, {f.bob, "IMG1"}} {
+
+		var verification HashVerification
+		json.Unmarshal(f.mustInvoke(expected.creator, "VerifyImageByHash", emptyFileSHA256), &verification)
+
+		if !verification.Licensed || verification.ImageID != expected.id {
+
+			t.Errorf("expected %v, got %+v", expected.id, verification)
+
+		}
+
+	}
+
+}
+
+func TestDeliverImageAcceptsLegacyDigestsWhenConfigured(t *testing.T) {
+
+	f := newFixture(t, `{"legacy-digests":true}`)
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "search-icon.png", "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709", "19.05.2017")
+
+	if image := f.image("IMG1"); image.Status != StatusDelivered || image.Hashes[HashSHA1] != "da39a3ee5e6b4b0d3255bfef95601890afd80709" {
+
+		t.Fatalf("expected a sha1-only delivery, got %+v", image)
+
+	}
+
+}
+
+//=======================================================================================================================
+//  FindSimilarImages
+//=======================================================================================================================
+
+func TestFindSimilarImages(t *testing.T) {
+
+	f := newFixture(t)
+
+	perceptualHashes := map[string]string{
+		"IMG1": "phash:0e0e0e0f0f0f0f0f",       // distance 3
+		"IMG2": "phash:0e0e0e0e0e0e0e0f",       // distance 7, one byte in common
+		"IMG3": "phash:00000c0f0f0f0f0f",       // distance 10
+		"IMG4": "dhash:0f0f0f0f0f0f0f0f",       // other algorithm
+	}
+
+	for i, id := range []string{"IMG1", "IMG2", "IMG3", "IMG4"} {
+
+		f.mustInvoke(f.alice, "DemandImage", demandJSON(id, ""))
+		f.mustInvoke(f.maria, "ApproveImageDemand", id)
+		f.mustInvoke(f.maria, "DeliverImage", id, id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64) + "," + perceptualHashes[id], "19.05.2017")
+
+	}
+
+	if image := f.image("IMG1"); image.PerceptualHash == nil || image.PerceptualHash.Algorithm != PerceptualPHash || image.PerceptualHash.Hash != "0e0e0e0f0f0f0f0f" {
+
+		t.Fatalf("unexpected perceptual hash %+v", image.PerceptualHash)
+
+	}
+
+	similar := func(args ...string) []string {
+
+		t.Helper()
+
+		var result struct {
+
+			Images  []SimilarImage  `json:"images"`
+
+		}
+
+		json.Unmarshal(f.mustInvoke(f.bob, "FindSimilarImages", args...), &result)
+
+		ids := []string{}
+
+		for _, image := range result.Images {
+
+			ids = append(ids, image.ImageID + ":" + strconv.Itoa(image.Distance))
+
+		}
+
+		return ids
+
+	}
+
+	// The default distance and distances below 8 use the index, larger ones scan
+	for args, expected := range map[string][]string{
+		"phash:0f0f0f0f0f0f0f0f":       {"IMG1:3"},
+		"phash:0f0f0f0f0f0f0f0f,7":     {"IMG1:3", "IMG2:7"},
+		"phash:0f0f0f0f0f0f0f0f,12":    {"IMG1:3", "IMG2:7", "IMG3:10"},
+		"PHASH:0E0E0E0F0F0F0F0F,0":     {"IMG1:0"},
+		"dhash:0f0f0f0f0f0f0f0f,64":    {"IMG4:0"},
+		"phash:f0f0f0f0f0f0f0f0":       {},
+	} {
+
+		if ids := similar(strings.Split(args, ",")...); !reflect.DeepEqual(ids, expected) {
+
+			t.Errorf("FindSimilarImages %v: expected %v, got %v", args, expected, ids)
+
+		}
+
+	}
+
+	f.mustFail(f.bob, CodeInvalidArgument, "FindSimilarImages", "phash:0f0f", "3")
+	f.mustFail(f.bob, CodeInvalidArgument, "FindSimilarImages", "ahash:0f0f0f0f0f0f0f0f")
+	f.mustFail(f.bob, CodeInvalidArgument, "FindSimilarImages", "phash:0f0f0f0f0f0f0f0f", "65")
+	f.mustFail(f.stranger, CodeForbidden, "FindSimilarImages", "phash:0f0f0f0f0f0f0f0f")
+
+	// Archiving an image removes its buckets
+	f.mustInvoke(f.maria, "ArchiveImage", "IMG1")
+
+	for key := range f.state {
+
+		if strings.HasPrefix(key, "\x00" + PerceptualIndexName + "\x00") && strings.HasSuffix(key, "\x00IMG1\x00") {
+
+			t.Fatalf("expected the perceptual hash of IMG1 to be removed from the index")
+
+		}
+
+	}
+
+	if ids := similar("phash:0f0f0f0f0f0f0f0f", "7"); !reflect.DeepEqual(ids, []string{"IMG2:7"}) {
+
+		t.Fatalf("expected only IMG2 to be similar, got %v", ids)
+
+	}
+
+	// A perceptual hash does not replace the digest of the file
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG5", ""))
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG5")
+	f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG5", "IMG5.png", "phash:0f0f0f0f0f0f0f0f", "19.05.2017")
+	f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG5", "IMG5.png", "sha256:" + strings.Repeat("5", 64) + ",phash:0f0f0f0f0f0f0f0f,dhash:0f0f0f0f0f0f0f0f", "19.05.2017")
+
+}
+
+//=======================================================================================================================
+//  CheckUsageAllowed
+//=======================================================================================================================
+
+const rightsManagedLicense = `{"type":"rights-managed", "media":["print","Web"], "territories":["de","FR"], "seats":5,
+	"start-date":"2017-05-01", "end-date":"2018-04-30", "attribution-required":true, "attribution":"Photo: ildogesto / iStock",
+	"provider-license-id":"IS-123456"}`
+
+func TestCheckUsageAllowed(t *testing.T) {
+
+	f := newFixture(t)
+
+	for i, id := range []string{"IMG1", "IMG2", "IMG3"} {
+
+		f.mustInvoke(f.alice, "DemandImage", demandJSON(id, ""))
+
+		if id != "IMG3" {
+
+			f.mustInvoke(f.maria, "ApproveImageDemand", id)
+
+		}
+
+		if id == "IMG1" {
+
+			f.mustInvoke(f.maria, "DeliverImage", id, id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64), "19.05.2017", "", rightsManagedLicense)
+
+		} else if id == "IMG2" {
+
+			f.mustInvoke(f.maria, "DeliverImage", id, id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64), "19.05.2017")
+
+		}
+
+	}
+
+	if license := f.image("IMG1").License; license == nil || license.Media[1] != "web" || license.Territories[0] != "DE" || license.Seats != 5 {
+
+		t.Fatalf("unexpected license %+v", license)
+
+	}
+
+	for args, expected := range map[string]bool{
+		"IMG1,print,DE,2017-06-01":         true,
+		"IMG1,web,fr":                      true,       // on the transaction date
+		"IMG1,advertising,DE,2017-06-01":   false,
+		"IMG1,print,US,2017-06-01":         false,
+		"IMG1,print,DE,2017-04-30":         false,
+		"IMG1,print,DE,2018-05-01":         false,
+		"IMG2,print,DE,2017-06-01":         false,      // no license recorded
+		"IMG3,print,DE,2017-06-01":         false,      // not delivered
+	} {
+
+		var check UsageCheck
+		json.Unmarshal(f.mustInvoke(f.alice, "CheckUsageAllowed", strings.Split(args, ",")...), &check)
+
+		if check.Allowed != expected || check.Allowed != (len(check.Reasons) == 0) {
+
+			t.Errorf("CheckUsageAllowed %v: expected %v, got %+v", args, expected, check)
+
+		}
+
+		if check.ImageID == "IMG1" && (!check.AttributionRequired || check.Attribution != "Photo: ildogesto / iStock") {
+
+			t.Errorf("CheckUsageAllowed %v: expected the attribution, got %+v", args, check)
+
+		}
+
+	}
+
+	failure := f.mustFail(f.alice, CodeInvalidArgument, "CheckUsageAllowed", "IMG1", "billboard", "worldwide", "01.06.2017")
+
+	if len(failure.Details) != 3 {
+
+		t.Fatalf("expected medium, territory and date to fail, got %+v", failure.Details)
+
+	}
+
+	f.mustFail(f.alice, CodeInvalidArgument, "CheckUsageAllowed", "IMG1", "print")
+	f.mustFail(f.maria, CodeNotFound, "CheckUsageAllowed", "UNKNOWN", "print", "DE")
+	f.mustFail(f.bob, CodeForbidden, "CheckUsageAllowed", "IMG1", "print", "DE")
+
+}
+
+func TestDeliverImageValidatesLicense(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+
+	deliver := func(license string) ChaincodeError {
+
+		t.Helper()
+
+		return f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG1", "IMG1.png", "sha256:" + emptyFileSHA256, "19.05.2017", "", license)
+
+	}
+
+	failure := deliver(`{"type":"editorial", "media":["advertising","tv"], "territories":["Germany"], "seats":0,
+		"start-date":"2017-05-01", "end-date":"2017-04-01", "attribution-required":true}`)
+
+	fields := []string{}
+
+	for _, detail := range failure.Details {
+
+		fields = append(fields, detail.Field)
+
+	}
+
+	expected := []string{"license.media", "license.media", "license.territories", "license.seats", "license.end-date", "license.attribution"}
+
+	if !reflect.DeepEqual(fields, expected) {
+
+		t.Fatalf("expected failures of %v, got %+v", expected, failure.Details)
+
+	}
+
+	deliver(`{"type":"rights-managed", "media":["print"], "territories":["DE"], "seats":1, "start-date":"2017-05-01"}`)
+	deliver(`{"type":"royalty-free", "media":["print"], "territories":["DE"], "seats":1, "start-date":"2017-05-01", "price":10}`)
+	deliver(`not json`)
+
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "IMG1.png", "sha256:" + emptyFileSHA256, "19.05.2017", "",
+		`{"type":"royalty-free", "media":["print"], "territories":["worldwide"], "seats":1, "start-date":"2017-05-01"}`)
+
+}
+
+//=======================================================================================================================
+//  GetExpiringLicenses and ExpireLicenses
+//=======================================================================================================================
+
+func licenseEnding(endDate string) string {
+
+	return `{"type":"rights-managed", "media":["web"], "territories":["DE"], "seats":1, "start-date":"2017-01-01", "end-date":"` + endDate + `"}`
+
+}
+
+func TestLicenseExpiry(t *testing.T) {
+
+	f := newFixture(t)
+
+	// The fixture's transactions run on 2017-05-19
+	endDates := map[string]string{"IMG1": "2017-05-18", "IMG2": "2017-05-19", "IMG3": "2017-06-30", "IMG4": "2018-01-15", "IMG5": ""}
+
+	for i, id := range []string{"IMG1", "IMG2", "IMG3", "IMG4", "IMG5"} {
+
+		license := licenseEnding(endDates[id])
+
+		if endDates[id] == "" {
+
+			license = `{"type":"royalty-free", "media":["web"], "territories":["DE"], "seats":1, "start-date":"2017-01-01"}`
+
+		}
+
+		f.mustInvoke(f.alice, "DemandImage", demandJSON(id, ""))
+		f.mustInvoke(f.maria, "ApproveImageDemand", id)
+		f.mustInvoke(f.maria, "DeliverImage", id, id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64), "19.05.2017", "", license)
+
+	}
+
+	expiring := func(from string, to string) []string {
+
+		t.Helper()
+
+		var result struct {
+
+			Licenses    []ExpiringLicense   `json:"licenses"`
+
+		}
+
+		json.Unmarshal(f.mustInvoke(f.maria, "GetExpiringLicenses", from, to), &result)
+
+		ids := []string{}
+
+		for _, license := range result.Licenses {
+
+			ids = append(ids, license.ImageID + ":" + license.EndDate)
+
+		}
+
+		return ids
+
+	}
+
+	if ids := expiring("2017-05-01", "2018-01-15"); !reflect.DeepEqual(ids, []string{"IMG1:2017-05-18", "IMG2:2017-05-19", "IMG3:2017-06-30", "IMG4:2018-01-15"}) {
+
+		t.Fatalf("unexpected expiring licenses %v", ids)
+
+	}
+
+	if ids := expiring("2017-05-19", "2017-12-31"); !reflect.DeepEqual(ids, []string{"IMG2:2017-05-19", "IMG3:2017-06-30"}) {
+
+		t.Fatalf("unexpected expiring licenses %v", ids)
+
+	}
+
+	// Only licenses that ended before the transaction date expire
+	var expired ExpiredLicenses
+	json.Unmarshal(f.mustInvoke(f.maria, "ExpireLicenses"), &expired)
+
+	if expired.Date != "2017-05-19" || !reflect.DeepEqual(expired.ImageIDs, []string{"IMG1"}) {
+
+		t.Fatalf("unexpected expired licenses %+v", expired)
+
+	}
+
+	if f.eventName != "ImageExpired" || !strings.Contains(string(f.event), `"image-id":"IMG1"`) {
+
+		t.Fatalf("expected an ImageExpired event, got %v %s", f.eventName, f.event)
+
+	}
+
+	image := f.image("IMG1")
+
+	if last := image.StatusChanges[len(image.StatusChanges)-1]; image.Status != StatusExpired || last.By != "maria@capgemini.com" || last.Reason != "License ended on 2017-05-18" {
+
+		t.Fatalf("unexpected image %+v", image)
+
+	}
+
+	if ids := expiring("2017-05-01", "2017-05-31"); !reflect.DeepEqual(ids, []string{"IMG2:2017-05-19"}) {
+
+		t.Fatalf("expected expired licenses to be dropped, got %v", ids)
+
+	}
+
+	// Nothing left to expire, and no event
+	json.Unmarshal(f.mustInvoke(f.admin, "ExpireLicenses"), &expired)
+
+	if len(expired.ImageIDs) != 0 || f.eventName != "" {
+
+		t.Fatalf("expected nothing to expire, got %+v", expired)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidArgument, "GetExpiringLicenses", "2017-06-01", "2017-05-01")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetExpiringLicenses", "2017-05-01", "9999-12-31")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetExpiringLicenses", "19.05.2017", "2017-05-01")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetExpiringLicenses", "2017-05-01")
+	f.mustFail(f.alice, CodeForbidden, "GetExpiringLicenses", "2017-05-01", "2017-06-01")
+	f.mustFail(f.alice, CodeForbidden, "ExpireLicenses")
+
+}
+
+//=======================================================================================================================
+//  RecordImagePurchase and GetImagePurchaseRecord
+//=======================================================================================================================
+
+func TestPurchaseRecords(t *testing.T) {
+
+	f := newFixture(t)
+	olga := newIdentity(t, "Org2MSP", "olga", map[string]string{UsernameAttribute: "olga@globex.com"})
+
+	f.mustInvoke(f.admin, "AddOrganization", "globex", `{"name":"Globex", "msp-id":"Org2MSP", "billing-contact":"billing@globex.com"}`)
+	f.mustInvoke(f.admin, "addUser", "olga@globex.com", `{"participant-type":"marketing", "organization":"globex"}`)
+
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG2", ""))
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "IMG1.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	record := func(recordAsJSON string) {
+
+		f.transient = map[string][]byte{PurchaseRecordTransientKey: []byte(recordAsJSON)}
+
+	}
+
+	// The record is only accepted as transient data
+	f.mustFail(f.maria, CodeInvalidArgument, "RecordImagePurchase", "IMG1")
+
+	record(`{"price":-1, "currency":"euro", "msp-id":"Org2MSP"}`)
+
+	if failure := f.mustFail(f.maria, CodeInvalidArgument, "RecordImagePurchase", "IMG1"); len(failure.Details) != 5 {
+
+		t.Fatalf("expected price, currency, invoice number, cost center and msp-id to fail, got %+v", failure.Details)
+
+	}
+
+	purchase := `{"price":4900, "currency":"eur", "invoice-number":"INV-2017-0815", "provider-contract":"iStock 2017/3", "cost-center":"CC-4711"}`
+
+	record(purchase)
+	f.mustFail(f.maria, CodeInvalidState, "RecordImagePurchase", "IMG2")
+	record(purchase)
+	f.mustFail(f.alice, CodeForbidden, "RecordImagePurchase", "IMG1")
+
+	record(purchase)
+
+	var link PurchaseRecordLink
+	json.Unmarshal(f.mustInvoke(f.maria, "RecordImagePurchase", "IMG1"), &link)
+
+	key, _ := createCompositeKey(PurchaseRecordsIndexName, []string{"IMG1"})
+	stored := f.private["purchasesOrg1MSP"][key]
+	digest := sha256.Sum256(stored)
+
+	if link.MSPID != "Org1MSP" || link.Collection != "purchasesOrg1MSP" || link.Hash != hex.EncodeToString(digest[:]) {
+
+		t.Fatalf("unexpected link %+v to %s", link, stored)
+
+	}
+
+	if image := f.image("IMG1"); image.PurchaseRecord == nil || *image.PurchaseRecord != link {
+
+		t.Fatalf("expected the image to link to the record, got %+v", image.PurchaseRecord)
+
+	}
+
+	// Nothing but the hash is on the public ledger
+	for key, value := range f.state {
+
+		if strings.Contains(string(value), "INV-2017-0815") || strings.Contains(string(value), "CC-4711") {
+
+			t.Fatalf("purchase details stored publicly under %q", key)
+
+		}
+
+	}
+
+	var read ImagePurchaseRecord
+	json.Unmarshal(f.mustInvoke(f.maria, "GetImagePurchaseRecord", "IMG1"), &read)
+
+	if read.ImageID != "IMG1" || read.Price != 4900 || read.Currency != "EUR" || read.MSPID != "Org1MSP" || read.RecordedBy != "maria@capgemini.com" {
+
+		t.Fatalf("unexpected record %+v", read)
+
+	}
+
+	// Other organizations can neither read nor replace it
+	f.mustFail(olga, CodeForbidden, "GetImagePurchaseRecord", "IMG1")
+	record(purchase)
+	f.mustFail(olga, CodeForbidden, "RecordImagePurchase", "IMG1")
+	f.mustFail(f.alice, CodeForbidden, "GetImagePurchaseRecord", "IMG1")
+	f.mustFail(f.maria, CodeNotFound, "GetImagePurchaseRecord", "IMG2")
+
+	f.private["purchasesOrg1MSP"][key] = []byte(strings.Replace(string(stored), "4900", "49", 1))
+	f.mustFail(f.maria, CodeInternal, "GetImagePurchaseRecord", "IMG1")
+
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":"IMG3", "url":"https://example.com/a.png", "purchase-record":{}}`)
+
+}
+
+func TestPurchaseRecordsNeedTheCollectionOfTheOrganization(t *testing.T) {
+
+	f := newFixture(t)
+	ian := newIdentity(t, "Org3MSP", "ian", map[string]string{UsernameAttribute: "ian@initech.com"})
+	ida := newIdentity(t, "Org3MSP", "ida", map[string]string{UsernameAttribute: "ida@initech.com"})
+
+	f.mustInvoke(f.admin, "AddOrganization", "initech", `{"name":"Initech", "msp-id":"Org3MSP", "billing-contact":"billing@initech.com"}`)
+	f.mustInvoke(f.admin, "addUser", "ian@initech.com", `{"participant-type":"marketing", "organization":"initech"}`)
+	f.mustInvoke(f.admin, "addUser", "ida@initech.com", `{"participant-type":"employee", "organization":"initech"}`)
+
+	f.mustInvoke(ida, "DemandImage", demandJSON("INI1", ""))
+	f.mustInvoke(ian, "ApproveImageDemand", "INI1")
+	f.mustInvoke(ian, "DeliverImage", "INI1", "INI1.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	// collections_config.json has no purchasesOrg3MSP
+	f.transient = map[string][]byte{PurchaseRecordTransientKey: []byte(`{"price":4900, "currency":"EUR", "invoice-number":"INV-1", "cost-center":"CC-1"}`)}
+
+	if failure := f.mustFail(ian, CodeInvalidState, "RecordImagePurchase", "INI1"); !strings.Contains(failure.Message, "purchasesOrg3MSP") {
+
+		t.Fatalf("expected the missing collection to be named, got %q", failure.Message)
+
+	}
+
+}
+
+//=======================================================================================================================
+//  TransferImageLicense
+//=======================================================================================================================
+
+func TestTransferImageLicense(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustInvoke(f.admin, "addUser", "carl@capgemini.com", `{"participant-type":"employee", "department":"Sales"}`)
+
+	transferable := strings.Replace(rightsManagedLicense, `"seats":5`, `"seats":5, "transferable":true`, 1)
+
+	for i, id := range []string{"IMG1", "IMG2", "IMG3"} {
+
+		f.mustInvoke(f.alice, "DemandImage", demandJSON(id, ""))
+
+		if id != "IMG2" {
+
+			f.mustInvoke(f.maria, "ApproveImageDemand", id)
+
+		}
+
+		if id == "IMG3" {
+
+			f.mustInvoke(f.maria, "DeliverImage", id, id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64), "19.05.2017", "", transferable)
+
+		}
+
+	}
+
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "IMG1.png", "sha256:" + emptyFileSHA256, "19.05.2017", "", rightsManagedLicense)
+
+	f.mustFail(f.bob, CodeForbidden, "TransferImageLicense", "IMG2", "bob@capgemini.com", "Taking over")
+	f.mustFail(f.alice, CodeInvalidArgument, "TransferImageLicense", "IMG2", "bob@capgemini.com", " ")
+	f.mustFail(f.alice, CodeNotFound, "TransferImageLicense", "IMG2", "nobody@capgemini.com", "Leaving")
+	f.mustFail(f.alice, CodeInvalidArgument, "TransferImageLicense", "IMG2", "alice@capgemini.com", "Leaving")
+	f.mustFail(f.alice, CodeInvalidState, "TransferImageLicense", "IMG1", "bob@capgemini.com", "Leaving")
+
+	f.mustInvoke(f.alice, "TransferImageLicense", "IMG2", "bob@capgemini.com", "Project handover")
+
+	if event := f.eventName; event != LicenseTransferredEvent || !strings.Contains(string(f.event), `"previous-user":"alice@capgemini.com"`) {
+
+		t.Fatalf("unexpected event %v %s", event, f.event)
+
+	}
+
+	// Privileged users can transfer licenses of others, the chain keeps every owner
+	var transfer OwnershipTransfer
+	json.Unmarshal(f.mustInvoke(f.maria, "TransferImageLicense", "IMG3", "bob@capgemini.com", "Alice left"), &transfer)
+	f.mustInvoke(f.bob, "TransferImageLicense", "IMG3", "carl@capgemini.com", "Moved to Sales")
+
+	if transfer.From != "alice@capgemini.com" || transfer.By != "maria@capgemini.com" || transfer.TxID == "" || transfer.At == "" {
+
+		t.Fatalf("unexpected transfer %+v", transfer)
+
+	}
+
+	image := f.image("IMG3")
+
+	if image.User != "carl@capgemini.com" || len(image.OwnershipChain) != 2 || image.OwnershipChain[0] != transfer {
+
+		t.Fatalf("unexpected ownership chain %+v", image.OwnershipChain)
+
+	}
+
+	if last := image.OwnershipChain[1]; last.From != "bob@capgemini.com" || last.To != "carl@capgemini.com" || last.ToDepartment != "Sales" || last.Reason != "Moved to Sales" {
+
+		t.Fatalf("unexpected transfer %+v", last)
+
+	}
+
+	// The user index follows the owner
+	if images := f.imagePage(f.maria, "GetImagesByUser", "alice@capgemini.com").Items; len(images) != 1 || images[0].ID != "IMG1" {
+
+		t.Fatalf("expected only IMG1 to remain with alice, got %+v", images)
+
+	}
+
+	if images := f.imagePage(f.maria, "GetImagesByUser", "bob@capgemini.com").Items; len(images) != 1 || images[0].ID != "IMG2" {
+
+		t.Fatalf("expected bob to own IMG2, got %+v", images)
+
+	}
+
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":"IMG4", "url":"https://example.com/a.png", "ownership-chain":[]}`)
+
+}
+
+//=======================================================================================================================
+//  RevokeImageLicense and GetRevokedImages
+//=======================================================================================================================
+
+func TestRevokeImageLicense(t *testing.T) {
+
+	f := newFixture(t)
+	evidence := "sha256:" + strings.Repeat("ab", 32)
+
+	for _, id := range []string{"IMG1", "IMG2"} {
+
+		f.mustInvoke(f.alice, "DemandImage", demandJSON(id, ""))
+		f.mustInvoke(f.maria, "ApproveImageDemand", id)
+
+	}
+
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "IMG1.png", "sha256:" + emptyFileSHA256, "19.05.2017", "", rightsManagedLicense)
+
+	f.mustFail(f.alice, CodeForbidden, "RevokeImageLicense", "IMG1", "Withdrawn by iStock", evidence)
+	f.mustFail(f.maria, CodeInvalidArgument, "RevokeImageLicense", "IMG1", "", evidence)
+	f.mustFail(f.maria, CodeInvalidArgument, "RevokeImageLicense", "IMG1", "Withdrawn by iStock", "not-a-digest")
+	f.mustFail(f.maria, CodeInvalidState, "RevokeImageLicense", "IMG2", "Withdrawn by iStock", evidence)
+
+	var revocation Revocation
+	json.Unmarshal(f.mustInvoke(f.maria, "RevokeImageLicense", "IMG1", "Withdrawn by iStock", evidence), &revocation)
+
+	if revocation.Reason != "Withdrawn by iStock" || revocation.Evidence != evidence || revocation.By != "maria@capgemini.com" || revocation.TxID != f.txID {
+
+		t.Fatalf("unexpected revocation %+v", revocation)
+
+	}
+
+	if f.eventName != "ImageRevoked" || !strings.Contains(string(f.event), `"reason":"Withdrawn by iStock"`) {
+
+		t.Fatalf("expected ImageRevoked, got %v %s", f.eventName, f.event)
+
+	}
+
+	if image := f.image("IMG1"); image.Status != StatusRevoked || image.Revocation == nil || *image.Revocation != revocation {
+
+		t.Fatalf("unexpected image %+v", image)
+
+	}
+
+	// Verification fails instead of reporting the file as unlicensed
+	if failure := f.mustFail(f.alice, CodeRevoked, "VerifyImageByHash", "sha256:" + emptyFileSHA256); !strings.Contains(failure.Message, "Withdrawn by iStock") {
+
+		t.Fatalf("expected the reason in %q", failure.Message)
+
+	}
+
+	f.mustFail(f.alice, CodeRevoked, "CheckUsageAllowed", "IMG1", "web", "DE")
+	f.mustFail(f.maria, CodeInvalidState, "RevokeImageLicense", "IMG1", "Withdrawn by iStock", evidence)
+
+	if page := f.imagePage(f.maria, "GetRevokedImages"); len(page.Items) != 1 || page.Items[0].ID != "IMG1" {
+
+		t.Fatalf("expected IMG1 to be revoked, got %+v", page.Items)
+
+	}
+
+	// Archiving a revoked image keeps it in the list
+	f.mustInvoke(f.maria, "ArchiveImage", "IMG1")
+
+	for _, creator := range [][]byte{f.maria, f.admin} {
+
+		if page := f.imagePage(creator, "GetRevokedImages"); len(page.Items) != 1 || page.Items[0].Status != StatusArchived || page.TotalCount != 1 {
+
+			t.Fatalf("expected the archived IMG1 to stay revoked, got %+v", page.Items)
+
+		}
+
+	}
+
+	f.mustFail(f.alice, CodeForbidden, "GetRevokedImages")
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":"IMG3", "url":"https://example.com/a.png", "revocation":{}}`)
+
+}
+
+//=======================================================================================================================
+//  Organizations
+//=======================================================================================================================
+
+func TestOrganizations(t *testing.T) {
+
+	f := newFixture(t)
+	ann := newIdentity(t, "Org1MSP", "ann", map[string]string{UsernameAttribute: "ann@acme.com"})
+	al := newIdentity(t, "Org1MSP", "al", map[string]string{UsernameAttribute: "al@acme.com"})
+	gus := newIdentity(t, "Org2MSP", "gus", map[string]string{UsernameAttribute: "gus@globex.com"})
+
+	if failure := f.mustFail(f.admin, CodeInvalidArgument, "AddOrganization", "acme", `{"name":" "}`); len(failure.Details) != 3 {
+
+		t.Fatalf("expected name, msp-id and billing-contact to fail, got %+v", failure.Details)
+
+	}
+
+	f.mustFail(f.maria, CodeForbidden, "AddOrganization", "acme", `{"name":"ACME", "msp-id":"Org1MSP", "billing-contact":"billing@acme.com"}`)
+	f.mustInvoke(f.admin, "AddOrganization", "acme", `{"name":"ACME", "msp-id":"Org1MSP", "billing-contact":"billing@acme.com"}`)
+	f.mustInvoke(f.admin, "AddOrganization", "globex", `{"name":"Globex", "msp-id":"Org2MSP", "billing-contact":"billing@globex.com"}`)
+	f.mustFail(f.admin, CodeAlreadyExists, "AddOrganization", "acme", `{"name":"ACME", "msp-id":"Org1MSP", "billing-contact":"billing@acme.com"}`)
+	f.mustFail(f.admin, CodeAlreadyExists, "AddOrganization", "initech", `{"name":"Initech", "msp-id":"Org2MSP", "billing-contact":"billing@initech.com"}`)
+
+	f.mustFail(f.admin, CodeInvalidArgument, "addUser", "ann@acme.com", `{"participant-type":"marketing", "organization":"initech"}`)
+	f.mustFail(f.admin, CodeInvalidArgument, "addUser", "ann@acme.com", `{"participant-type":"marketing", "organization":"acme", "msp-id":"Org2MSP", "identity":"x509::CN=ann"}`)
+	f.mustInvoke(f.admin, "addUser", "ann@acme.com", `{"participant-type":"marketing", "organization":"acme"}`)
+	f.mustInvoke(f.admin, "addUser", "al@acme.com", `{"participant-type":"employee", "organization":"acme"}`)
+	f.mustInvoke(f.admin, "addUser", "gus@globex.com", `{"participant-type":"marketing", "organization":"globex"}`)
+
+	f.mustInvoke(al, "DemandImage", demandJSON("ACME1", ""))
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+
+	var image Image
+	json.Unmarshal(f.mustInvoke(ann, "getImage", "ACME1"), &image)
+
+	if image.Organization != "acme" {
+
+		t.Fatalf("expected ACME1 to belong to acme, got %q", image.Organization)
+
+	}
+
+	// Cross-organization reads and writes are denied
+	f.mustFail(ann, CodeForbidden, "getImage", "IMG1")
+	f.mustFail(gus, CodeForbidden, "getImage", "ACME1")
+	f.mustFail(f.maria, CodeForbidden, "getImage", "ACME1")
+	f.mustFail(f.maria, CodeForbidden, "ApproveImageDemand", "ACME1")
+	f.mustFail(gus, CodeForbidden, "GetImagesByUser", "al@acme.com")
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":"IMG2", "url":"https://example.com/a.png", "organization":"acme"}`)
+
+	if images := f.images(f.maria, "GetPendingApprovals"); len(images) != 1 || images[0].ID != "IMG1" {
+
+		t.Fatalf("expected only IMG1 to be pending for maria, got %+v", images)
+
+	}
+
+	f.mustInvoke(ann, "ApproveImageDemand", "ACME1")
+	f.mustFail(al, CodeForbidden, "TransferImageLicense", "ACME1", "bob@capgemini.com", "Leaving")
+
+	// Lists only hold the caller's organization, network admins see all
+	idsOf := func(page imagePage) string {
+
+		var ids []string
+
+		for _, image := range page.Items {
+
+			ids = append(ids, image.ID)
+
+		}
+
+		return strings.Join(ids, ",")
+
+	}
+
+	expected := map[string][]byte{"ACME1": ann, "IMG1": f.maria, "ACME1,IMG1": f.admin, "": gus}
+
+	for ids, creator := range expected {
+
+		for _, couchDB := range []bool{false, true} {
+
+			f.couchDB = couchDB
+
+			if got := idsOf(f.imagePage(creator, "QueryImages", `{"author":"ildogesto"}`)); got != ids {
+
+				t.Errorf("couchDB %v: expected %v, got %v", couchDB, ids, got)
+
+			}
+
+		}
+
+		if got := idsOf(f.imagePage(creator, "GetImagesByAuthor", "ildogesto")); got != ids {
+
+			t.Errorf("expected %v by author, got %v", ids, got)
+
+		}
+
+	}
+
+	if page := f.imagePage(ann, "GetImagesByOrganization", "acme"); len(page.Items) != 1 || page.Items[0].ID != "ACME1" {
+
+		t.Fatalf("unexpected images of acme %+v", page.Items)
+
+	}
+
+	f.mustFail(gus, CodeForbidden, "GetImagesByOrganization", "acme")
+	f.mustFail(f.admin, CodeNotFound, "GetImagesByOrganization", "initech")
+
+	var users struct {
+
+		Items       []User      `json:"items"`
+
+	}
+
+	json.Unmarshal(f.mustInvoke(ann, "GetUsersByOrganization", "acme"), &users)
+
+	if len(users.Items) != 2 || users.Items[0].Username != "al@acme.com" || users.Items[1].Organization != "acme" {
+
+		t.Fatalf("unexpected users of acme %+v", users.Items)
+
+	}
+
+	json.Unmarshal(f.mustInvoke(gus, "getUsers"), &users)
+
+	if len(users.Items) != 1 || users.Items[0].Username != "gus@globex.com" {
+
+		t.Fatalf("expected gus to see only globex users, got %+v", users.Items)
+
+	}
+
+	var organization Organization
+	json.Unmarshal(f.mustInvoke(al, "GetOrganization", "acme"), &organization)
+
+	if organization.Name != "ACME" || organization.MSPID != "Org1MSP" || organization.BillingContact != "billing@acme.com" {
+
+		t.Fatalf("unexpected organization %+v", organization)
+
+	}
+
+	f.mustFail(gus, CodeForbidden, "GetOrganization", "acme")
+
+}
+
+func TestAdminsOfOtherMSPsAreBoundToTheirOrganization(t *testing.T) {
+
+	f := newFixture(t, `{"admin-msps":["Org1MSP", "Org2MSP"], "network-admin-msps":["Org1MSP"]}`)
+	gus := newIdentity(t, "Org2MSP", "gus", map[string]string{UsernameAttribute: "gus@globex.com"})
+	gina := newIdentity(t, "Org2MSP", "gina", map[string]string{UsernameAttribute: "gina@globex.com"})
+	root := newIdentity(t, "Org2MSP", "root", map[string]string{RoleAttribute: ParticipantAdmin})
+
+	f.mustInvoke(f.admin, "AddOrganization", "globex", `{"name":"Globex", "msp-id":"Org2MSP", "billing-contact":"billing@globex.com"}`)
+	f.mustInvoke(f.admin, "addUser", "gus@globex.com", `{"participant-type":"employee", "organization":"globex"}`)
+	f.mustInvoke(f.admin, "addUser", "gina@globex.com", `{"participant-type":"marketing", "organization":"globex"}`)
+
+	for i, demand := range []struct{ id string; creator, approver []byte }{{"GLX1", gus, gina}, {"IMG1", f.alice, f.maria}} {
+
+		f.mustInvoke(demand.creator, "DemandImage", demandJSON(demand.id, ""))
+		f.mustInvoke(demand.approver, "ApproveImageDemand", demand.id)
+		f.mustInvoke(demand.approver, "DeliverImage", demand.id, demand.id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64), "19.05.2017", "", licenseEnding("2017-05-18"))
+
+	}
+
+	var caller Caller
+	json.Unmarshal(f.mustInvoke(root, "WhoAmI"), &caller)
+
+	if caller.Role != ParticipantAdmin || caller.Organization != "globex" || caller.IsNetworkAdmin() {
+
+		t.Fatalf("expected an admin of globex, got %+v", caller)
+
+	}
+
+	f.mustFail(root, CodeForbidden, "AddOrganization", "initech", `{"name":"Initech", "msp-id":"Org3MSP", "billing-contact":"billing@initech.com"}`)
+	f.mustFail(root, CodeForbidden, "MigrateLegacyIndexes")
+	f.mustFail(root, CodeForbidden, "getImage", "IMG1")
+	f.mustFail(root, CodeForbidden, "addUser", "carl@capgemini.com", `{"participant-type":"admin"}`)
+
+	if page := f.imagePage(root, "GetImages"); len(page.Items) != 1 || page.Items[0].ID != "GLX1" {
+
+		t.Fatalf("expected root to see only the images of globex, got %+v", page.Items)
+
+	}
+
+	// Expiring licenses leaves those of other organizations alone
+	var expired ExpiredLicenses
+	json.Unmarshal(f.mustInvoke(root, "ExpireLicenses"), &expired)
+
+	if !reflect.DeepEqual(expired.ImageIDs, []string{"GLX1"}) || f.image("IMG1").Status != StatusDelivered {
+
+		t.Fatalf("expected only GLX1 to expire, got %+v", expired)
+
+	}
+
+	// ...and hands them to their organization, so repeated calls do not read them again
+	expiryKey, _ := createCompositeKey(ExpiryIndexName, []string{"2017", "05", "18", "IMG1"})
+	dueKey, _ := createCompositeKey(DueExpiryIndexName, []string{"", "IMG1"})
+
+	if f.state[expiryKey] != nil || string(f.state[dueKey]) != "2017-05-18" {
+
+		t.Fatalf("expected the expiry of IMG1 to be due for the default organization")
+
+	}
+
+	for _, creator := range [][]byte{root, f.maria, f.admin} {
+
+		expected := map[string][]string{string(root): {}, string(f.maria): {"IMG1"}, string(f.admin): {}}[string(creator)]
+		json.Unmarshal(f.mustInvoke(creator, "ExpireLicenses"), &expired)
+
+		if !reflect.DeepEqual(expired.ImageIDs, expected) {
+
+			t.Fatalf("expected %v to expire, got %+v", expected, expired)
+
+		}
+
+	}
+
+	if f.state[dueKey] != nil || f.image("IMG1").Status != StatusExpired {
+
+		t.Fatalf("expected IMG1 to be expired and no longer due")
+
+	}
+
+}
+
+//=======================================================================================================================
+//  Budgets
+//=======================================================================================================================
+
+func TestBudgets(t *testing.T) {
+
+	f := newFixture(t)
+	carl := newIdentity(t, "Org1MSP", "carl", map[string]string{UsernameAttribute: "carl@capgemini.com"})
+	eve := newIdentity(t, "Org1MSP", "eve", map[string]string{UsernameAttribute: "eve@capgemini.com"})
+	f.mustInvoke(f.admin, "addUser", "carl@capgemini.com", `{"participant-type":"employee", "department":"Sales"}`)
+	f.mustInvoke(f.admin, "addUser", "eve@capgemini.com", `{"participant-type":"employee", "department":"Design"}`)
+
+	// The price is transient data of the demand
+	priced := func(id string, price string, currency string) string {
+
+		f.transient = map[string][]byte{PriceTransientKey: []byte(`{"price":` + price + `, "currency":"` + currency + `"}`)}
+
+		return demandJSON(id, "")
+
+	}
+
+	// The budget is transient data too
+	budget := func(period string, budgetAsJSON string) string {
+
+		f.transient = map[string][]byte{BudgetTransientKey: []byte(budgetAsJSON)}
+
+		return period
+
+	}
+
+	status := func(creator []byte, department string, period string) BudgetStatus {
+
+		var status BudgetStatus
+		json.Unmarshal(f.mustInvoke(creator, "GetBudgetStatus", department, period), &status)
+
+		return status
+
+	}
+
+	if failure := f.mustFail(f.maria, CodeInvalidArgument, "SetBudget", "Sales", budget("May", `{"amount":-1, "currency":"euro"}`)); len(failure.Details) != 3 {
+
+		t.Fatalf("expected period, amount and currency to fail, got %+v", failure.Details)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidArgument, "SetBudget", "Sales", "2017-05")
+	f.mustFail(carl, CodeForbidden, "SetBudget", "Sales", budget("2017-05", `{"amount":10000, "currency":"EUR"}`))
+	f.mustInvoke(f.maria, "SetBudget", "Sales", budget("2017-05", `{"amount":10000, "currency":"eur"}`))
+	f.mustInvoke(f.maria, "SetBudget", "Design", budget("2017", `{"amount":500, "currency":"EUR"}`))
+
+	f.mustFail(carl, CodeInvalidArgument, "DemandImage", priced("IMG1", "-1", "EUR"))
+	f.mustFail(carl, CodeInvalidArgument, "DemandImage", priced("IMG1", "6000", ""))
+	f.mustFail(carl, CodeInvalidArgument, "DemandImage", priced("IMG1", "6000", "USD"))
+	f.mustFail(carl, CodeInvalidArgument, "DemandImage", `{"id":"IMG1", "url":"https://example.com/a.png", "budget-reservation":{}}`)
+	f.mustFail(carl, CodeInvalidArgument, "DemandImage", `{"id":"IMG1", "url":"https://example.com/a.png", "price":6000, "currency":"EUR"}`)
+
+	f.mustInvoke(carl, "DemandImage", priced("IMG1", "6000", "EUR"))
+
+	if failure := f.mustFail(carl, CodeBudgetExceeded, "DemandImage", priced("IMG2", "5000", "EUR")); !strings.Contains(failure.Message, "4000 EUR") {
+
+		t.Fatalf("expected the remaining amount in %q", failure.Message)
+
+	}
+
+	f.mustInvoke(carl, "DemandImage", priced("IMG2", "3000", "EUR"))
+
+	if budget := status(carl, "Sales", "2017-05"); budget.Reserved != 9000 || budget.Spent != 0 || budget.Remaining != 1000 {
+
+		t.Fatalf("unexpected budget after demands %+v", budget)
+
+	}
+
+	// The month has no budget for Design, the year has
+	f.mustFail(eve, CodeBudgetExceeded, "DemandImage", priced("IMG3", "600", "EUR"))
+
+	// Departments without a budget and unpriced demands are not limited
+	f.mustInvoke(f.alice, "DemandImage", priced("IMG4", "100000", "EUR"))
+	f.mustInvoke(carl, "DemandImage", demandJSON("IMG5", ""))
+
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "IMG1.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+	f.mustInvoke(f.maria, "RejectImageDemand", "IMG2", "Too expensive")
+
+	if budget := status(f.maria, "Sales", "2017-05"); budget.Reserved != 0 || budget.Spent != 6000 || budget.Remaining != 4000 || budget.Currency != "EUR" {
+
+		t.Fatalf("unexpected budget after delivery and rejection %+v", budget)
+
+	}
+
+	if reservation := f.image("IMG1").BudgetReservation; reservation == nil || reservation.State != ReservationConsumed || reservation.Collection != "purchasesOrg1MSP" {
+
+		t.Fatalf("unexpected reservation of IMG1 %+v", reservation)
+
+	}
+
+	// The price stays off the public ledger
+	key, _ := createCompositeKey(ReservationsIndexName, []string{"IMG1"})
+	imageKey, _ := createCompositeKey(ImagesIndexName, []string{"IMG1"})
+
+	if amount := string(f.private["purchasesOrg1MSP"][key]); amount != `{"image-id":"IMG1","amount":6000}` || strings.Contains(string(f.state[imageKey]), "6000") {
+
+		t.Fatalf("expected the amount only in the private collection, got %s and image %s", amount, f.state[imageKey])
+
+	}
+
+	// So do the budget totals, which would reveal every price in their history
+	budgetKey, _ := createCompositeKey(BudgetsIndexName, []string{"", "Sales", "2017-05"})
+
+	if f.state[budgetKey] != nil || f.private["purchasesOrg1MSP"][budgetKey] == nil {
+
+		t.Fatalf("expected the budget only in the private collection")
+
+	}
+
+	if reservation := f.image("IMG2").BudgetReservation; reservation == nil || reservation.State != ReservationReleased {
+
+		t.Fatalf("unexpected reservation of IMG2 %+v", reservation)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidState, "SetBudget", "Sales", budget("2017-05", `{"amount":10000, "currency":"USD"}`))
+	f.mustFail(carl, CodeForbidden, "GetBudgetStatus", "Design", "2017")
+	f.mustFail(f.maria, CodeNotFound, "GetBudgetStatus", "Sales", "2018")
+
+}
+
+//=======================================================================================================================
+//  Provider registry
+//=======================================================================================================================
+
+func TestProviderRegistry(t *testing.T) {
+
+	f := newFixture(t)
+
+	istock := `{"name":"iStock", "domains":["www.iStockphoto.com"], "url-patterns":["^https?://([a-z]+\\.)?istockphoto\\.com/.*-gm(?P<asset>[0-9]+)-[0-9]+$"], "license-types":["royalty-free", "editorial"]}`
+
+	invalid := `{"name":" ", "domains":["not a domain"], "url-patterns":["(", "^https://example.com/([0-9]+)$"], "license-types":["lifetime"]}`
+
+	if failure := f.mustFail(f.admin, CodeInvalidArgument, "AddProvider", "istock", invalid); len(failure.Details) != 5 {
+
+		t.Fatalf("expected name, domains, both patterns and license types to fail, got %+v", failure.Details)
+
+	}
+
+	f.mustFail(f.maria, CodeForbidden, "AddProvider", "istock", istock)
+	f.mustInvoke(f.admin, "AddProvider", "istock", istock)
+	f.mustFail(f.admin, CodeAlreadyExists, "AddProvider", "istock", istock)
+	f.mustFail(f.admin, CodeNotFound, "UpdateProvider", "getty", istock)
+
+	asset := func(id string, assetID string) string {
+
+		return `{"id":"` + id + `", "url":"https://www.istockphoto.com/photo/sunset-gm` + assetID + `-4711"}`
+
+	}
+
+	// The provider and asset ID are taken from the URL
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+
+	if image := f.image("IMG1"); image.Provider != "istock" || image.ProviderAssetID != "509786662" {
+
+		t.Fatalf("expected iStock asset 509786662, got %q %q", image.Provider, image.ProviderAssetID)
+
+	}
+
+	f.mustFail(f.bob, CodeAlreadyExists, "DemandImage", demandJSON("IMG2", ""))
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":"IMG2", "url":"https://www.istockphoto.com/about"}`)
+	f.mustFail(f.alice, CodeInvalidArgument, "DemandImage", `{"id":"IMG2", "url":"https://example.com/a.png", "provider":"istock"}`)
+
+	f.mustInvoke(f.alice, "DemandImage", `{"id":"IMG2", "url":"https://example.com/a.png"}`)
+
+	if image := f.image("IMG2"); image.Provider != "" || image.ProviderAssetID != "" {
+
+		t.Fatalf("expected no provider for IMG2, got %+v", image)
+
+	}
+
+	// A rejected demand frees the asset
+	f.mustInvoke(f.alice, "DemandImage", asset("IMG3", "123"))
+	f.mustFail(f.bob, CodeAlreadyExists, "DemandImage", asset("IMG4", "123"))
+	f.mustInvoke(f.maria, "RejectImageDemand", "IMG3", "Wrong picture")
+	f.mustInvoke(f.bob, "DemandImage", asset("IMG4", "123"))
+
+	if page := f.imagePage(f.maria, "GetImagesByProvider", "istock"); page.TotalCount != 3 {
+
+		t.Fatalf("expected 3 iStock images, got %+v", page.Items)
+
+	}
+
+	if page := f.imagePage(f.maria, "GetImagesByProvider", "www.example.com"); len(page.Items) != 1 || page.Items[0].ID != "IMG2" {
+
+		t.Fatalf("expected IMG2 by host, got %+v", page.Items)
+
+	}
+
+	if page := f.imagePage(f.maria, "QueryImages", `{"provider":"istock", "status":"Demanded"}`); page.TotalCount != 2 {
+
+		t.Fatalf("expected IMG1 and IMG4, got %+v", page.Items)
+
+	}
+
+	// Queries fall back to the host of images without provider, like GetImagesByProvider
+	for _, couchDB := range []bool{false, true} {
+
+		f.couchDB = couchDB
+
+		if page := f.imagePage(f.maria, "QueryImages", `{"provider":"example.com"}`); len(page.Items) != 1 || page.Items[0].ID != "IMG2" {
+
+			t.Errorf("couchDB %v: expected IMG2 by host, got %+v", couchDB, page.Items)
+
+		}
+
+	}
+
+	f.couchDB = false
+
+	// Other organizations demand the same asset on their own
+	gus := newIdentity(t, "Org2MSP", "gus", map[string]string{UsernameAttribute: "gus@globex.com"})
+	f.mustInvoke(f.admin, "AddOrganization", "globex", `{"name":"Globex", "msp-id":"Org2MSP", "billing-contact":"billing@globex.com"}`)
+	f.mustInvoke(f.admin, "addUser", "gus@globex.com", `{"participant-type":"employee", "organization":"globex"}`)
+
+	if failure := f.mustFail(f.alice, CodeAlreadyExists, "DemandImage", asset("IMG5", "123")); !strings.Contains(failure.Message, "IMG4") {
+
+		t.Fatalf("expected the image of the organization in %q", failure.Message)
+
+	}
+
+	f.mustInvoke(gus, "DemandImage", asset("GLX1", "123"))
+
+	// Deliveries are limited to the license types the provider offers
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG1", "IMG1.png", "sha256:" + emptyFileSHA256, "19.05.2017", "", rightsManagedLicense)
+	f.mustInvoke(f.admin, "UpdateProvider", "istock", strings.Replace(istock, `"editorial"`, `"editorial", "rights-managed"`, 1))
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "IMG1.png", "sha256:" + emptyFileSHA256, "19.05.2017", "", rightsManagedLicense)
+
+	// A revoked license frees the asset too
+	f.mustFail(f.bob, CodeAlreadyExists, "DemandImage", demandJSON("IMG6", ""))
+	f.mustInvoke(f.maria, "RevokeImageLicense", "IMG1", "Takedown notice", "sha256:" + strings.Repeat("a", 64))
+	f.mustInvoke(f.bob, "DemandImage", demandJSON("IMG6", ""))
+
+	var providers map[string][]Provider
+	json.Unmarshal(f.mustInvoke(f.stranger, "GetProviders"), &providers)
+
+	if list := providers["providers"]; len(list) != 1 || list[0].Domains[0] != "istockphoto.com" || len(list[0].LicenseTypes) != 3 {
+
+		t.Fatalf("unexpected providers %+v", providers)
+
+	}
+
+}
+
+//=======================================================================================================================
+//  Events
+//=======================================================================================================================
+
+func TestEvents(t *testing.T) {
+
+	f := newFixture(t)
+
+	event := func(name string) ChaincodeEvent {
+
+		t.Helper()
+
+		var event ChaincodeEvent
+
+		if f.eventName != name || json.Unmarshal(f.event, &event) != nil || event.Type != name {
+
+			t.Fatalf("expected event %v, got %v %s", name, f.eventName, f.event)
+
+		}
+
+		if event.Version != EventVersion || event.TxID != f.txID || event.Timestamp != f.txTime.Format(time.RFC3339) {
+
+			t.Fatalf("unexpected event envelope %+v", event)
+
+		}
+
+		return event
+
+	}
+
+	f.mustInvoke(f.admin, "addUser", "carl@capgemini.com", `{"participant-type":"employee"}`)
+
+	if added := event(UserAddedEvent); added.Username != "carl@capgemini.com" || added.Actor != "admin" || added.From != nil {
+
+		t.Fatalf("unexpected event %+v", added)
+
+	}
+
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+
+	if demanded := event("ImageDemanded"); demanded.ImageID != "IMG1" || *demanded.From != StatusNone || *demanded.To != StatusDemanded || demanded.Actor != "alice@capgemini.com" {
+
+		t.Fatalf("unexpected event %+v", demanded)
+
+	}
+
+	f.mustInvoke(f.maria, "RejectImageDemand", "IMG1", "Too expensive")
+
+	if rejected := event("ImageRejected"); *rejected.From != StatusDemanded || rejected.Actor != "maria@capgemini.com" || rejected.Reason != "Too expensive" {
+
+		t.Fatalf("unexpected event %+v", rejected)
+
+	}
+
+	// Failed transactions emit nothing, queries neither
+	f.mustFail(f.maria, CodeInvalidState, "ApproveImageDemand", "IMG1")
+
+	if f.eventName != "" {
+
+		t.Fatalf("expected no event, got %v", f.eventName)
+
+	}
+
+	f.mustInvoke(f.maria, "getImage", "IMG1")
+
+	if f.eventName != "" {
+
+		t.Fatalf("expected no event, got %v", f.eventName)
+
+	}
+
+	// Several events of one transaction come as a batch
+	for i, id := range []string{"IMG2", "IMG3"} {
+
+		f.mustInvoke(f.alice, "DemandImage", demandJSON(id, ""))
+		f.mustInvoke(f.maria, "ApproveImageDemand", id)
+		event("ImageApproved")
+		f.mustInvoke(f.maria, "DeliverImage", id, id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64), "19.05.2017", "", licenseEnding("2017-05-01"))
+		event("ImageDelivered")
+
+	}
+
+	f.mustInvoke(f.maria, "ExpireLicenses")
+
+	var batch EventBatch
+
+	if f.eventName != BatchEvent || json.Unmarshal(f.event, &batch) != nil || batch.Version != EventVersion || len(batch.Events) != 2 {
+
+		t.Fatalf("expected a batch of two events, got %v %s", f.eventName, f.event)
+
+	}
+
+	for i, expired := range batch.Events {
+
+		if expired.Type != "ImageExpired" || expired.ImageID != []string{"IMG2", "IMG3"}[i] || *expired.From != StatusDelivered {
+
+			t.Fatalf("unexpected event %+v", expired)
+
+		}
+
+	}
+
+}
+
+//=======================================================================================================================
+//  GetImageHistory
+//=======================================================================================================================
+
+func TestGetImageHistory(t *testing.T) {
+
+	f := newFixture(t)
+
+	// A legacy image written before the migration, under its plain ID
+	f.state[LegacyImagesIndexName] = []byte(`["IMG1"]`)
+	f.state["IMG1"] = []byte(`{"id":"IMG1","url":"https://example.com/a.png","user":"alice@capgemini.com","status":1}`)
+	f.history["IMG1"] = append(f.history["IMG1"], &queryresult.KeyModification{TxId: "legacy", Value: f.state["IMG1"]})
+
+	// A legacy user under a plain key, its history must not be readable as an image
+	f.state[LegacyUsersIndexName] = []byte(`["carl@capgemini.com"]`)
+	f.state["carl@capgemini.com"] = []byte(`{"password":"123456","participant-type":"employee"}`)
+	f.history["carl@capgemini.com"] = append(f.history["carl@capgemini.com"], &queryresult.KeyModification{TxId: "legacy", Value: f.state["carl@capgemini.com"]})
+
+	if response := f.init(f.admin); response.Status != 200 {
+
+		t.Fatalf("Init failed: %v", response.Message)
+
+	}
+
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "a.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	var history struct {
+
+		Versions    []ImageVersion      `json:"versions"`
+
+	}
+
+	json.Unmarshal(f.mustInvoke(f.alice, "GetImageHistory", "IMG1"), &history)
+
+	fields := func(version ImageVersion) string {
+
+		var names []string
+
+		for _, change := range version.Changes {
+
+			names = append(names, change.Field)
+
+		}
+
+		return strings.Join(names, ",")
+
+	}
+
+	expected := []struct{ actor, fields string; deleted bool }{
+
+		{"", "id,status,url,user", false},                          // legacy write
+		{"", "id,status,url,user", true},                           // migration deletes the plain key...
+		{"", "id,status,url,user", false},                          // ...and writes the composite one
+		{"maria@capgemini.com", "author,md5-hash,name,purchase-date,remarks,status,status-changes", false},
+		{"maria@capgemini.com", "hashes,name,purchase-date,status,status-changes", false},
+
+	}
+
+	if len(history.Versions) != len(expected) {
+
+		t.Fatalf("expected %v versions, got %+v", len(expected), history.Versions)
+
+	}
+
+	for i, version := range history.Versions {
+
+		if version.Actor != expected[i].actor || fields(version) != expected[i].fields || version.Deleted != expected[i].deleted {
+
+			t.Errorf("version %v: expected %+v, got %v %v %v", i, expected[i], version.Actor, fields(version), version.Deleted)
+
+		}
+
+	}
+
+	if change := history.Versions[4].Changes[3]; string(change.Old) != "3" || string(change.New) != "2" {
+
+		t.Errorf("expected the status to change from approved to delivered, got %s to %s", change.Old, change.New)
+
+	}
+
+	image := f.image("IMG1")
+	delivery := image.StatusChanges[len(image.StatusChanges)-1]
+
+	if history.Versions[1].Value != nil || history.Versions[4].TxID != delivery.TxID || history.Versions[4].Timestamp != delivery.At {
+
+		t.Errorf("expected the last version to be the delivery %+v, got %+v", delivery, history.Versions[4])
+
+	}
+
+	f.mustFail(f.maria, CodeNotFound, "GetImageHistory", "UNKNOWN")
+	f.mustFail(f.maria, CodeNotFound, "GetImageHistory", "carl@capgemini.com")
+	f.mustFail(f.maria, CodeNotFound, "GetImageHistory", LegacyImagesIndexName)
+	f.mustFail(f.bob, CodeForbidden, "GetImageHistory", "IMG1")
+
+	// Transfers and purchase records change no status, their own records name the actor
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG2", ""))
+	f.mustInvoke(f.alice, "TransferImageLicense", "IMG2", "bob@capgemini.com", "Leaving")
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG2")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG2", "b.png", "sha256:" + strings.Repeat("1", 64), "19.05.2017")
+	f.transient = map[string][]byte{PurchaseRecordTransientKey: []byte(`{"price":4900, "currency":"eur", "invoice-number":"INV-2017-0815", "cost-center":"CC-4711"}`)}
+	f.mustInvoke(f.maria, "RecordImagePurchase", "IMG2")
+
+	history.Versions = nil
+	json.Unmarshal(f.mustInvoke(f.maria, "GetImageHistory", "IMG2"), &history)
+
+	if versions := history.Versions; len(versions) != 5 || versions[1].Actor != "alice@capgemini.com" || versions[4].Actor != "maria@capgemini.com" {
+
+		t.Errorf("expected the transfer by alice and the purchase record by maria, got %+v", versions)
+
+	}
+
+}
+
+//=======================================================================================================================
+//  ApproveImageDemand, RejectImageDemand and DeliverImage
+//=======================================================================================================================
+
+func TestApproveAndDeliverImage(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+
+	// Only approved demands can be delivered
+	f.mustFail(f.maria, CodeInvalidState, "DeliverImage", "IMG1", "search-icon.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	f.mustFail(f.bob, CodeForbidden, "ApproveImageDemand", "IMG1")
+	f.mustFail(f.maria, CodeNotFound, "ApproveImageDemand", "UNKNOWN")
+	f.mustFail(f.maria, CodeInvalidArgument, "ApproveImageDemand")
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustFail(f.maria, CodeInvalidState, "ApproveImageDemand", "IMG1")
+
+	f.mustFail(f.alice, CodeForbidden, "DeliverImage", "IMG1", "search-icon.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+	f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG1", "search-icon.png")
+	failure := f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG1", " ", "sha256:da39a3ee5e6b4b0d3255bfef95601890afd80709", "2017-13-01")
+
+	if len(failure.Details) != 3 {
+
+		t.Fatalf("expected name, hash and purchase date to fail, got %+v", failure.Details)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG1", "search-icon.png", "da39a3ee5e6b4b0d3255bfef95601890afd80709", "19.05.2017")
+	f.mustFail(f.maria, CodeInvalidArgument, "DeliverImage", "IMG1", "search-icon.png", "crc32:da39a3ee", "19.05.2017")
+	f.mustFail(f.maria, CodeNotFound, "DeliverImage", "UNKNOWN", "search-icon.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "search-icon.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	image := f.image("IMG1")
+
+	if image.Status != StatusDelivered || image.Name != "search-icon.png" || image.Hashes[HashSHA256] != emptyFileSHA256 || image.PurchaseDate != "19.05.2017" {
+
+		t.Fatalf("unexpected image %+v", image)
+
+	}
+
+	if last := image.StatusChanges[len(image.StatusChanges)-1]; last.From != StatusApproved || last.By != "maria@capgemini.com" {
+
+		t.Fatalf("unexpected status change %+v", last)
+
+	}
+
+	// Delivered images cannot be delivered again
+	f.mustFail(f.maria, CodeInvalidState, "DeliverImage", "IMG1", "search-icon.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+}
+
+func TestRejectImageDemand(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+
+	f.mustFail(f.maria, CodeInvalidArgument, "RejectImageDemand", "IMG1", "")
+	f.mustInvoke(f.maria, "RejectImageDemand", "IMG1", "Budget exceeded")
+
+	image := f.image("IMG1")
+
+	if last := image.StatusChanges[len(image.StatusChanges)-1]; image.Status != StatusRejected || last.Reason != "Budget exceeded" {
+
+		t.Fatalf("unexpected image %+v", image)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidState, "ApproveImageDemand", "IMG1")
+
+}
+
+func TestArchiveImage(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+
+	// Open demands are decided, not archived
+	f.mustFail(f.maria, CodeInvalidState, "ArchiveImage", "IMG1")
+	f.mustInvoke(f.maria, "RejectImageDemand", "IMG1", "Budget exceeded")
+
+	f.mustFail(f.alice, CodeForbidden, "ArchiveImage", "IMG1")
+	f.mustFail(f.maria, CodeNotFound, "ArchiveImage", "UNKNOWN")
+	f.mustInvoke(f.maria, "ArchiveImage", "IMG1", "Campaign ended")
+
+	if f.eventName != "ImageArchived" {
+
+		t.Fatalf("expected ImageArchived, got %q", f.eventName)
+
+	}
+
+	image := f.image("IMG1")
+
+	if last := image.StatusChanges[len(image.StatusChanges)-1]; image.Status != StatusArchived || last.Reason != "Campaign ended" {
+
+		t.Fatalf("unexpected image %+v", image)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidState, "ArchiveImage", "IMG1")
+
+}
+
+func TestApproversCannotApproveTheirOwnDemand(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustInvoke(f.maria, "DemandImage", demandJSON("IMG1", ""))
+	f.mustFail(f.maria, CodeForbidden, "ApproveImageDemand", "IMG1")
+
+}
+
+//=======================================================================================================================
+//  AuthenticateAsUser
+//=======================================================================================================================
+
+func TestAuthenticateAsUser(t *testing.T) {
+
+	f := newFixture(t)
+	f.transient = map[string][]byte{PasswordTransientKey: []byte("alice-secret")}
+	f.mustFail(f.stranger, CodeForbidden, "AuthenticateAsUser", "alice@capgemini.com")
+
+	f = newFixture(t, `{"legacy-auth":true}`)
+
+	authenticate := func(username string, password string) UserAuthenticationResult {
+
+		var result UserAuthenticationResult
+		f.transient = map[string][]byte{PasswordTransientKey: []byte(password)}
+		json.Unmarshal(f.mustInvoke(f.stranger, "AuthenticateAsUser", username), &result)
+
+		if result.User.Password != "" || result.User.PasswordHash != "" {
+
+			t.Fatalf("password material returned: %+v", result.User)
+
+		}
+
+		return result
+
+	}
+
+	if result := authenticate("alice@capgemini.com", "alice-secret"); !result.Authenticated || result.User.PType != ParticipantEmployee || result.PasswordUpgradeNeeded {
+
+		t.Fatalf("expected alice to authenticate: %+v", result)
+
+	}
+
+	if authenticate("alice@capgemini.com", "wrong").Authenticated || authenticate("nobody@capgemini.com", "alice-secret").Authenticated {
+
+		t.Fatalf("expected authentication to fail")
+
+	}
+
+	// The password is only accepted as transient data
+	f.mustFail(f.stranger, CodeInvalidArgument, "AuthenticateAsUser", "alice@capgemini.com")
+	f.mustFail(f.stranger, CodeInvalidArgument, "AuthenticateAsUser", "alice@capgemini.com", "alice-secret")
+
+}
+
+func TestUpgradePasswordHashUpgradesPlaintextPasswords(t *testing.T) {
+
+	stub := newMemoryStub(t)
+	stub.state[LegacyUsersIndexName] = []byte(`["alice@capgemini.com"]`)
+	stub.state["alice@capgemini.com"] = []byte(`{"password":"123456","participant-type":"employee"}`)
+	stub.init(nil, `{"legacy-auth":true}`)
+
+	var result UserAuthenticationResult
+	stub.transient = map[string][]byte{PasswordTransientKey: []byte("123456")}
+	json.Unmarshal(stub.mustInvoke(nil, "AuthenticateAsUser", "alice@capgemini.com"), &result)
+
+	// Authenticating never writes, it only tells the client to upgrade
+	if user, _ := GetUser(stub, "alice@capgemini.com"); !result.Authenticated || !result.PasswordUpgradeNeeded || user.PasswordHash != "" {
+
+		t.Fatalf("expected an upgrade to be needed: %+v", result)
+
+	}
+
+	stub.transient = map[string][]byte{PasswordTransientKey: []byte("wrong")}
+	stub.mustFail(nil, CodeForbidden, "UpgradePasswordHash", "alice@capgemini.com")
+
+	stub.transient = map[string][]byte{PasswordTransientKey: []byte("123456")}
+	stub.mustInvoke(nil, "UpgradePasswordHash", "alice@capgemini.com")
+
+	user, _ := GetUser(stub, "alice@capgemini.com")
+
+	if user.Password != "" || user.PasswordHash == "" {
+
+		t.Fatalf("plaintext password not upgraded: %+v", user)
+
+	}
+
+	result = UserAuthenticationResult{}
+	stub.transient = map[string][]byte{PasswordTransientKey: []byte("123456")}
+	json.Unmarshal(stub.mustInvoke(nil, "AuthenticateAsUser", "alice@capgemini.com"), &result)
+
+	if !result.Authenticated || result.PasswordUpgradeNeeded {
+
+		t.Fatalf("expected the upgraded password to authenticate: %+v", result)
+
+	}
+
+}
+
+//=======================================================================================================================
+//  Queries
+//=======================================================================================================================
+
+func TestGetUsers(t *testing.T) {
+
+	f := newFixture(t)
+
+	payload := f.mustInvoke(f.maria, "getUsers")
+
+	var users struct {
+
+		Items       []User      `json:"items"`
+		TotalCount  int         `json:"totalCount"`
+
+	}
+
+	json.Unmarshal(payload, &users)
+
+	if len(users.Items) != 3 || users.TotalCount != 3 || users.Items[0].Username != "alice@capgemini.com" {
+
+		t.Fatalf("unexpected users %s", payload)
+
+	}
+
+	if strings.Contains(string(payload), "password") {
+
+		t.Fatalf("password material returned: %s", payload)
+
+	}
+
+	f.mustFail(f.alice, CodeForbidden, "getUsers")
+
+}
+
+func TestImageQueries(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+	f.mustInvoke(f.bob, "DemandImage", demandJSON("IMG2", ""))
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG3", ""))
+
+	if images := f.imagePage(f.maria, "GetImages").Items; len(images) != 3 {
+
+		t.Fatalf("expected 3 images, got %v", len(images))
+
+	}
+
+	if images := f.imagePage(f.alice, "GetImagesByUser", "alice@capgemini.com").Items; len(images) != 2 || images[0].ID != "IMG1" || images[1].ID != "IMG3" {
+
+		t.Fatalf("unexpected images of alice %+v", images)
+
+	}
+
+	if images := f.imagePage(f.maria, "GetImagesByUser", "bob@capgemini.com").Items; len(images) != 1 {
+
+		t.Fatalf("unexpected images of bob %+v", images)
+
+	}
+
+	if images := f.images(f.maria, "GetPendingApprovals"); len(images) != 3 {
+
+		t.Fatalf("expected 3 pending approvals, got %v", len(images))
+
+	}
+
+	// Employees only see their own images
+	f.mustFail(f.alice, CodeForbidden, "GetImages")
+	f.mustFail(f.alice, CodeForbidden, "GetImagesByUser", "bob@capgemini.com")
+	f.mustFail(f.alice, CodeForbidden, "getImage", "IMG2")
+	f.mustFail(f.alice, CodeForbidden, "GetPendingApprovals")
+	f.mustInvoke(f.alice, "getImage", "IMG1")
+
+	f.mustFail(f.maria, CodeInvalidArgument, "getImage")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetImagesByUser")
+
+	f.mustFail(f.maria, CodeNotFound, "getImage", "UNKNOWN")
+
+	var transitions AllowedTransitions
+	json.Unmarshal(f.mustInvoke(f.alice, "GetAllowedTransitions", "IMG1"), &transitions)
+
+	if transitions.Status != StatusDemanded || len(transitions.Allowed) != 2 {
+
+		t.Fatalf("unexpected transitions %+v", transitions)
+
+	}
+
+	f.mustFail(f.alice, CodeForbidden, "GetAllowedTransitions", "IMG2")
+
+}
+
+func TestPagination(t *testing.T) {
+
+	f := newFixture(t)
+
+	// Delivered in both purchase date layouts, IMG2 is still demanded
+	purchaseDates := map[string]string{"IMG1": "2017-05-19", "IMG3": "01.03.2017", "IMG4": "2016-12-24", "IMG5": "19.05.2017"}
+
+	for i, id := range []string{"IMG1", "IMG2", "IMG3", "IMG4", "IMG5"} {
+
+		f.mustInvoke(f.alice, "DemandImage", demandJSON(id, ""))
+
+		if purchaseDates[id] != "" {
+
+			f.mustInvoke(f.maria, "ApproveImageDemand", id)
+			f.mustInvoke(f.maria, "DeliverImage", id, id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64), purchaseDates[id])
+
+		}
+
+	}
+
+	// Follows the bookmarks through all pages
+	all := func(sort string) string {
+
+		t.Helper()
+
+		var ids []string
+		page := imagePage{HasMore: true}
+
+		for page.HasMore {
+
+			page = f.imagePage(f.maria, "GetImages", "2", page.Bookmark, sort)
+
+			if page.TotalCount != 5 || len(page.Items) > 2 || page.HasMore != (page.Bookmark != "") {
+
+				t.Fatalf("unexpected page %+v", page)
+
+			}
+
+			for _, image := range page.Items {
+
+				ids = append(ids, image.ID)
+
+			}
+
+		}
+
+		return strings.Join(ids, ",")
+
+	}
+
+	for sort, expected := range map[string]string{
+
+		"":                 "IMG1,IMG2,IMG3,IMG4,IMG5",
+		"-id":              "IMG5,IMG4,IMG3,IMG2,IMG1",
+		"purchase-date":    "IMG2,IMG4,IMG3,IMG1,IMG5",
+		"-purchase-date":   "IMG5,IMG1,IMG3,IMG4,IMG2",
+		"status":           "IMG2,IMG1,IMG3,IMG4,IMG5",
+
+	} {
+
+		if ids := all(sort); ids != expected {
+
+			t.Errorf("sort %q: expected %v, got %v", sort, expected, ids)
+
+		}
+
+	}
+
+	// Network admins page by ID straight from the images index, counted from its keys
+	var ids []string
+	page := imagePage{HasMore: true}
+
+	for page.HasMore {
+
+		payload := f.mustInvoke(f.admin, "GetImages", "2", page.Bookmark)
+		json.Unmarshal(payload, &page)
+
+		if page.TotalCount != 5 || len(page.Items) > 2 || page.HasMore != (page.Bookmark != "") {
+
+			t.Fatalf("unexpected page %s", payload)
+
+		}
+
+		for _, image := range page.Items {
+
+			ids = append(ids, image.ID)
+
+		}
+
+	}
+
+	if strings.Join(ids, ",") != "IMG1,IMG2,IMG3,IMG4,IMG5" {
+
+		t.Errorf("expected all images by ID, got %v", ids)
+
+	}
+
+	// Images added between pages do not shift the next page
+	first := f.imagePage(f.maria, "GetImages", "2")
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG0", ""))
+
+	if next := f.imagePage(f.maria, "GetImages", "2", first.Bookmark); next.Items[0].ID != "IMG3" || next.TotalCount != 6 {
+
+		t.Fatalf("unexpected next page %+v", next)
+
+	}
+
+	if page := f.imagePage(f.alice, "GetImagesByUser", "alice@capgemini.com", "10"); len(page.Items) != 6 || page.HasMore || page.Bookmark != "" {
+
+		t.Fatalf("unexpected page %+v", page)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidArgument, "GetImages", "0")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetImages", "501")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetImages", "", "", "name")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetImages", "", "not a bookmark")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetImages", "2", first.Bookmark, "-id")
+	f.mustFail(f.maria, CodeInvalidArgument, "getUsers", "", "", "status")
+
+}
+
+func TestQueryImages(t *testing.T) {
+
+	f := newFixture(t)
+
+	demands := []struct{ id, author, url, purchaseDate string }{
+
+		{"IMG1", "ildogesto", "http://www.istockphoto.com/vector/a", "2017-05-19"},
+		{"IMG2", "erhui1979", "https://istockphoto.com/b", ""},
+		{"IMG3", "ildogesto", "https://images.example.org/c", "01.03.2017"},
+		{"IMG4", "someone", "https://notistockphoto.com/d", "2016-12-24"},
+
+	}
+
+	for i, demand := range demands {
+
+		f.mustInvoke(f.alice, "DemandImage", `{"id":"` + demand.id + `", "author":"` + demand.author + `", "url":"` + demand.url + `"}`)
+
+		if demand.purchaseDate != "" {
+
+			f.mustInvoke(f.maria, "ApproveImageDemand", demand.id)
+			f.mustInvoke(f.maria, "DeliverImage", demand.id, demand.id + ".png", "sha256:" + strings.Repeat(strconv.Itoa(i), 64), demand.purchaseDate)
+
+		}
+
+	}
+
+	filters := map[string]string{
+
+		`{}`:                                                             "IMG1,IMG2,IMG3,IMG4",
+		`{"author":"ildogesto"}`:                                         "IMG1,IMG3",
+		`{"author":{"$in":["erhui1979","someone"]}}`:                     "IMG2,IMG4",
+		`{"status":"Demanded"}`:                                          "IMG2",
+		`{"status":{"$in":[2,"approved"]}}`:                              "IMG1,IMG3,IMG4",
+		`{"status":{"$gt":1}}`:                                           "IMG1,IMG3,IMG4",
+		`{"purchase-date":{"$gte":"2017-01-01","$lt":"2017-05-19"}}`:     "IMG3",
+		`{"purchase-date":{"$lte":"2017-05-19"}}`:                        "IMG1,IMG3,IMG4",
+		`{"url-domain":"istockphoto.com"}`:                               "IMG1,IMG2",
+		`{"url-domain":{"$in":["example.org","notistockphoto.com"]}}`:    "IMG3,IMG4",
+		`{"author":"ildogesto", "purchase-date":"2017-05-19"}`:           "IMG1",
+		`{"user":"bob@capgemini.com"}`:                                   "",
+
+	}
+
+	// Rich queries and the index scan give the same results
+	for _, couchDB := range []bool{false, true} {
+
+		f.couchDB = couchDB
+
+		for filter, expected := range filters {
+
+			var ids []string
+
+			for _, image := range f.imagePage(f.maria, "QueryImages", filter).Items {
+
+				ids = append(ids, image.ID)
+
+			}
+
+			if strings.Join(ids, ",") != expected {
+
+				t.Errorf("couchDB %v, filter %v: expected %v, got %v", couchDB, filter, expected, ids)
+
+			}
+
+		}
+
+	}
+
+	// The stub evaluates selectors like CouchDB, so a selector stricter than the filter fails the comparison above
+	iterator, _ := f.GetQueryResult(`{"selector":{"$and":[{"author":{"$in":["ildogesto"]}},{"url":{"$regex":"example"}},{"status":{"$eq":2}}]}}`)
+	var matched []string
+
+	for iterator.HasNext() {
+
+		entry, _ := iterator.Next()
+		matched = append(matched, entry.Key)
+
+	}
+
+	if imageKey, _ := createCompositeKey(ImagesIndexName, []string{"IMG3"}); len(matched) != 1 || matched[0] != imageKey {
+
+		t.Fatalf("expected the selector to match IMG3 only, got %q", matched)
+
+	}
+
+	// Purchase dates are checked by the chaincode only
+	f.queries = nil
+	f.imagePage(f.maria, "QueryImages", `{"status":{"$in":[2,5]}, "url-domain":"istockphoto.com", "purchase-date":{"$gte":"2017-01-01"}}`)
+
+	if len(f.queries) != 1 || !strings.Contains(f.queries[0], `{"status":{"$in":[2,5]}}`) || !strings.Contains(f.queries[0], `"$regex"`) || strings.Contains(f.queries[0], "purchase-date") {
+
+		t.Fatalf("unexpected rich queries %v", f.queries)
+
+	}
+
+	// Paging applies to the filtered images
+	if page := f.imagePage(f.maria, "QueryImages", `{"author":"ildogesto"}`, "1", "", "-purchase-date"); page.TotalCount != 2 || !page.HasMore || page.Items[0].ID != "IMG1" {
+
+		t.Fatalf("unexpected page %+v", page)
+
+	}
+
+	failure := f.mustFail(f.maria, CodeInvalidArgument, "QueryImages", `{"remarks":"x", "author":{"$gt":"a"}, "status":"Lost", "purchase-date":"19.05.2017", "url-domain":"http://x"}`)
+
+	if len(failure.Details) != 5 {
+
+		t.Fatalf("expected every condition to fail, got %+v", failure.Details)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidArgument, "QueryImages", `["author"]`)
+	f.mustFail(f.maria, CodeInvalidArgument, "QueryImages", `{"status":{"$in":[]}}`)
+	f.mustFail(f.maria, CodeInvalidArgument, "QueryImages")
+	f.mustFail(f.alice, CodeForbidden, "QueryImages", `{}`)
+
+}
+
+func TestSecondaryIndexes(t *testing.T) {
+
+	f := newFixture(t)
+
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+	f.mustInvoke(f.bob, "DemandImage", `{"id":"IMG2", "author":"erhui1979", "url":"https://WWW.iStockPhoto.com:443/vector/teamwork"}`)
+	f.mustInvoke(f.alice, "DemandImage", `{"id":"IMG3", "author":"erhui1979", "url":"https://www.gettyimages.com/detail/1"}`)
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG3")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG3", "IMG3.png", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	ids := func(function string, args ...string) string {
+
+		t.Helper()
+
+		var ids []string
+
+		for _, image := range f.imagePage(f.maria, function, args...).Items {
+
+			ids = append(ids, image.ID)
+
+		}
+
+		return strings.Join(ids, ",")
+
+	}
+
+	for query, expected := range map[string]string{
+
+		"GetImagesByUser alice@capgemini.com":      "IMG1,IMG3",
+		"GetImagesByAuthor erhui1979":              "IMG2,IMG3",
+		"GetImagesByAuthor nobody":                 "",
+		"GetImagesByStatus Demanded":               "IMG2",
+		"GetImagesByStatus 3":                      "IMG1",
+		"GetImagesByStatus delivered":              "IMG3",
+		"GetImagesByProvider istockphoto.com":      "IMG1,IMG2",
+		"GetImagesByProvider www.gettyimages.com":  "IMG3",
+
+	} {
+
+		args := strings.Split(query, " ")
+
+		if got := ids(args[0], args[1:]...); got != expected {
+
+			t.Errorf("%v: expected %v, got %v", query, expected, got)
+
+		}
+
+	}
+
+	// Status changes move the image between status entries
+	demanded, _ := createCompositeKey(ImagesByStatusIndexName, []string{StatusDemanded.Key(), "IMG3"})
+	delivered, _ := createCompositeKey(ImagesByStatusIndexName, []string{StatusDelivered.Key(), "IMG3"})
+
+	if f.state[demanded] != nil || f.state[delivered] == nil {
+
+		t.Fatalf("expected only the delivered entry of IMG3")
+
+	}
+
+	if got := ids("GetImagesByAuthor", "erhui1979", "1", "", "-id"); got != "IMG3" {
+
+		t.Fatalf("expected the first page sorted descending, got %v", got)
+
+	}
+
+	f.mustFail(f.maria, CodeInvalidArgument, "GetImagesByStatus", "Lost")
+	f.mustFail(f.maria, CodeInvalidArgument, "GetImagesByProvider")
+	f.mustFail(f.alice, CodeForbidden, "GetImagesByAuthor", "ildogesto")
+
+}
+
+func TestUnknownFunction(t *testing.T) {
+
+	f := newFixture(t)
+	f.mustFail(f.admin, CodeInvalidArgument, "DropEverything")
+
+}
+
+//=======================================================================================================================
+//  Scenario - An employee demands an image, marketing approves and delivers it, everyone sees the result
+//=======================================================================================================================
+
+func TestScenarioDemandApproveDeliver(t *testing.T) {
+
+	f := newFixture(t)
+
+	f.mustInvoke(f.alice, "DemandImage", demandJSON("IMG1", ""))
+	f.mustInvoke(f.bob, "DemandImage", demandJSON("IMG2", ""))
+	f.mustInvoke(f.maria, "ApproveImageDemand", "IMG1")
+	f.mustInvoke(f.maria, "RejectImageDemand", "IMG2", "Duplicate of IMG1")
+	f.mustInvoke(f.maria, "DeliverImage", "IMG1", "IMG1.jpeg", "sha256:" + emptyFileSHA256, "19.05.2017")
+
+	images := f.imagePage(f.alice, "GetImagesByUser", "alice@capgemini.com").Items
+
+	if len(images) != 1 || images[0].Status != StatusDelivered || images[0].Name != "IMG1.jpeg" {
+
+		t.Fatalf("unexpected images of alice %+v", images)
+
+	}
+
+	var statuses []ImageStatus
+
+	for _, change := range images[0].StatusChanges {
+
+		statuses = append(statuses, change.To)
+
+	}
+
+	if len(statuses) != 3 || statuses[0] != StatusDemanded || statuses[1] != StatusApproved || statuses[2] != StatusDelivered {
+
+		t.Fatalf("unexpected status history %v", statuses)
+
+	}
+
+	if images = f.images(f.maria, "GetPendingApprovals"); len(images) != 0 {
+
+		t.Fatalf("expected no pending approvals, got %+v", images)
+
+	}
+
+	if image := f.image("IMG2"); image.Status != StatusRejected {
+
+		t.Fatalf("expected IMG2 to be rejected, got %v", image.Status)
+
+	}
+
+}
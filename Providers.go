@@ -0,0 +1,475 @@
+package main
+
+import (
+
+	"bytes"
+	"regexp"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Provider registry - The stock photo agencies images are bought from. A demand whose URL is on the domain of a
+// registered provider must match one of its URL patterns, regular expressions with a group named "asset" capturing
+// the provider's asset ID; the image then records the provider ID and asset ID. An organization can only demand an
+// asset again once its earlier image of the asset is rejected, expired, revoked or archived; other organizations
+// license the same asset on their own. URLs on other domains have no provider, as before the registry.
+//=======================================================================================================================
+
+const ProvidersIndexName        =   "provider~id"
+const ProviderAssetsIndexName   =   "provider~asset~organization"
+
+const AssetGroupName            =   "asset"
+
+type Provider struct {
+
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	Domains         []string    `json:"domains"`                   // subdomains included
+	URLPatterns     []string    `json:"url-patterns"`
+	LicenseTypes    []string    `json:"license-types"`
+
+}
+
+//=======================================================================================================================
+//  Parse provider - Decode and validate a provider for AddProvider and UpdateProvider
+//=======================================================================================================================
+
+func ParseProvider(providerID string, providerAsJSON string) (Provider, error) {
+
+	var provider Provider
+	var validation Validation
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(providerAsJSON)))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&provider); err != nil {
+
+		return provider, NewError(CodeInvalidArgument, "Provider is not valid JSON, reason: " + err.Error())
+
+	}
+
+	if provider.ID != "" && provider.ID != providerID {
+
+		validation.Fail("id", "must match the provider ID argument")
+
+	}
+
+	provider.ID = providerID
+
+	if strings.TrimSpace(provider.Name) == "" {
+
+		validation.Fail("name", "is required")
+
+	}
+
+	if len(provider.Domains) == 0 {
+
+		validation.Fail("domains", "must list at least one domain")
+
+	}
+
+	for i, domain := range provider.Domains {
+
+		provider.Domains[i] = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "www.")
+
+		if !domainName.MatchString(provider.Domains[i]) {
+
+			validation.Fail("domains", domain + " is not a domain name")
+
+		}
+
+	}
+
+	if len(provider.URLPatterns) == 0 {
+
+		validation.Fail("url-patterns", "must list at least one pattern")
+
+	}
+
+	for _, pattern := range provider.URLPatterns {
+
+		if reason := checkURLPattern(pattern); reason != "" {
+
+			validation.Fail("url-patterns", pattern + " " + reason)
+
+		}
+
+	}
+
+	if len(provider.LicenseTypes) == 0 {
+
+		validation.Fail("license-types", "must list at least one license type")
+
+	}
+
+	for i, licenseType := range provider.LicenseTypes {
+
+		provider.LicenseTypes[i] = strings.ToLower(licenseType)
+
+		if !licenseTypes[provider.LicenseTypes[i]] {
+
+			validation.Fail("license-types", licenseType + " is not one of royalty-free, rights-managed, editorial")
+
+		}
+
+	}
+
+	return provider, validation.Error("Invalid provider")
+
+}
+
+func checkURLPattern(pattern string) string {
+
+	compiled, err := regexp.Compile(pattern)
+
+	if err != nil {
+
+		return "is not a regular expression"
+
+	}
+
+	if !contains(compiled.SubexpNames(), AssetGroupName) {
+
+		return "has no group (?P<" + AssetGroupName + ">...) for the asset ID"
+
+	}
+
+	return ""
+
+}
+
+//=======================================================================================================================
+//  Get provider - NOT_FOUND if it is not registered
+//=======================================================================================================================
+
+func GetProvider(stub shim.ChaincodeStubInterface, providerID string) (Provider, error) {
+
+	providerAsBytes, err := GetObject(stub, ProvidersIndexName, providerID)
+
+	if err != nil {
+
+		return Provider{}, WrapError(err, "Could not retrieve provider " + providerID)
+
+	}
+
+	if providerAsBytes == nil {
+
+		return Provider{}, NewError(CodeNotFound, "Provider " + providerID + " is not registered")
+
+	}
+
+	var provider Provider
+
+	if err = json.Unmarshal(providerAsBytes, &provider); err != nil {
+
+		return Provider{}, WrapError(err, "Error while unmarshalling provider " + providerID)
+
+	}
+
+	return provider, nil
+
+}
+
+//=======================================================================================================================
+//  Add provider - args[0] = provider ID, args[1] = provider as JSON
+//=======================================================================================================================
+
+func AddProvider(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	provider, err := ParseProvider(args[0], args[1])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	providerAsBytes, err := json.Marshal(provider)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Error marshalling provider")
+
+	}
+
+	if err = Store(stub, provider.ID, ProvidersIndexName, providerAsBytes); err != nil {
+
+		return nil, err
+
+	}
+
+	return providerAsBytes, nil
+
+}
+
+//=======================================================================================================================
+//  Update provider - args[0] = provider ID, args[1] = provider as JSON, replacing the registered one. Images demanded
+//  before keep their provider and asset ID.
+//=======================================================================================================================
+
+func UpdateProvider(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if _, err := GetProvider(stub, args[0]); err != nil {
+
+		return nil, err
+
+	}
+
+	provider, err := ParseProvider(args[0], args[1])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	providerAsBytes, err := json.Marshal(provider)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Error marshalling provider")
+
+	}
+
+	if err = Update(stub, provider.ID, ProvidersIndexName, providerAsBytes); err != nil {
+
+		return nil, err
+
+	}
+
+	return providerAsBytes, nil
+
+}
+
+//=======================================================================================================================
+//  Get providers - All registered providers, by ID
+//=======================================================================================================================
+
+func GetProviders(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	providers := []Provider{}
+
+	err := ForEachInIndex(stub, ProvidersIndexName, func(providerID string, providerAsBytes []byte) error {
+
+		var provider Provider
+
+		if err := json.Unmarshal(providerAsBytes, &provider); err != nil {
+
+			return WrapError(err, "Error while unmarshalling provider " + providerID)
+
+		}
+
+		providers = append(providers, provider)
+
+		return nil
+
+	})
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return json.Marshal(map[string][]Provider{"providers": providers})
+
+}
+
+//=======================================================================================================================
+//  Identify provider - Set the provider and asset ID of a demanded image from its URL. Fails if the URL is on the
+//  domain of a provider but is not one of its asset URLs.
+//=======================================================================================================================
+
+func IdentifyProvider(stub shim.ChaincodeStubInterface, image *Image) error {
+
+	host, unmatched := urlHost(image.URL), ""
+
+	err := ForEachInIndex(stub, ProvidersIndexName, func(providerID string, providerAsBytes []byte) error {
+
+		var provider Provider
+
+		if err := json.Unmarshal(providerAsBytes, &provider); err != nil {
+
+			return WrapError(err, "Error while unmarshalling provider " + providerID)
+
+		}
+
+		if image.Provider != "" || !onDomains(host, provider.Domains) {
+
+			return nil
+
+		}
+
+		for _, pattern := range provider.URLPatterns {
+
+			compiled, err := regexp.Compile(pattern)
+
+			if err != nil {
+
+				return NewError(CodeInternal, "URL pattern " + pattern + " of provider " + provider.ID + " is invalid")
+
+			}
+
+			if assetID := matchAsset(compiled, image.URL); assetID != "" {
+
+				image.Provider, image.ProviderAssetID = provider.ID, assetID
+				return nil
+
+			}
+
+		}
+
+		unmatched = provider.Name
+
+		return nil
+
+	})
+
+	if err == nil && image.Provider == "" && unmatched != "" {
+
+		return NewError(CodeInvalidArgument, "URL " + image.URL + " is not an asset URL of provider " + unmatched)
+
+	}
+
+	return err
+
+}
+
+// The asset ID captured by a URL pattern, empty if the URL does not match
+func matchAsset(pattern *regexp.Regexp, rawURL string) string {
+
+	match := pattern.FindStringSubmatch(rawURL)
+
+	for i, name := range pattern.SubexpNames() {
+
+		if match != nil && name == AssetGroupName {
+
+			return match[i]
+
+		}
+
+	}
+
+	return ""
+
+}
+
+func onDomains(host string, domains []string) bool {
+
+	for _, domain := range domains {
+
+		if host == domain || strings.HasSuffix(host, "." + domain) {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+//=======================================================================================================================
+//  Register provider asset - Map the provider asset of a new image to its ID within its organization, ALREADY_EXISTS
+//  if the organization holds another image of the asset that is still demanded, approved or licensed
+//=======================================================================================================================
+
+func RegisterProviderAsset(stub shim.ChaincodeStubInterface, image Image) error {
+
+	if image.Provider == "" {
+
+		return nil
+
+	}
+
+	key, err := stub.CreateCompositeKey(ProviderAssetsIndexName, []string{image.Provider, image.ProviderAssetID, image.Organization})
+
+	if err != nil {
+
+		return NewError(CodeInvalidArgument, "Error creating key for asset " + image.ProviderAssetID + ", reason: " + err.Error())
+
+	}
+
+	existingID, err := stub.GetState(key)
+
+	if err != nil {
+
+		return WrapError(err, "Could not look up asset " + image.ProviderAssetID + " of provider " + image.Provider)
+
+	}
+
+	if existingID != nil {
+
+		existing, err := LoadImage(stub, string(existingID))
+
+		if err != nil && !HasCode(err, CodeNotFound) {
+
+			return err
+
+		}
+
+		if err == nil && holdsProviderAsset(existing) {
+
+			return NewError(CodeAlreadyExists, "Asset " + image.ProviderAssetID + " of provider " + image.Provider + " is already demanded as image " + existing.ID)
+
+		}
+
+	}
+
+	if err = stub.PutState(key, []byte(image.ID)); err != nil {
+
+		return WrapError(err, "Error registering asset " + image.ProviderAssetID + " of provider " + image.Provider)
+
+	}
+
+	return nil
+
+}
+
+func holdsProviderAsset(image Image) bool {
+
+	switch image.Status {
+
+	case StatusRejected, StatusExpired, StatusRevoked, StatusArchived:
+
+		return false
+
+	}
+
+	return true
+
+}
+
+//=======================================================================================================================
+//  Check provider license - The license type of a delivery must be one the image's provider offers
+//=======================================================================================================================
+
+func CheckProviderLicense(stub shim.ChaincodeStubInterface, image Image, license *License) error {
+
+	if image.Provider == "" || license == nil {
+
+		return nil
+
+	}
+
+	provider, err := GetProvider(stub, image.Provider)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if !contains(provider.LicenseTypes, license.Type) {
+
+		return NewError(CodeInvalidArgument, provider.Name + " does not offer " + license.Type + " licenses, only " + strings.Join(provider.LicenseTypes, ", "))
+
+	}
+
+	return nil
+
+}
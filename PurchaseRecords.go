@@ -0,0 +1,309 @@
+package main
+
+import (
+
+	"time"
+	"bytes"
+	"strings"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Purchase records - Price and contract details of a purchase are kept in a private data collection of the purchasing
+// organization, "purchases" followed by its MSP ID (see collections_config.json). Only the peers of that organization
+// store the record; the image on the public ledger links to it by organization and SHA-256 hash. The record is passed
+// in the transient data of the proposal, so it does not end up in the transaction either.
+//=======================================================================================================================
+
+const PurchaseCollectionPrefix    =   "purchases"
+const PurchaseRecordTransientKey  =   "purchase-record"
+const PurchaseRecordsIndexName    =   "purchase~id"
+
+type ImagePurchaseRecord struct {
+
+	ImageID             string      `json:"image-id"`
+	Price               int64       `json:"price"`                         // in the minor unit of the currency, e.g. cents
+	Currency            string      `json:"currency"`                      // ISO 4217 code
+	InvoiceNumber       string      `json:"invoice-number"`
+	ProviderContract    string      `json:"provider-contract,omitempty"`
+	CostCenter          string      `json:"cost-center"`
+	MSPID               string      `json:"msp-id"`                        // set by the chaincode, like the fields below
+	RecordedBy          string      `json:"recorded-by"`
+	RecordedAt          string      `json:"recorded-at"`
+
+}
+
+type PurchaseRecordLink struct {
+
+	MSPID               string      `json:"msp-id"`
+	Collection          string      `json:"collection"`
+	Hash                string      `json:"hash"`
+	RecordedBy          string      `json:"recorded-by"`
+	TxID                string      `json:"tx-id"`
+
+}
+
+func PurchaseCollection(mspID string) string {
+
+	return PurchaseCollectionPrefix + mspID
+
+}
+
+//=======================================================================================================================
+//  Parse purchase record - Decode and validate the transient record of RecordImagePurchase
+//=======================================================================================================================
+
+func ParsePurchaseRecord(recordAsJSON []byte) (ImagePurchaseRecord, error) {
+
+	var record ImagePurchaseRecord
+	var validation Validation
+
+	decoder := json.NewDecoder(bytes.NewReader(recordAsJSON))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&record); err != nil {
+
+		return record, NewError(CodeInvalidArgument, "Purchase record is not valid JSON, reason: " + err.Error())
+
+	}
+
+	if record.Price < 0 {
+
+		validation.Fail("price", "must not be negative")
+
+	}
+
+	record.Currency = strings.ToUpper(strings.TrimSpace(record.Currency))
+
+	if !isCurrencyCode(record.Currency) {
+
+		validation.Fail("currency", "must be an ISO 4217 code")
+
+	}
+
+	if strings.TrimSpace(record.InvoiceNumber) == "" {
+
+		validation.Fail("invoice-number", "is required")
+
+	}
+
+	if strings.TrimSpace(record.CostCenter) == "" {
+
+		validation.Fail("cost-center", "is required")
+
+	}
+
+	for _, field := range []struct{ name, value string }{{"image-id", record.ImageID}, {"msp-id", record.MSPID},
+		{"recorded-by", record.RecordedBy}, {"recorded-at", record.RecordedAt}} {
+
+		if field.value != "" {
+
+			validation.Fail(field.name, "is set by the chaincode")
+
+		}
+
+	}
+
+	return record, validation.Error("Invalid purchase record")
+
+}
+
+// Three upper case letters, as ISO 4217 codes
+func isCurrencyCode(value string) bool {
+
+	return len(value) == 3 && strings.Trim(value, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+
+}
+
+func purchaseRecordKey(stub shim.ChaincodeStubInterface, imageID string) (string, error) {
+
+	return CreateKey(stub, PurchaseRecordsIndexName, imageID)
+
+}
+
+//=======================================================================================================================
+//  Record image purchase - args[0] = image ID, transient "purchase-record" = the record. Stores the record in the
+//  collection of the caller's organization and links it from the image. Only that organization can replace it.
+//=======================================================================================================================
+
+func RecordImagePurchase(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	transient, err := stub.GetTransient()
+
+	if err != nil {
+
+		return nil, WrapError(err, "Could not read the transient data")
+
+	}
+
+	if transient[PurchaseRecordTransientKey] == nil {
+
+		return nil, NewError(CodeInvalidArgument, "The purchase record must be passed as transient data '" + PurchaseRecordTransientKey + "'")
+
+	}
+
+	record, err := ParsePurchaseRecord(transient[PurchaseRecordTransientKey])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	image, err := LoadImage(stub, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if image.Status != StatusDelivered && image.Status != StatusExpired {
+
+		return nil, NewError(CodeInvalidState, "Image " + image.ID + " is " + image.Status.String() + ", purchases are recorded for delivered images")
+
+	}
+
+	if image.PurchaseRecord != nil && image.PurchaseRecord.MSPID != caller.MSPID {
+
+		return nil, NewError(CodeForbidden, "The purchase of image " + image.ID + " was recorded by " + image.PurchaseRecord.MSPID)
+
+	}
+
+	txTime, err := GetTransactionTime(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	record.ImageID = image.ID
+	record.MSPID = caller.MSPID
+	record.RecordedBy = caller.Name()
+	record.RecordedAt = txTime.Format(time.RFC3339)
+
+	recordAsBytes, err := json.Marshal(record)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Error marshalling purchase record")
+
+	}
+
+	key, err := purchaseRecordKey(stub, image.ID)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	collection := PurchaseCollection(caller.MSPID)
+
+	// The peer fails to read from collections that are not in the collection config of the chaincode
+	if _, err = stub.GetPrivateData(collection, key); err != nil {
+
+		return nil, NewError(CodeInvalidState, "Collection " + collection + " for the purchase records of " + caller.MSPID + " is not available, it has to be added to the collection config of the chaincode, reason: " + err.Error())
+
+	}
+
+	if err = stub.PutPrivateData(collection, key, recordAsBytes); err != nil {
+
+		return nil, WrapError(err, "Error storing purchase record in collection " + collection)
+
+	}
+
+	digest := sha256.Sum256(recordAsBytes)
+	image.PurchaseRecord = &PurchaseRecordLink{MSPID: caller.MSPID, Collection: collection, Hash: hex.EncodeToString(digest[:]),
+		RecordedBy: record.RecordedBy, TxID: stub.GetTxID()}
+
+	if err = SaveImage(stub, image); err != nil {
+
+		return nil, err
+
+	}
+
+	return json.Marshal(image.PurchaseRecord)
+
+}
+
+//=======================================================================================================================
+//  Get image purchase record - args[0] = image ID. Only callers of the purchasing organization can read the record,
+//  from a peer of that organization.
+//=======================================================================================================================
+
+func GetImagePurchaseRecord(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	image, err := LoadImage(stub, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if image.PurchaseRecord == nil {
+
+		return nil, NewError(CodeNotFound, "No purchase is recorded for image " + image.ID)
+
+	}
+
+	if image.PurchaseRecord.MSPID != caller.MSPID {
+
+		return nil, NewError(CodeForbidden, "The purchase of image " + image.ID + " belongs to " + image.PurchaseRecord.MSPID)
+
+	}
+
+	key, err := purchaseRecordKey(stub, image.ID)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	recordAsBytes, err := stub.GetPrivateData(image.PurchaseRecord.Collection, key)
+
+	if err != nil {
+
+		return nil, WrapError(err, "Could not read collection " + image.PurchaseRecord.Collection)
+
+	}
+
+	if recordAsBytes == nil {
+
+		return nil, NewError(CodeNotFound, "The purchase record of image " + image.ID + " is not available on this peer")
+
+	}
+
+	// The record must be the one the image links to
+	if digest := sha256.Sum256(recordAsBytes); hex.EncodeToString(digest[:]) != image.PurchaseRecord.Hash {
+
+		return nil, NewError(CodeInternal, "The purchase record of image " + image.ID + " does not match its hash")
+
+	}
+
+	return recordAsBytes, nil
+
+}
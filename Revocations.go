@@ -0,0 +1,144 @@
+package main
+
+import (
+
+	"time"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Revocation - Why and on what evidence the license of an image was revoked, e.g. because the provider withdrew the
+// picture. The evidence is a digest of the document proving it, which is kept outside the ledger. A revoked image
+// stays revoked when it is archived: verifying it fails with LICENSE_REVOKED, so publishing systems cannot mistake it
+// for an image that is merely not licensed. Revoked images are listed in an index of their own, which archiving
+// leaves alone.
+//=======================================================================================================================
+
+const RevokedImagesIndexName    =   "revoked~id"
+
+type Revocation struct {
+
+	Reason      string      `json:"reason"`
+	Evidence    string      `json:"evidence"`      // <algorithm>:<hex digest>
+	By          string      `json:"by"`
+	At          string      `json:"at"`
+	TxID        string      `json:"tx-id"`
+
+}
+
+//=======================================================================================================================
+//  Revoked error - The LICENSE_REVOKED error of verification queries for a revoked image, nil if it is not revoked
+//=======================================================================================================================
+
+func RevokedError(image Image) error {
+
+	if image.Revocation == nil {
+
+		return nil
+
+	}
+
+	return NewError(CodeRevoked, "The license of image " + image.ID + " was revoked at " + image.Revocation.At + ": " + image.Revocation.Reason)
+
+}
+
+//=======================================================================================================================
+//  Revoke image license - args[0] = image ID, args[1] = reason, args[2] = evidence digest, see ParseDigest. Only
+//  delivered and expired images can be revoked; the status change emits ImageRevoked.
+//=======================================================================================================================
+
+func RevokeImageLicense(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	reason := strings.TrimSpace(args[1])
+
+	if reason == "" {
+
+		return nil, NewError(CodeInvalidArgument, "A reason is required for revoking an image license")
+
+	}
+
+	algorithm, digest, err := ParseDigest(args[2])
+
+	if err != nil {
+
+		return nil, WrapError(err, "Invalid evidence")
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	image, err := LoadImage(stub, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if err = TransitionImage(stub, &image, StatusRevoked, caller.Name(), reason); err != nil {
+
+		return nil, err
+
+	}
+
+	txTime, err := GetTransactionTime(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	image.Revocation = &Revocation{
+
+		Reason:   reason,
+		Evidence: algorithm + ":" + digest,
+		By:       caller.Name(),
+		At:       txTime.Format(time.RFC3339),
+		TxID:     stub.GetTxID(),
+
+	}
+
+	if err = SaveImage(stub, image); err != nil {
+
+		return nil, err
+
+	}
+
+	key, err := stub.CreateCompositeKey(RevokedImagesIndexName, []string{image.ID})
+
+	if err != nil {
+
+		return nil, NewError(CodeInvalidArgument, "Error creating key for image " + image.ID + " in index '" + RevokedImagesIndexName + "', reason: " + err.Error())
+
+	}
+
+	if err = stub.PutState(key, indexEntryValue); err != nil {
+
+		return nil, WrapError(err, "Error adding image " + image.ID + " to index '" + RevokedImagesIndexName + "'")
+
+	}
+
+	return json.Marshal(image.Revocation)
+
+}
+
+//=======================================================================================================================
+//  Get revoked images - args[0..2] = page size, bookmark and sort as described in Pagination.go. Lists the revoked
+//  images of the caller's organization, also those archived since.
+//=======================================================================================================================
+
+func GetRevokedImages(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	return pageImagesUnder(stub, args, 0, RevokedImagesIndexName, []string{})
+
+}
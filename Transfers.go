@@ -0,0 +1,166 @@
+package main
+
+import (
+
+	"time"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Ownership transfer - A change of the user an image belongs to. The transfers of an image form its ownership chain,
+// oldest first; the first owner is the user who demanded it. Departments are those of the users at the time.
+//=======================================================================================================================
+
+type OwnershipTransfer struct {
+
+	From            string      `json:"from"`
+	FromDepartment  string      `json:"from-department,omitempty"`
+	To              string      `json:"to"`
+	ToDepartment    string      `json:"to-department,omitempty"`
+	By              string      `json:"by"`
+	At              string      `json:"at"`
+	TxID            string      `json:"tx-id"`
+	Reason          string      `json:"reason"`
+
+}
+
+//=======================================================================================================================
+//  Check transferable - Demands can always be handed over, licensed images only if their license allows it
+//=======================================================================================================================
+
+func checkTransferable(image Image) error {
+
+	switch image.Status {
+
+	case StatusDemanded, StatusApproved:
+
+		return nil
+
+	case StatusDelivered, StatusExpired:
+
+		if image.License == nil || !image.License.Transferable {
+
+			return NewError(CodeInvalidState, "The license of image " + image.ID + " does not allow a transfer")
+
+		}
+
+		return nil
+
+	}
+
+	return NewError(CodeInvalidState, "Image " + image.ID + " is " + image.Status.String() + " and cannot be transferred")
+
+}
+
+//=======================================================================================================================
+//  Transfer image license - args[0] = image ID, args[1] = new owner, args[2] = reason. Moves the image to the new
+//  owner, who must be a registered user of the image's organization, and records the transfer in the ownership chain.
+//=======================================================================================================================
+
+func TransferImageLicense(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	newOwner, reason := args[1], strings.TrimSpace(args[2])
+
+	if reason == "" {
+
+		return nil, NewError(CodeInvalidArgument, "A reason is required for transferring an image license")
+
+	}
+
+	caller, err := GetCaller(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	image, err := LoadImage(stub, args[0])
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if image.User == newOwner {
+
+		return nil, NewError(CodeInvalidArgument, "Image " + image.ID + " already belongs to " + newOwner)
+
+	}
+
+	if err = checkTransferable(image); err != nil {
+
+		return nil, err
+
+	}
+
+	to, err := GetUser(stub, newOwner)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	if to.Organization != image.Organization {
+
+		return nil, NewError(CodeForbidden, "Image " + image.ID + " cannot be transferred to a user of another organization")
+
+	}
+
+	// Legacy images may belong to users that were never migrated
+	from, err := GetUser(stub, image.User)
+
+	if err != nil && !HasCode(err, CodeNotFound) {
+
+		return nil, err
+
+	}
+
+	txTime, err := GetTransactionTime(stub)
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	transfer := OwnershipTransfer{
+
+		From:           image.User,
+		FromDepartment: from.Department,
+		To:             to.Username,
+		ToDepartment:   to.Department,
+		By:             caller.Name(),
+		At:             txTime.Format(time.RFC3339),
+		TxID:           stub.GetTxID(),
+		Reason:         reason,
+
+	}
+
+	image.User = to.Username
+	image.OwnershipChain = append(image.OwnershipChain, transfer)
+
+	// Moves the image in the user index too
+	if err = SaveImage(stub, image); err != nil {
+
+		return nil, err
+
+	}
+
+	err = EmitEvent(stub, ChaincodeEvent{Type: LicenseTransferredEvent, ImageID: image.ID, Username: transfer.To,
+		PreviousUser: transfer.From, Actor: transfer.By, Reason: reason})
+
+	if err != nil {
+
+		return nil, err
+
+	}
+
+	return json.Marshal(transfer)
+
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+
+	"sort"
+	"time"
+	"strings"
+	"net/url"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+)
+
+//=======================================================================================================================
+// Field error - A field of a payload that failed validation
+//=======================================================================================================================
+
+type FieldError struct {
+
+	Field       string      `json:"field"`
+	Reason      string      `json:"reason"`
+
+}
+
+//=======================================================================================================================
+// Validation - Collects the field errors of a payload, so that a caller gets all of them in one response
+//=======================================================================================================================
+
+type Validation struct {
+
+	FieldErrors     []FieldError
+
+}
+
+func (v *Validation) Fail(field string, reason string) {
+
+	v.FieldErrors = append(v.FieldErrors, FieldError{Field: field, Reason: reason})
+
+}
+
+// Error is nil if no field failed, else an INVALID_ARGUMENT error listing every failure as detail
+func (v *Validation) Error(message string) error {
+
+	if len(v.FieldErrors) == 0 {
+
+		return nil
+
+	}
+
+	return &ChaincodeError{Code: CodeInvalidArgument, Message: message, Details: v.FieldErrors}
+
+}
+
+//=======================================================================================================================
+// Image fields - Status and status changes are owned by the chaincode, hashes and the purchase date are set on
+// delivery. A demand may contain the other fields of an image.
+//=======================================================================================================================
+
+// Value of the legacy clients for fields that are not known yet, treated as empty
+const UndefinedPlaceholder = "UNDEFINED"
+
+var reservedFields = map[string]string{"status": "is set by the chaincode", "status-changes": "is set by the chaincode",
+	"hashes": "is set on delivery", "purchase-record": "is set by RecordImagePurchase",
+	"ownership-chain": "is set by TransferImageLicense", "revocation": "is set by RevokeImageLicense",
+	"organization": "is the organization of the user", "budget-reservation": "is set by the chaincode",
+	"provider": "is derived from the url", "provider-asset-id": "is derived from the url",
+	"price": "is passed as transient data " + PriceTransientKey, "currency": "is passed as transient data " + PriceTransientKey}
+
+// Accepted purchase date formats
+var purchaseDateLayouts = []string{"02.01.2006", "2006-01-02"}
+
+//=======================================================================================================================
+//  Validate image demand - Parse the JSON payload of DemandImage, placeholders are cleared
+//=======================================================================================================================
+
+func ValidateImageDemand(stub shim.ChaincodeStubInterface, imageAsJSON string) (Image, error) {
+
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal([]byte(imageAsJSON), &fields); err != nil {
+
+		return Image{}, NewError(CodeInvalidArgument, "Error while unmarshalling image, reason: " + err.Error())
+
+	}
+
+	var validation Validation
+	var image Image
+
+	targets := map[string]*string{"id": &image.ID, "name": &image.Name, "author": &image.Author, "url": &image.URL,
+		"user": &image.User, "remarks": &image.Remarks, "md5-hash": &image.MD5Hash, "purchase-date": &image.PurchaseDate}
+
+	names := make([]string, 0, len(fields))
+
+	for name := range fields {
+
+		names = append(names, name)
+
+	}
+
+	// Report in a stable order, map iteration is random
+	sort.Strings(names)
+
+	for _, name := range names {
+
+		target, allowed := targets[name]
+
+		if reason, reserved := reservedFields[name]; reserved {
+
+			validation.Fail(name, reason)
+
+		} else if !allowed {
+
+			validation.Fail(name, "is not a field of an image")
+
+		} else if err := json.Unmarshal(fields[name], target); err != nil {
+
+			// Decoding the fields one by one reports every mistyped field, not the first one only
+			validation.Fail(name, "must be a string")
+
+		}
+
+	}
+
+	for _, field := range []*string{&image.Name, &image.Author, &image.Remarks, &image.MD5Hash, &image.PurchaseDate} {
+
+		if *field == UndefinedPlaceholder {
+
+			*field = ""
+
+		}
+
+	}
+
+	if strings.TrimSpace(image.ID) == "" {
+
+		validation.Fail("id", "is required")
+
+	}
+
+	if image.URL == "" {
+
+		validation.Fail("url", "is required")
+
+	} else if reason := checkURL(image.URL); reason != "" {
+
+		validation.Fail("url", reason)
+
+	}
+
+	if image.User != "" {
+
+		userAsBytes, err := GetObject(stub, UsersIndexName, image.User)
+
+		if err != nil {
+
+			return Image{}, err
+
+		}
+
+		if userAsBytes == nil {
+
+			validation.Fail("user", "user " + image.User + " does not exist")
+
+		}
+
+	}
+
+	if image.MD5Hash != "" {
+
+		validation.Fail("md5-hash", "is set on delivery")
+
+	}
+
+	if image.PurchaseDate != "" {
+
+		validation.Fail("purchase-date", "is set on delivery")
+
+	}
+
+	return image, validation.Error("Invalid image demand")
+
+}
+
+func checkURL(rawURL string) string {
+
+	parsed, err := url.Parse(rawURL)
+
+	if err != nil {
+
+		return "is not a valid URL"
+
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+
+		return "must be an http or https URL"
+
+	}
+
+	if parsed.Host == "" {
+
+		return "must have a host"
+
+	}
+
+	return ""
+
+}
+
+//=======================================================================================================================
+//  Delivery - The validated arguments of DeliverImage
+//=======================================================================================================================
+
+type Delivery struct {
+
+	ImageID         string
+	Name            string
+	Hashes          map[string]string
+	PerceptualHash  *PerceptualHash
+	License         *License
+	PurchaseDate    string
+
+}
+
+//=======================================================================================================================
+//  Validate image delivery - args: id, name, comma separated digests of the file (see ParseDigest) and optionally a
+//  perceptual hash (see ParsePerceptualHash), purchase date, delivering user, license JSON (see ParseLicense). A SHA-2
+//  digest is required unless legacyDigests is set.
+//=======================================================================================================================
+
+func ValidateImageDelivery(args []string, legacyDigests bool) (Delivery, error) {
+
+	var validation Validation
+
+	delivery := Delivery{
+
+		ImageID:        args[0],
+		Name:           strings.TrimSpace(args[1]),
+		PurchaseDate:   args[3],
+
+	}
+
+	if delivery.ImageID == "" {
+
+		validation.Fail("id", "is required")
+
+	}
+
+	if delivery.Name == "" || delivery.Name == UndefinedPlaceholder {
+
+		validation.Fail("name", "is required")
+
+	}
+
+	var digests []string
+
+	for _, item := range strings.Split(args[2], ",") {
+
+		if !IsPerceptualHash(item) {
+
+			digests = append(digests, item)
+			continue
+
+		}
+
+		perceptualHash, err := ParsePerceptualHash(item)
+
+		if err != nil {
+
+			validation.Fail("hash", AsChaincodeError(err).Message)
+
+		} else if delivery.PerceptualHash != nil {
+
+			validation.Fail("hash", "has more than one perceptual hash")
+
+		} else {
+
+			delivery.PerceptualHash = &perceptualHash
+
+		}
+
+	}
+
+	delivery.Hashes = ParseDigests(digests, &validation, "hash")
+
+	if len(digests) == 0 {
+
+		validation.Fail("hash", "is required")
+
+	} else if len(delivery.Hashes) > 0 && !hasStrongDigest(delivery.Hashes) && !legacyDigests {
+
+		validation.Fail("hash", "needs a sha256 or sha512 digest, md5 and sha1 are only accepted alongside one")
+
+	}
+
+	if !isPurchaseDate(delivery.PurchaseDate) {
+
+		validation.Fail("purchase-date", "must be a date as " + strings.Join(purchaseDateLayouts, " or "))
+
+	}
+
+	if licenseAsJSON := optionalArg(args, 5); licenseAsJSON != "" {
+
+		delivery.License = ParseLicense(licenseAsJSON, &validation)
+
+	}
+
+	return delivery, validation.Error("Invalid image delivery")
+
+}
+
+func isPurchaseDate(date string) bool {
+
+	for _, layout := range purchaseDateLayouts {
+
+		if _, err := time.Parse(layout, date); err == nil {
+
+			return true
+
+		}
+
+	}
+
+	return false
+
+}
+
+// Purchase date as YYYY-MM-DD whichever layout it was delivered in, "" if there is none
+func normalizedPurchaseDate(image Image) string {
+
+	for _, layout := range purchaseDateLayouts {
+
+		if date, err := time.Parse(layout, image.PurchaseDate); err == nil {
+
+			return date.Format("2006-01-02")
+
+		}
+
+	}
+
+	return ""
+
+}